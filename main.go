@@ -118,6 +118,16 @@ func printUsage() {
 	fmt.Println("  -trace              Enable trace mode")
 	fmt.Println("  -memory-limit int   Memory limit in MB (default 1024)")
 	fmt.Println("  -max-goroutines int Maximum number of goroutines (default 1000)")
+	fmt.Println("  -fake-clock         Use a virtual clock advanced only by clock.advance()")
+	fmt.Println("  -callback-mode m    Run scheduler callbacks \"isolated\" (default) or on the \"main\" state")
+	fmt.Println("  -http-cassette path Record HTTP exchanges to, or replay them from, a cassette file")
+	fmt.Println("  -http-cassette-mode Cassette mode: auto (default), record or replay")
+	fmt.Println("  -http-proxy url     Proxy for outbound HTTP (http, https or socks5 URL, or none)")
+	fmt.Println("  -http-ca-file path  Extra PEM CA bundle trusted by outbound HTTPS")
+	fmt.Println("  -http-cert path     Client certificate for outbound mutual TLS")
+	fmt.Println("  -http-key path      Private key for -http-cert")
+	fmt.Println("  -http-insecure      Skip TLS certificate verification (testing only)")
+	fmt.Println("  -job-store path     File used to persist named scheduler jobs (default .solvm/jobs.json)")
 	fmt.Println("  -version            Show version information")
 	fmt.Println("  -update             Update to the latest version")
 	fmt.Println("\nExamples:")
@@ -177,6 +187,16 @@ func main() {
 	trace := flag.Bool("trace", false, "Enable trace mode")
 	memoryLimit := flag.Int("memory-limit", 1024, "Memory limit in MB")
 	maxGoroutines := flag.Int("max-goroutines", 1000, "Maximum number of goroutines")
+	fakeClock := flag.Bool("fake-clock", false, "Use a virtual clock advanced only by clock.advance()")
+	callbackMode := flag.String("callback-mode", "isolated", "Run scheduler callbacks \"isolated\" or on the \"main\" state")
+	cassette := flag.String("http-cassette", "", "Record HTTP exchanges to, or replay them from, a cassette file")
+	cassetteMode := flag.String("http-cassette-mode", "auto", "Cassette mode: auto, record or replay")
+	httpProxy := flag.String("http-proxy", "", "Proxy for outbound HTTP (http, https or socks5 URL, or none)")
+	httpCAFile := flag.String("http-ca-file", "", "Extra PEM CA bundle trusted by outbound HTTPS")
+	httpCert := flag.String("http-cert", "", "Client certificate for outbound mutual TLS")
+	httpKey := flag.String("http-key", "", "Private key for -http-cert")
+	httpInsecure := flag.Bool("http-insecure", false, "Skip TLS certificate verification (testing only)")
+	jobStore := flag.String("job-store", "", "File used to persist named scheduler jobs (default .solvm/jobs.json)")
 	showVersion := flag.Bool("version", false, "Show version information")
 	update := flag.Bool("update", false, "Update to the latest version")
 
@@ -204,6 +224,26 @@ func main() {
 		Trace:         *trace,
 		MemoryLimit:   int64(*memoryLimit) * 1024 * 1024,
 		MaxGoroutines: *maxGoroutines,
+		JobStore:      *jobStore,
+		FakeClock:     *fakeClock,
+		CallbackMode:  *callbackMode,
+		HTTP: vm.HTTPClientConfig{
+			Proxy:              *httpProxy,
+			CAFile:             *httpCAFile,
+			CertFile:           *httpCert,
+			KeyFile:            *httpKey,
+			InsecureSkipVerify: *httpInsecure,
+		},
+	}
+
+	if err := vm.ValidateCallbackMode(config.CallbackMode); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := config.HTTP.Validate(); err != nil {
+		fmt.Printf("Error in HTTP client options: %v\n", err)
+		os.Exit(1)
 	}
 
 	if flag.NArg() == 0 {
@@ -235,6 +275,7 @@ func main() {
 
 	if isServer {
 		*timeout = 0
+		config.Timeout = 0
 		fmt.Println("Server mode detected: timeout disabled")
 	}
 
@@ -252,8 +293,19 @@ func main() {
 
 	vm.RegisterCustomFunctions()
 
+	if *cassette != "" {
+		if err := vm.HTTPMock().UseCassette(*cassette, *cassetteMode); err != nil {
+			fmt.Printf("Error loading HTTP cassette: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if err := vm.LoadString(string(code)); err != nil {
 		fmt.Printf("Error executing Lua code: %v\n", err)
 		os.Exit(1)
 	}
+
+	// Handlers in main mode run on the main state, which is free once the
+	// script returns; keep serving them for as long as the servers run.
+	vm.ServeMain()
 }
@@ -0,0 +1,291 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	CallbackIsolated = "isolated"
+	CallbackMain     = "main"
+)
+
+// Callback is a Lua function scheduled to run outside the call that created
+// it. In isolated mode every call runs in a pooled state on a copy of the
+// function's upvalues and arguments taken when the callback was created; in
+// main mode calls are serialized onto the VM's main state.
+type Callback struct {
+	vm   *SolVM
+	fn   *lua.LFunction
+	args []lua.LValue
+	mode string
+}
+
+// ValidateCallbackMode reports a callback mode other than "isolated" or
+// "main", so the command line can reject it before any script runs.
+func ValidateCallbackMode(mode string) error {
+	switch mode {
+	case "", CallbackIsolated, CallbackMain:
+		return nil
+	}
+	return fmt.Errorf("invalid callback mode %q: use %q or %q", mode, CallbackIsolated, CallbackMain)
+}
+
+type mainTask struct {
+	run  func(L *lua.LState) error
+	done chan error
+}
+
+func (vm *SolVM) NewCallback(L *lua.LState, fn *lua.LFunction, args []lua.LValue, mode string) *Callback {
+	if mode == "" {
+		mode = vm.callbackMode
+	}
+
+	cb := &Callback{vm: vm, mode: mode}
+	if mode == CallbackMain {
+		cb.fn = fn
+		cb.args = args
+		return cb
+	}
+
+	c := newValueCopier(L.G.Global)
+	cb.fn = c.copy(L, fn).(*lua.LFunction)
+	for _, arg := range args {
+		cb.args = append(cb.args, c.copy(L, arg))
+	}
+	return cb
+}
+
+func (cb *Callback) Mode() string {
+	return cb.mode
+}
+
+// Call runs the callback with its stored arguments followed by the values
+// returned by extra, which is evaluated on the state the callback runs on.
+func (cb *Callback) Call(ctx context.Context, extra func(L *lua.LState) []lua.LValue) error {
+	return cb.vm.RunCallbacks(ctx, cb.mode, func(L *lua.LState) error {
+		var values []lua.LValue
+		if extra != nil {
+			values = extra(L)
+		}
+		_, err := cb.CallOn(L, 0, values...)
+		return err
+	})
+}
+
+// RunCallbacks runs f on a state for callbacks in the given mode: the main
+// state in main mode, otherwise a pooled state. Several callbacks can then be
+// called on it with CallOn, so a chain of them shares one state and can pass
+// tables to each other.
+func (vm *SolVM) RunCallbacks(ctx context.Context, mode string, f func(L *lua.LState) error) error {
+	if mode == "" {
+		mode = vm.callbackMode
+	}
+	run := func(L *lua.LState) error {
+		if ctx != nil {
+			L.SetContext(ctx)
+			defer L.RemoveContext()
+		}
+		return f(L)
+	}
+
+	if mode == CallbackMain {
+		return vm.runOnMain(run)
+	}
+
+	L := vm.callbackPool.Get().(*lua.LState)
+	defer vm.callbackPool.Put(L)
+	return run(L)
+}
+
+// CallOn calls the callback on L, which must come from RunCallbacks, with its
+// stored arguments followed by extra, and returns nret results.
+func (cb *Callback) CallOn(L *lua.LState, nret int, extra ...lua.LValue) ([]lua.LValue, error) {
+	fn, args := cb.fn, cb.args
+	if cb.mode != CallbackMain {
+		c := newValueCopier(L.G.Global)
+		fn = c.copy(L, cb.fn).(*lua.LFunction)
+		args = make([]lua.LValue, len(cb.args))
+		for i, arg := range cb.args {
+			args[i] = c.copy(L, arg)
+		}
+	}
+
+	top := L.GetTop()
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	for _, v := range extra {
+		L.Push(v)
+	}
+	if err := L.PCall(len(args)+len(extra), nret, nil); err != nil {
+		L.SetTop(top)
+		return nil, err
+	}
+
+	results := make([]lua.LValue, nret)
+	for i := range results {
+		results[i] = L.Get(top + i + 1)
+	}
+	L.SetTop(top)
+	return results, nil
+}
+
+func (vm *SolVM) newCallbackState() *lua.LState {
+	L := lua.NewState()
+	for name, value := range vm.builtins {
+		L.SetGlobal(name, value)
+	}
+	return L
+}
+
+// captureBuiltins records the globals SolVM adds on top of the Lua standard
+// library so callback states can expose the same functions and modules.
+func (vm *SolVM) captureBuiltins() {
+	plain := lua.NewState()
+	defer plain.Close()
+
+	builtins := make(map[string]lua.LValue)
+	vm.state.G.Global.ForEach(func(key, value lua.LValue) {
+		name, ok := key.(lua.LString)
+		if !ok || plain.GetGlobal(string(name)) != lua.LNil {
+			return
+		}
+		builtins[string(name)] = value
+	})
+	vm.builtins = builtins
+}
+
+func (vm *SolVM) runOnMain(run func(L *lua.LState) error) error {
+	task := mainTask{run: run, done: make(chan error, 1)}
+	select {
+	case vm.tasks <- task:
+	case <-vm.ctx.Done():
+		return fmt.Errorf("VM stopped before callback could run")
+	}
+
+	select {
+	case err := <-task.done:
+		return err
+	case <-vm.ctx.Done():
+		return fmt.Errorf("VM stopped before callback could run")
+	}
+}
+
+// ServeMain runs callbacks queued for the main state once the script has
+// returned, so servers with handlers in main mode keep working. It returns
+// when the VM stops or no server is left, and must be called from the
+// goroutine that owns the main state.
+func (vm *SolVM) ServeMain() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for vm.serverMod.hasServers() {
+		select {
+		case task := <-vm.tasks:
+			vm.mu.Lock()
+			task.done <- task.run(vm.state)
+			vm.mu.Unlock()
+		case <-ticker.C:
+		case <-vm.ctx.Done():
+			return
+		}
+	}
+}
+
+func (vm *SolVM) waitMain(d time.Duration) {
+	timer := vm.clock.After(d)
+	for {
+		select {
+		case <-timer:
+			return
+		case task := <-vm.tasks:
+			task.done <- task.run(vm.state)
+		}
+	}
+}
+
+// advanceMain advances the fake clock for the main state. The timers run on
+// another goroutine while this one serves the callbacks they queue for the
+// main state, so those still run in order before it returns, and only this
+// goroutine ever touches the main state.
+func (vm *SolVM) advanceMain(fc *FakeClock, d time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fc.Advance(d)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case task := <-vm.tasks:
+			task.done <- task.run(vm.state)
+		}
+	}
+}
+
+type valueCopier struct {
+	env      *lua.LTable
+	seen     map[lua.LValue]lua.LValue
+	upvalues map[*lua.Upvalue]*lua.Upvalue
+}
+
+func newValueCopier(env *lua.LTable) *valueCopier {
+	return &valueCopier{
+		env:      env,
+		seen:     make(map[lua.LValue]lua.LValue),
+		upvalues: make(map[*lua.Upvalue]*lua.Upvalue),
+	}
+}
+
+// copy deep-copies tables and Lua closures so a callback never shares
+// mutable state with the state that created it. Go functions, userdata and
+// other reference values are shared as-is.
+func (c *valueCopier) copy(L *lua.LState, value lua.LValue) lua.LValue {
+	if value == nil {
+		return lua.LNil
+	}
+	if copied, ok := c.seen[value]; ok {
+		return copied
+	}
+
+	switch v := value.(type) {
+	case *lua.LTable:
+		tbl := L.NewTable()
+		c.seen[v] = tbl
+		v.ForEach(func(key, val lua.LValue) {
+			tbl.RawSet(c.copy(L, key), c.copy(L, val))
+		})
+		if v.Metatable != nil && v.Metatable != lua.LNil {
+			tbl.Metatable = c.copy(L, v.Metatable)
+		}
+		return tbl
+	case *lua.LFunction:
+		if v.IsG {
+			return v
+		}
+		fn := L.NewFunctionFromProto(v.Proto)
+		fn.Env = c.env
+		c.seen[v] = fn
+		for i, uv := range v.Upvalues {
+			if uv == nil || i >= len(fn.Upvalues) {
+				continue
+			}
+			copied, ok := c.upvalues[uv]
+			if !ok {
+				copied = &lua.Upvalue{}
+				copied.Close()
+				c.upvalues[uv] = copied
+				copied.SetValue(c.copy(L, uv.Value()))
+			}
+			fn.Upvalues[i] = copied
+		}
+		return fn
+	default:
+		return value
+	}
+}
@@ -0,0 +1,205 @@
+package vm
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	seq    int
+	depth  int
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	seq   int
+	fn    func()
+	ch    chan time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (fc *FakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *FakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	fc.mu.Lock()
+	advancing := fc.depth > 0
+	fc.mu.Unlock()
+
+	if advancing {
+		fc.advanceTo(fc.Now().Add(d))
+		return
+	}
+	<-fc.After(d)
+}
+
+func (fc *FakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	fc.addTimer(d, nil, ch)
+	return ch
+}
+
+func (fc *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return fc.addTimer(d, f, nil)
+}
+
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.advanceTo(fc.Now().Add(d))
+}
+
+func (fc *FakeClock) addTimer(d time.Duration, fn func(), ch chan time.Time) *fakeTimer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if d < 0 {
+		d = 0
+	}
+	t := &fakeTimer{
+		clock: fc,
+		when:  fc.now.Add(d),
+		seq:   fc.seq,
+		fn:    fn,
+		ch:    ch,
+	}
+	fc.seq++
+	fc.timers = append(fc.timers, t)
+	sort.SliceStable(fc.timers, func(i, j int) bool {
+		if fc.timers[i].when.Equal(fc.timers[j].when) {
+			return fc.timers[i].seq < fc.timers[j].seq
+		}
+		return fc.timers[i].when.Before(fc.timers[j].when)
+	})
+	return t
+}
+
+func (fc *FakeClock) advanceTo(target time.Time) {
+	fc.mu.Lock()
+	fc.depth++
+	fc.mu.Unlock()
+
+	defer func() {
+		fc.mu.Lock()
+		fc.depth--
+		fc.mu.Unlock()
+	}()
+
+	for {
+		fc.mu.Lock()
+		if len(fc.timers) == 0 || fc.timers[0].when.After(target) {
+			if target.After(fc.now) {
+				fc.now = target
+			}
+			fc.mu.Unlock()
+			return
+		}
+
+		t := fc.timers[0]
+		fc.timers = fc.timers[1:]
+		if t.when.After(fc.now) {
+			fc.now = t.when
+		}
+		now := fc.now
+		fc.mu.Unlock()
+
+		if t.fn != nil {
+			t.fn()
+		} else {
+			select {
+			case t.ch <- now:
+			default:
+			}
+		}
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	fc := t.clock
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	for i, pending := range fc.timers {
+		if pending == t {
+			fc.timers = append(fc.timers[:i], fc.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (vm *SolVM) Clock() Clock {
+	return vm.clock
+}
+
+func (vm *SolVM) registerClock() {
+	vm.RegisterTable("clock", map[string]lua.LGFunction{
+		"now": func(L *lua.LState) int {
+			L.Push(timeToLua(vm.clock.Now()))
+			return 1
+		},
+		"is_fake": func(L *lua.LState) int {
+			_, fake := vm.clock.(*FakeClock)
+			L.Push(lua.LBool(fake))
+			return 1
+		},
+		"advance": func(L *lua.LState) int {
+			seconds := L.CheckNumber(1)
+			fc, fake := vm.clock.(*FakeClock)
+			if !fake {
+				L.RaiseError("clock.advance requires the fake clock")
+				return 0
+			}
+			if L == vm.state {
+				vm.advanceMain(fc, secondsToDuration(seconds))
+				return 0
+			}
+			fc.Advance(secondsToDuration(seconds))
+			return 0
+		},
+	})
+}
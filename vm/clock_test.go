@@ -0,0 +1,116 @@
+package vm
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFakeClockAdvanceFiresTimersInOrder(t *testing.T) {
+	fc := NewFakeClock(time.Unix(1000, 0))
+	var fired []string
+	fc.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	fc.AfterFunc(time.Second, func() { fired = append(fired, "a") })
+	fc.AfterFunc(2*time.Second, func() { fired = append(fired, "c") })
+	stopped := fc.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	if !stopped.Stop() {
+		t.Fatal("Stop on a pending timer returned false")
+	}
+	ch := fc.After(3 * time.Second)
+
+	fc.Advance(2 * time.Second)
+	if got := len(fired); got != 3 || fired[0] != "a" || fired[1] != "b" || fired[2] != "c" {
+		t.Fatalf("fired %v, want [a b c]", fired)
+	}
+	select {
+	case <-ch:
+		t.Fatal("After fired early")
+	default:
+	}
+	fc.Advance(time.Second)
+	if at := <-ch; !at.Equal(time.Unix(1003, 0)) {
+		t.Fatalf("After fired at %v", at)
+	}
+	if !fc.Now().Equal(time.Unix(1003, 0)) {
+		t.Fatalf("now is %v", fc.Now())
+	}
+}
+
+func TestFakeClockSleepOnMainAdvances(t *testing.T) {
+	v := newTestVM(t, Config{FakeClock: true})
+	runLuaWithin(t, v, 5*time.Second, `
+		local ticks = 0
+		set_interval(function() ticks = ticks + 1 end, 1, { mode = "main" })
+		local start = clock.now()
+		sleep(5)
+		assert(clock.now() - start == 5, "clock moved " .. (clock.now() - start))
+		assert(ticks == 5, "ticks " .. ticks)
+
+		local limiter = ratelimit.new{ rate = 1, burst = 1 }
+		assert(limiter:allow())
+		assert(limiter:wait())
+		assert(clock.now() - start == 6, "wait did not advance the clock")
+	`)
+}
+
+// Handlers in main mode must be served by the goroutine that owns the main
+// state even while it is inside clock.advance. Run with -race.
+func TestFakeClockAdvanceServesMainCallbacks(t *testing.T) {
+	v := newTestVM(t, Config{FakeClock: true, CallbackMode: CallbackMain})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		served, ticks = 0, 0
+		local app = create_server("race", %d)
+		app:get("/", function(req) served = served + 1; return { body = "ok" } end)
+		app:start()
+		set_interval(function() ticks = ticks + 1 end, 0.01)
+	`, port))
+
+	addr := waitForServer(t, port)
+
+	const requests = 20
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			client := &http.Client{Timeout: 10 * time.Second}
+			resp, err := client.Get("http://" + addr + "/")
+			if err == nil {
+				resp.Body.Close()
+			}
+			errs <- err
+		}()
+	}
+
+	runLuaWithin(t, v, 10*time.Second, fmt.Sprintf(`
+		local deadline = os.time() + 5
+		while served < %d and os.time() < deadline do
+			clock.advance(0.01)
+		end
+		assert(served == %d, "served " .. served)
+		assert(ticks > 0)
+	`, requests, requests))
+	for i := 0; i < requests; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("request failed: %v", err)
+		}
+	}
+	runLua(t, v, `stop_server("race")`)
+}
+
+func TestDatetimeSleepRunsMainCallbacks(t *testing.T) {
+	v := newTestVM(t, Config{})
+	runLuaWithin(t, v, 5*time.Second, `
+		local ticks = 0
+		set_interval(function() ticks = ticks + 1 end, 0.02, { mode = "main" })
+		datetime.sleep("150ms")
+		assert(ticks >= 3, "ticks " .. ticks)
+	`)
+
+	fake := newTestVM(t, Config{FakeClock: true})
+	runLuaWithin(t, fake, 5*time.Second, `
+		local start = clock.now()
+		datetime.sleep("90s")
+		assert(clock.now() - start == 90)
+	`)
+}
@@ -148,7 +148,7 @@ func (cm *ConcurrencyModule) sendToChannel(L *lua.LState) int {
 	select {
 	case ch.ch <- value:
 		L.Push(lua.LTrue)
-	case <-time.After(time.Second):
+	case <-cm.vm.clock.After(time.Second):
 		L.Push(lua.LFalse)
 	case <-cm.done:
 		L.Push(lua.LFalse)
@@ -181,7 +181,7 @@ func (cm *ConcurrencyModule) receiveFromChannel(L *lua.LState) int {
 	select {
 	case value := <-ch.ch:
 		L.Push(value)
-	case <-time.After(time.Duration(float64(timeout) * float64(time.Second))):
+	case <-cm.vm.clock.After(time.Duration(float64(timeout) * float64(time.Second))):
 		L.Push(lua.LNil)
 	case <-cm.done:
 		L.Push(lua.LNil)
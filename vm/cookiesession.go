@@ -0,0 +1,496 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const maxCookieSize = 4096
+
+// secretKeys holds the keys derived from the configured secrets. The first
+// secret signs and encrypts; the others are still accepted, so secrets can
+// be rotated without logging everybody out.
+type secretKeys struct {
+	sign    [][]byte
+	encrypt [][]byte
+}
+
+func deriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("solvm " + purpose))
+	return mac.Sum(nil)
+}
+
+// minSecretLength is the shortest secret accepted for signing cookies,
+// CSRF tokens and JWTs.
+const minSecretLength = 16
+
+func newSecretKeys(L *lua.LState, value lua.LValue) *secretKeys {
+	secrets, ok := luaStringList(value)
+	if !ok || len(secrets) == 0 {
+		L.ArgError(1, "secret must be a string or an array of strings")
+	}
+	keys := &secretKeys{}
+	for _, secret := range secrets {
+		if len(secret) < minSecretLength {
+			L.ArgError(1, fmt.Sprintf("secret must be at least %d characters", minSecretLength))
+		}
+		keys.sign = append(keys.sign, deriveKey(secret, "sign"))
+		keys.encrypt = append(keys.encrypt, deriveKey(secret, "encrypt"))
+	}
+	return keys
+}
+
+// signValue appends an HMAC of name and value, so a value signed for one
+// cookie cannot be replayed in another.
+func (k *secretKeys) signValue(name, value string) string {
+	return value + "." + base64.RawURLEncoding.EncodeToString(macOf(k.sign[0], name, value))
+}
+
+func (k *secretKeys) verifyValue(name, signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil {
+		return "", false
+	}
+	for _, key := range k.sign {
+		if hmac.Equal(sig, macOf(key, name, value)) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// macValue returns just the HMAC of name and value, for tokens that must
+// not reveal the value they are derived from.
+func (k *secretKeys) macValue(name, value string) string {
+	return base64.RawURLEncoding.EncodeToString(macOf(k.sign[0], name, value))
+}
+
+func (k *secretKeys) verifyMAC(name, value, mac string) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil {
+		return false
+	}
+	for _, key := range k.sign {
+		if hmac.Equal(sig, macOf(key, name, value)) {
+			return true
+		}
+	}
+	return false
+}
+
+func macOf(key []byte, name, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name + "|" + value))
+	return mac.Sum(nil)
+}
+
+func (k *secretKeys) encryptValue(name string, plaintext []byte) (string, error) {
+	gcm, err := newGCM(k.encrypt[0])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (k *secretKeys) decryptValue(name, value string) ([]byte, bool) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false
+	}
+	for _, key := range k.encrypt {
+		gcm, err := newGCM(key)
+		if err != nil || len(sealed) < gcm.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+		if plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(name)); err == nil {
+			return plaintext, true
+		}
+	}
+	return nil, false
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// cookieOptions are the attributes of a cookie set by middleware.
+type cookieOptions struct {
+	name     string
+	path     string
+	domain   string
+	secure   lua.LValue
+	httpOnly bool
+	sameSite http.SameSite
+}
+
+func parseCookieOptions(L *lua.LState, tbl *lua.LTable, name string, httpOnly bool) cookieOptions {
+	opts := cookieOptions{
+		name:     name,
+		path:     "/",
+		domain:   lua.LVAsString(tbl.RawGetString("domain")),
+		secure:   tbl.RawGetString("secure"),
+		httpOnly: httpOnly,
+		sameSite: http.SameSiteLaxMode,
+	}
+	if v, ok := tbl.RawGetString("cookie").(lua.LString); ok && v != "" {
+		opts.name = string(v)
+	}
+	if v, ok := tbl.RawGetString("path").(lua.LString); ok {
+		opts.path = string(v)
+	}
+	if v, ok := tbl.RawGetString("same_site").(lua.LString); ok {
+		mode, known := sameSiteModes[strings.ToLower(string(v))]
+		if !known {
+			L.ArgError(1, fmt.Sprintf("unknown same_site mode %q", string(v)))
+		}
+		opts.sameSite = mode
+	}
+	return opts
+}
+
+// cookie builds the cookie for value. Unless secure is set explicitly,
+// cookies are marked Secure on HTTPS requests.
+func (o cookieOptions) cookie(r *http.Request, value string, maxAge int) *http.Cookie {
+	secure := r.TLS != nil
+	if v, ok := o.secure.(lua.LBool); ok {
+		secure = bool(v)
+	}
+	return &http.Cookie{
+		Name:     o.name,
+		Value:    value,
+		Path:     o.path,
+		Domain:   o.domain,
+		MaxAge:   maxAge,
+		Secure:   secure,
+		HttpOnly: o.httpOnly,
+		SameSite: o.sameSite,
+	}
+}
+
+// sessionStore keeps the data of sessions whose cookie only holds an ID.
+type sessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]storedSession
+	lastSweep time.Time
+}
+
+type storedSession struct {
+	data    []byte
+	expires time.Time
+}
+
+func (s *sessionStore) get(id string, now time.Time) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.sessions[id]
+	if !ok || now.After(stored.expires) {
+		return nil, false
+	}
+	return stored.data, true
+}
+
+func (s *sessionStore) set(id string, data []byte, expires time.Time, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = storedSession{data: data, expires: expires}
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.lastSweep = now
+		for id, stored := range s.sessions {
+			if now.After(stored.expires) {
+				delete(s.sessions, id)
+			}
+		}
+	}
+}
+
+func (s *sessionStore) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// sessionManager loads and saves sessions for the session middleware. With
+// the cookie store the whole session travels in the cookie, signed or, with
+// encrypt, encrypted; with the memory store the cookie carries a signed
+// random ID.
+type sessionManager struct {
+	clock   Clock
+	keys    *secretKeys
+	cookie  cookieOptions
+	store   *sessionStore
+	encrypt bool
+	maxAge  time.Duration
+}
+
+// requestSession is the session of one request. values is what Lua sees
+// as req.session; original is its encoding when loaded, to tell whether it
+// needs saving. A bound session has an ID that other tokens are tied to,
+// so it keeps its cookie even while it is empty.
+type requestSession struct {
+	id       string
+	values   map[string]interface{}
+	original []byte
+	loaded   bool
+	saved    bool
+	bound    bool
+	newID    bool
+}
+
+// bind returns the session's ID, giving it one first if it has none yet.
+func (s *requestSession) bind() string {
+	if s.id == "" {
+		s.id = randomToken(32)
+		s.newID = true
+	}
+	s.bound = true
+	return s.id
+}
+
+type cookiePayload struct {
+	ID      string                 `json:"i,omitempty"`
+	Data    map[string]interface{} `json:"d"`
+	Expires int64                  `json:"e"`
+}
+
+func (m *sessionManager) load(r *http.Request) *requestSession {
+	sess := &requestSession{values: make(map[string]interface{})}
+	cookie, err := r.Cookie(m.cookie.name)
+	if err != nil {
+		return sess
+	}
+	now := m.clock.Now()
+
+	var data []byte
+	if m.store != nil {
+		id, ok := m.keys.verifyValue(m.cookie.name, cookie.Value)
+		if !ok {
+			return sess
+		}
+		if data, ok = m.store.get(id, now); !ok {
+			return sess
+		}
+		sess.id = id
+	} else {
+		var plaintext []byte
+		if m.encrypt {
+			var ok bool
+			if plaintext, ok = m.keys.decryptValue(m.cookie.name, cookie.Value); !ok {
+				return sess
+			}
+		} else {
+			value, ok := m.keys.verifyValue(m.cookie.name, cookie.Value)
+			if !ok {
+				return sess
+			}
+			if plaintext, err = base64.RawURLEncoding.DecodeString(value); err != nil {
+				return sess
+			}
+		}
+		var payload cookiePayload
+		if json.Unmarshal(plaintext, &payload) != nil || now.Unix() > payload.Expires {
+			return sess
+		}
+		if data, err = json.Marshal(payload.Data); err != nil {
+			return sess
+		}
+		sess.id = payload.ID
+	}
+
+	values := make(map[string]interface{})
+	if json.Unmarshal(data, &values) != nil {
+		return sess
+	}
+	sess.values = values
+	sess.original = data
+	sess.loaded = true
+	return sess
+}
+
+// save sets the session cookie if the session changed: a new value for a
+// modified session, or an expired cookie for one that was emptied.
+func (m *sessionManager) save(w http.ResponseWriter, r *http.Request, sess *requestSession) error {
+	if sess.saved {
+		return nil
+	}
+	sess.saved = true
+
+	if len(sess.values) == 0 && !sess.bound {
+		if !sess.loaded {
+			return nil
+		}
+		if m.store != nil {
+			m.store.delete(sess.id)
+		}
+		http.SetCookie(w, m.cookie.cookie(r, "", -1))
+		return nil
+	}
+
+	if sess.values == nil {
+		sess.values = make(map[string]interface{})
+	}
+	data, err := json.Marshal(sess.values)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %v", err)
+	}
+	if sess.loaded && !sess.newID && bytes.Equal(data, sess.original) {
+		return nil
+	}
+
+	now := m.clock.Now()
+	expires := now.Add(m.maxAge)
+	var value string
+	if m.store != nil {
+		if sess.id == "" {
+			sess.id = randomToken(32)
+		}
+		m.store.set(sess.id, data, expires, now)
+		value = m.keys.signValue(m.cookie.name, sess.id)
+	} else {
+		plaintext, err := json.Marshal(cookiePayload{ID: sess.id, Data: sess.values, Expires: expires.Unix()})
+		if err != nil {
+			return fmt.Errorf("failed to encode session: %v", err)
+		}
+		if m.encrypt {
+			if value, err = m.keys.encryptValue(m.cookie.name, plaintext); err != nil {
+				return fmt.Errorf("failed to encrypt session: %v", err)
+			}
+		} else {
+			value = m.keys.signValue(m.cookie.name, base64.RawURLEncoding.EncodeToString(plaintext))
+		}
+	}
+
+	cookie := m.cookie.cookie(r, value, int(m.maxAge/time.Second))
+	if len(cookie.String()) > maxCookieSize {
+		return errors.New("session is too large for a cookie; use store = \"memory\"")
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// syncSession reads req.session back from the Lua side of the request.
+func (s *requestState) syncSession() {
+	if s.session == nil || s.lua == nil || !s.lua.session {
+		return
+	}
+	values, _ := convertToGoValue(s.lua.req.RawGetString("session")).(map[string]interface{})
+	s.session.values = values
+}
+
+// sessionWriter saves the session just before the response starts, the
+// last moment the cookie can still be set.
+type sessionWriter struct {
+	http.ResponseWriter
+	save func()
+}
+
+func (sw *sessionWriter) WriteHeader(status int) {
+	sw.save()
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *sessionWriter) Write(data []byte) (int, error) {
+	sw.save()
+	return sw.ResponseWriter.Write(data)
+}
+
+func (sw *sessionWriter) Flush() {
+	sw.save()
+	flushWriter(sw.ResponseWriter)
+}
+
+func (sw *sessionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijackWriter(sw.ResponseWriter)
+}
+
+func (sw *sessionWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sm *ServerModule) sessionMiddleware(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	m := &sessionManager{
+		clock:  sm.vm.clock,
+		keys:   newSecretKeys(L, tbl.RawGetString("secret")),
+		cookie: parseCookieOptions(L, tbl, "session", true),
+		maxAge: 24 * time.Hour,
+	}
+	if v, ok := tbl.RawGetString("max_age").(lua.LNumber); ok {
+		if v <= 0 {
+			L.ArgError(1, "max_age must be positive")
+		}
+		m.maxAge = secondsToDuration(v)
+	}
+	switch store := lua.LVAsString(tbl.RawGetString("store")); store {
+	case "", "cookie":
+		m.encrypt = lua.LVAsBool(tbl.RawGetString("encrypt"))
+	case "memory":
+		m.store = &sessionStore{sessions: make(map[string]storedSession)}
+	default:
+		L.ArgError(1, `store must be "cookie" or "memory"`)
+	}
+
+	L.Push(middlewareValue(L, "session", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, state := ensureRequestState(r, nil)
+			sess := m.load(r)
+			state.mu.Lock()
+			state.session = sess
+			state.mu.Unlock()
+
+			sw := &sessionWriter{ResponseWriter: w}
+			sw.save = func() {
+				if sess.saved {
+					return
+				}
+				state.syncSession()
+				if err := m.save(w, r, sess); err != nil {
+					sm.vm.monitor.handleError(err)
+				}
+			}
+			next.ServeHTTP(sw, r)
+			// Nothing was written, so the server will send the headers.
+			sw.save()
+		})
+	}))
+	return 1
+}
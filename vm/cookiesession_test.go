@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func testSecretKeys(t *testing.T, secrets ...string) *secretKeys {
+	t.Helper()
+	L := lua.NewState()
+	defer L.Close()
+	list := L.NewTable()
+	for _, secret := range secrets {
+		list.Append(lua.LString(secret))
+	}
+	return newSecretKeys(L, list)
+}
+
+// saveSession stores values with m and returns the cookie it set.
+func saveSession(t *testing.T, m *sessionManager, values map[string]interface{}) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := m.save(w, r, &requestSession{values: values}); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("save set %d cookies", len(cookies))
+	}
+	return cookies[0]
+}
+
+func loadSession(m *sessionManager, cookie *http.Cookie) *requestSession {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	return m.load(r)
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	modes := map[string]func(m *sessionManager){
+		"signed":    func(m *sessionManager) {},
+		"encrypted": func(m *sessionManager) { m.encrypt = true },
+		"memory": func(m *sessionManager) {
+			m.store = &sessionStore{sessions: make(map[string]storedSession)}
+		},
+	}
+	for name, configure := range modes {
+		t.Run(name, func(t *testing.T) {
+			clock := NewFakeClock(time.Now())
+			m := &sessionManager{
+				clock:  clock,
+				keys:   testSecretKeys(t, "first secret 0123"),
+				cookie: cookieOptions{name: "session", path: "/"},
+				maxAge: time.Hour,
+			}
+			configure(m)
+
+			cookie := saveSession(t, m, map[string]interface{}{"user": "alice"})
+			if name == "encrypted" && strings.Contains(cookie.Value, "alice") {
+				t.Fatalf("encrypted cookie shows its contents: %s", cookie.Value)
+			}
+			if sess := loadSession(m, cookie); !sess.loaded || sess.values["user"] != "alice" {
+				t.Fatalf("session not restored: %+v", sess)
+			}
+
+			// Flipping any character must lose the session, never change it.
+			// The last one is skipped: part of it is base64 padding that
+			// decodes to the same bytes.
+			for i := range cookie.Value[:len(cookie.Value)-1] {
+				tampered := *cookie
+				b := []byte(cookie.Value)
+				b[i] ^= 1
+				tampered.Value = string(b)
+				if sess := loadSession(m, &tampered); sess.loaded {
+					t.Fatalf("tampered cookie accepted: %+v", sess.values)
+				}
+			}
+
+			// A rotated secret still reads the old cookie.
+			rotated := *m
+			rotated.keys = testSecretKeys(t, "second secret 456", "first secret 0123")
+			if sess := loadSession(&rotated, cookie); !sess.loaded {
+				t.Fatal("cookie lost after rotating the secret")
+			}
+			other := *m
+			other.keys = testSecretKeys(t, "another secret 78")
+			if sess := loadSession(&other, cookie); sess.loaded {
+				t.Fatal("cookie accepted with an unrelated secret")
+			}
+
+			clock.Advance(time.Hour + time.Second)
+			if sess := loadSession(m, cookie); sess.loaded {
+				t.Fatal("expired session was loaded")
+			}
+		})
+	}
+}
+
+func TestSecretKeysRequireLongSecrets(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.CallByParam(lua.P{
+		Fn:      L.NewFunction(func(L *lua.LState) int { newSecretKeys(L, lua.LString("too short")); return 0 }),
+		Protect: true,
+	}); err == nil || !strings.Contains(err.Error(), "at least 16 characters") {
+		t.Fatalf("short secret: %v", err)
+	}
+}
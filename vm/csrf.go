@@ -0,0 +1,161 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var csrfSafeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// csrfMiddleware protects unsafe requests: POST, PUT, PATCH and DELETE
+// requests must send a token back in a header or form field, which another
+// site cannot read. Behind the session middleware the token is an HMAC of
+// the session ID, so a token issued to one client is useless to another.
+// Without a session it falls back to the double submit pattern with the
+// token in a cookie. Signing that cookie only proves the server issued the
+// token, not to whom, so a sibling subdomain can still plant one it fetched
+// itself; only a __Host- cookie name prevents that.
+func (sm *ServerModule) csrfMiddleware(L *lua.LState) int {
+	tbl := L.OptTable(1, L.NewTable())
+	var keys *secretKeys
+	if secret := tbl.RawGetString("secret"); secret != lua.LNil {
+		keys = newSecretKeys(L, secret)
+	}
+	// Session tokens need a key even without a secret; this one lasts until
+	// the server restarts.
+	sessionKeys := keys
+	if sessionKeys == nil {
+		sessionKeys = &secretKeys{sign: [][]byte{[]byte(randomToken(32))}}
+	}
+	// The cookie is readable from JavaScript, which is what lets scripts
+	// send it back in the header.
+	cookie := parseCookieOptions(L, tbl, "csrf_token", false)
+	header := "X-CSRF-Token"
+	if v, ok := tbl.RawGetString("header").(lua.LString); ok && v != "" {
+		header = string(v)
+	}
+	field := "_csrf"
+	if v, ok := tbl.RawGetString("field").(lua.LString); ok && v != "" {
+		field = string(v)
+	}
+
+	valid := func(token string) bool {
+		if token == "" {
+			return false
+		}
+		if keys != nil {
+			_, ok := keys.verifyValue(cookie.name, token)
+			return ok
+		}
+		return true
+	}
+
+	L.Push(middlewareValue(L, "csrf", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var sess *requestSession
+			if state := requestStateOf(r); state != nil {
+				state.mu.Lock()
+				sess = state.session
+				state.mu.Unlock()
+			}
+
+			token, issued := "", false
+			var check func(submitted string) bool
+			if sess != nil {
+				id := sess.bind()
+				token = sessionKeys.macValue("csrf", id)
+				check = func(submitted string) bool {
+					return sessionKeys.verifyMAC("csrf", id, submitted)
+				}
+			} else {
+				if c, err := r.Cookie(cookie.name); err == nil && valid(c.Value) {
+					token = c.Value
+				}
+				issued = token == ""
+				if issued {
+					token = randomToken(32)
+					if keys != nil {
+						token = keys.signValue(cookie.name, token)
+					}
+					http.SetCookie(w, cookie.cookie(r, token, 0))
+				}
+				check = func(submitted string) bool {
+					return subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) == 1
+				}
+			}
+			setRequestValue(r, "csrf_token", token)
+
+			if csrfSafeMethods[r.Method] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			submitted := r.Header.Get(header)
+			if submitted == "" {
+				value, err := csrfFormValue(w, r, field)
+				if herr, ok := isHTTPError(err); ok {
+					writeError(w, r, herr.message, herr.status)
+					return
+				}
+				submitted = value
+			}
+			if issued || submitted == "" || !check(submitted) {
+				writeError(w, r, "Forbidden: invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}))
+	return 1
+}
+
+// csrfFormValue finds the token field in a urlencoded or multipart body.
+// The body is read into memory and put back, so the handler can still
+// read it.
+func csrfFormValue(w http.ResponseWriter, r *http.Request, field string) (string, error) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		return "", nil
+	}
+	limit := int64(defaultMaxBodySize)
+	if state := requestStateOf(r); state != nil && state.srv != nil {
+		limit = state.srv.maxBodySize
+	}
+	body, err := readRequestBody(w, r, limit)
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader([]byte(body)))
+
+	if mediaType == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(body)
+		if err != nil {
+			return "", nil
+		}
+		return values.Get(field), nil
+	}
+
+	reader := multipart.NewReader(bytes.NewReader([]byte(body)), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return "", nil
+		}
+		if part.FormName() == field && part.FileName() == "" {
+			value, _ := io.ReadAll(io.LimitReader(part, 4096))
+			return string(value), nil
+		}
+	}
+}
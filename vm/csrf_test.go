@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	v := newTestVM(t, Config{})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server("csrf", %d)
+		app:use(middleware.csrf{ secret = "csrf secret 01234" })
+		app:get("/", function(req) return { body = req.context.csrf_token } end)
+		app:post("/", function(req) return { body = "posted" } end)
+		app:start()
+	`, port))
+	t.Cleanup(func() { runLua(t, v, `stop_server("csrf")`) })
+	base := "http://" + waitForServer(t, port) + "/"
+
+	resp, err := http.Get(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var token string
+	for _, c := range resp.Cookies() {
+		if c.Name == "csrf_token" {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("GET did not issue a csrf_token cookie")
+	}
+
+	post := func(cookie, header, form string) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", base, strings.NewReader(form))
+		if form != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "csrf_token", Value: cookie})
+		}
+		if header != "" {
+			req.Header.Set("X-CSRF-Token", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	forged := "forged." + strings.SplitN(token, ".", 2)[1]
+	tests := []struct {
+		name                 string
+		cookie, header, form string
+		want                 int
+	}{
+		{"header", token, token, "", http.StatusOK},
+		{"form field", token, "", "_csrf=" + url.QueryEscape(token), http.StatusOK},
+		{"no token", token, "", "", http.StatusForbidden},
+		{"no cookie", "", token, "", http.StatusForbidden},
+		{"mismatch", token, token + "x", "", http.StatusForbidden},
+		{"wrong form field", token, "", "_csrf=nope", http.StatusForbidden},
+		{"unsigned cookie", forged, forged, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := post(tt.cookie, tt.header, tt.form); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Behind a session a token only works for the session it was issued to, so
+// a token fetched by one client cannot be replayed by another, even when it
+// is planted as that client's csrf_token cookie.
+func TestCSRFBoundToSession(t *testing.T) {
+	for _, store := range []string{"cookie", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			v := newTestVM(t, Config{})
+			port := freePort(t)
+			runLua(t, v, fmt.Sprintf(`
+				local app = create_server("csrf_session", %d)
+				app:use(middleware.session{ secret = "session secret 01", store = %q })
+				app:use(middleware.csrf())
+				app:get("/", function(req) return { body = req.context.csrf_token } end)
+				app:post("/", function(req) return { body = "posted" } end)
+				app:start()
+			`, port, store))
+			t.Cleanup(func() { runLua(t, v, `stop_server("csrf_session")`) })
+			base := "http://" + waitForServer(t, port) + "/"
+
+			// visit returns the session cookie and token a new client gets.
+			visit := func() (*http.Cookie, string) {
+				t.Helper()
+				resp, err := http.Get(base)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				for _, c := range resp.Cookies() {
+					if c.Name == "csrf_token" {
+						t.Fatal("a csrf_token cookie was set behind a session")
+					}
+					if c.Name == "session" {
+						return c, string(body)
+					}
+				}
+				t.Fatal("GET did not start a session")
+				return nil, ""
+			}
+			post := func(session *http.Cookie, token string) int {
+				t.Helper()
+				req, _ := http.NewRequest("POST", base, nil)
+				if session != nil {
+					req.AddCookie(session)
+				}
+				req.AddCookie(&http.Cookie{Name: "csrf_token", Value: token})
+				req.Header.Set("X-CSRF-Token", token)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+
+			victim, victimToken := visit()
+			attacker, attackerToken := visit()
+			if victimToken == attackerToken {
+				t.Fatal("two sessions got the same token")
+			}
+			if got := post(victim, victimToken); got != http.StatusOK {
+				t.Fatalf("own token: status %d", got)
+			}
+			if got := post(victim, attackerToken); got != http.StatusForbidden {
+				t.Fatalf("token of another session: status %d", got)
+			}
+			if got := post(nil, attackerToken); got != http.StatusForbidden {
+				t.Fatalf("token without a session: status %d", got)
+			}
+			if got := post(attacker, attackerToken); got != http.StatusOK {
+				t.Fatalf("attacker's own token: status %d", got)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package vm
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -92,7 +93,7 @@ func (fc *FunctionCache) GetCachedFunction(name string) *lua.LFunction {
 func (vm *SolVM) RegisterCustomFunctions() {
 	vm.RegisterFunction("json_encode", jsonEncode)
 	vm.RegisterFunction("json_decode", jsonDecode)
-	vm.RegisterFunction("sleep", sleep)
+	vm.RegisterFunction("sleep", vm.sleep)
 	vm.importMod.Register()
 	vm.concMod.Register()
 	vm.monitor.Register()
@@ -102,6 +103,10 @@ func (vm *SolVM) RegisterCustomFunctions() {
 	vm.schedMod.Register()
 	vm.netMod.Register()
 	vm.debugMod.Register()
+	vm.registerClock()
+	vm.registerRateLimit()
+	vm.registerJWT()
+	vm.captureBuiltins()
 }
 
 func (vm *SolVM) RegisterFunction(name string, fn lua.LGFunction) {
@@ -121,6 +126,30 @@ func (vm *SolVM) RegisterFunction(name string, fn lua.LGFunction) {
 	}))
 }
 
+func (vm *SolVM) RegisterTable(name string, fns map[string]lua.LGFunction) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	parts := strings.Split(name, ".")
+	tbl, ok := vm.state.GetGlobal(parts[0]).(*lua.LTable)
+	if !ok {
+		tbl = vm.state.NewTable()
+		vm.state.SetGlobal(parts[0], tbl)
+	}
+	for _, part := range parts[1:] {
+		child, ok := tbl.RawGetString(part).(*lua.LTable)
+		if !ok {
+			child = vm.state.NewTable()
+			tbl.RawSetString(part, child)
+		}
+		tbl = child
+	}
+
+	for key, fn := range fns {
+		tbl.RawSetString(key, vm.state.NewFunction(fn))
+	}
+}
+
 func jsonEncode(L *lua.LState) int {
 	value := L.CheckAny(1)
 
@@ -152,12 +181,26 @@ func jsonDecode(L *lua.LState) int {
 	return 1
 }
 
-func sleep(L *lua.LState) int {
-	duration := float64(L.CheckNumber(1))
-	time.Sleep(time.Duration(duration * float64(time.Second)))
+func (vm *SolVM) sleep(L *lua.LState) int {
+	vm.sleepFor(L, time.Duration(float64(L.CheckNumber(1))*float64(time.Second)))
 	return 0
 }
 
+// sleepFor blocks L for d. The main state keeps running callbacks while it
+// waits. With the fake clock nothing else could advance time while the main
+// script sleeps, so its sleep advances the clock instead.
+func (vm *SolVM) sleepFor(L *lua.LState, d time.Duration) {
+	if L == vm.state {
+		if fc, fake := vm.clock.(*FakeClock); fake {
+			vm.advanceMain(fc, d)
+			return
+		}
+		vm.waitMain(d)
+		return
+	}
+	vm.clock.Sleep(d)
+}
+
 func convertToGoValue(value lua.LValue) interface{} {
 	switch value.Type() {
 	case lua.LTNil:
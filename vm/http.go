@@ -1,27 +1,59 @@
 package vm
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"solvm/vm/modules"
+
 	lua "github.com/yuin/gopher-lua"
 )
 
 type HTTPModule struct {
-	vm     *SolVM
-	client *http.Client
+	vm           *SolVM
+	client       *http.Client
+	streamClient *http.Client
+	breakers     map[string]*circuitBreaker
+	breakerMu    sync.Mutex
+	transports   map[string]http.RoundTripper
+	transportMu  sync.Mutex
+	cache        *HTTPCache
+	cacheMu      sync.RWMutex
 }
 
 func NewHTTPModule(vm *SolVM) *HTTPModule {
-	return &HTTPModule{
-		vm: vm,
-		client: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+	hm := &HTTPModule{
+		vm:         vm,
+		breakers:   make(map[string]*circuitBreaker),
+		transports: make(map[string]http.RoundTripper),
+	}
+
+	// main validates the global options, so this only fails for a VM
+	// embedded with bad ones; every request then reports why.
+	transport, err := hm.transportFor(vm.httpConfig)
+	if err != nil {
+		transport = errorTransport{err: err}
+	}
+	hm.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+	}
+	// Streams and downloads can legitimately take longer than any fixed
+	// limit, so they only time out while waiting for response headers.
+	hm.streamClient = &http.Client{
+		Transport: transport,
 	}
+	return hm
 }
 
 func (hm *HTTPModule) Register() {
@@ -30,146 +62,673 @@ func (hm *HTTPModule) Register() {
 	hm.vm.RegisterFunction("http_put", hm.put)
 	hm.vm.RegisterFunction("http_delete", hm.delete)
 	hm.vm.RegisterFunction("http_request", hm.request)
+	hm.vm.RegisterFunction("ws_connect", hm.wsConnect)
+	hm.vm.RegisterFunction("sse_connect", hm.sseConnect)
+	hm.vm.RegisterTable("http", map[string]lua.LGFunction{
+		"request":  hm.httpRequest,
+		"download": hm.download,
+		"session":  hm.session,
+		"form_encode": func(L *lua.LState) int {
+			L.Push(lua.LString(encodeForm(L.CheckTable(1))))
+			return 1
+		},
+		"form_decode": func(L *lua.LState) int {
+			values, err := url.ParseQuery(L.CheckString(1))
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(valuesTable(L, values))
+			return 1
+		},
+	})
+	hm.vm.RegisterTable("http.mock", hm.mockFunctions())
+	hm.vm.RegisterTable("http.cache", hm.cacheFunctions())
 }
 
 func (hm *HTTPModule) get(L *lua.LState) int {
-	url := L.CheckString(1)
+	opts := newRequestOptions()
+	opts.url = L.CheckString(1)
+	return hm.legacyRequest(L, opts)
+}
+
+func (hm *HTTPModule) post(L *lua.LState) int {
+	opts := newRequestOptions()
+	opts.method = http.MethodPost
+	opts.url = L.CheckString(1)
+	opts.body = bytesBody([]byte(L.CheckString(2)))
+	opts.headers.Set("Content-Type", L.OptString(3, "application/json"))
+	return hm.legacyRequest(L, opts)
+}
+
+func (hm *HTTPModule) put(L *lua.LState) int {
+	opts := newRequestOptions()
+	opts.method = http.MethodPut
+	opts.url = L.CheckString(1)
+	opts.body = bytesBody([]byte(L.CheckString(2)))
+	opts.headers.Set("Content-Type", "application/json")
+	return hm.legacyRequest(L, opts)
+}
+
+func (hm *HTTPModule) delete(L *lua.LState) int {
+	opts := newRequestOptions()
+	opts.method = http.MethodDelete
+	opts.url = L.CheckString(1)
+	return hm.legacyRequest(L, opts)
+}
+
+func (hm *HTTPModule) request(L *lua.LState) int {
+	opts := newRequestOptions()
+	opts.method = L.CheckString(1)
+	opts.url = L.CheckString(2)
+	if L.GetTop() > 2 {
+		opts.body = bytesBody([]byte(L.CheckString(3)))
+	}
+	if L.GetTop() > 3 {
+		L.CheckTable(4).ForEach(func(key, value lua.LValue) {
+			opts.headers.Set(key.String(), value.String())
+		})
+	}
+	return hm.legacyRequest(L, opts)
+}
 
-	resp, err := hm.client.Get(url)
+// legacyRequest sends a request for the http_get family through the same
+// client as http.request, so the mock, the cache and the VM's transport
+// settings apply. Failures still go to on_error as well, as they always
+// have.
+func (hm *HTTPModule) legacyRequest(L *lua.LState, opts *requestOptions) int {
+	req, err := hm.newRequest(opts)
+	var resp *http.Response
+	if err == nil {
+		var client *http.Client
+		if client, err = hm.clientFor(opts); err == nil {
+			resp, err = client.Do(req)
+		}
+	}
 	if err != nil {
-		hm.vm.monitor.handleError(fmt.Errorf("HTTP GET failed: %v", err))
+		hm.vm.monitor.handleError(fmt.Errorf("HTTP %s failed: %v", opts.method, err))
 		L.Push(lua.LNil)
-		return 1
+		L.Push(lua.LString(err.Error()))
+		return 2
 	}
 	defer resp.Body.Close()
 
 	return hm.handleResponse(L, resp)
 }
 
-func (hm *HTTPModule) post(L *lua.LState) int {
-	url := L.CheckString(1)
-	body := L.CheckString(2)
-
-	resp, err := hm.client.Post(url, "application/json", bytes.NewBufferString(body))
+// handleResponse builds the result of the http_get family. Headers are
+// strings there, so repeated values are joined with commas.
+func (hm *HTTPModule) handleResponse(L *lua.LState, resp *http.Response) int {
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		hm.vm.monitor.handleError(fmt.Errorf("HTTP POST failed: %v", err))
+		hm.vm.monitor.handleError(fmt.Errorf("Failed to read response body: %v", err))
 		L.Push(lua.LNil)
-		return 1
+		L.Push(lua.LString(err.Error()))
+		return 2
 	}
-	defer resp.Body.Close()
 
-	return hm.handleResponse(L, resp)
+	response := L.NewTable()
+	response.RawSetString("status", lua.LNumber(resp.StatusCode))
+	response.RawSetString("body", lua.LString(string(body)))
+
+	headers := L.NewTable()
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			headers.RawSetString(key, lua.LString(strings.Join(values, ", ")))
+		}
+	}
+	response.RawSetString("headers", headers)
+
+	L.Push(response)
+	return 1
 }
 
-func (hm *HTTPModule) put(L *lua.LState) int {
-	url := L.CheckString(1)
-	body := L.CheckString(2)
+type requestOptions struct {
+	method          string
+	url             string
+	headers         http.Header
+	query           url.Values
+	body            requestBody
+	contentType     string
+	timeout         time.Duration
+	hasTimeout      bool
+	followRedirects bool
+	maxRedirects    int
+	stream          bool
+	jar             http.CookieJar
+	retry           *RetryPolicy
+	breaker         *BreakerPolicy
+	hasRetry        bool
+	hasBreaker      bool
+	overrides       []clientOverride
+	cache           string
+}
 
-	req, err := http.NewRequest("PUT", url, bytes.NewBufferString(body))
+func (hm *HTTPModule) httpRequest(L *lua.LState) int {
+	opts, err := hm.parseRequestOptions(L, 1)
 	if err != nil {
-		hm.vm.monitor.handleError(fmt.Errorf("HTTP PUT failed: %v", err))
 		L.Push(lua.LNil)
-		return 1
+		L.Push(lua.LString(err.Error()))
+		return 2
 	}
-	req.Header.Set("Content-Type", "application/json")
+	return hm.perform(L, opts)
+}
 
-	resp, err := hm.client.Do(req)
+func (hm *HTTPModule) perform(L *lua.LState, opts *requestOptions) int {
+	req, err := hm.newRequest(opts)
 	if err != nil {
-		hm.vm.monitor.handleError(fmt.Errorf("HTTP PUT failed: %v", err))
 		L.Push(lua.LNil)
-		return 1
+		L.Push(lua.LString(err.Error()))
+		return 2
 	}
-	defer resp.Body.Close()
-
-	return hm.handleResponse(L, resp)
-}
-
-func (hm *HTTPModule) delete(L *lua.LState) int {
-	url := L.CheckString(1)
 
-	req, err := http.NewRequest("DELETE", url, nil)
+	client, err := hm.clientFor(opts)
 	if err != nil {
-		hm.vm.monitor.handleError(fmt.Errorf("HTTP DELETE failed: %v", err))
 		L.Push(lua.LNil)
-		return 1
+		L.Push(lua.LString(err.Error()))
+		return 2
 	}
-
-	resp, err := hm.client.Do(req)
+	start := time.Now()
+	resp, err := client.Do(req)
 	if err != nil {
-		hm.vm.monitor.handleError(fmt.Errorf("HTTP DELETE failed: %v", err))
 		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	if opts.stream {
+		response := hm.responseTable(L, resp, nil, time.Since(start))
+		hm.addStreamMethods(L, response, resp)
+		L.Push(response)
 		return 1
 	}
 	defer resp.Body.Close()
 
-	return hm.handleResponse(L, resp)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to read response body: %v", err)))
+		return 2
+	}
+
+	L.Push(hm.responseTable(L, resp, body, time.Since(start)))
+	return 1
 }
 
-func (hm *HTTPModule) request(L *lua.LState) int {
-	method := L.CheckString(1)
-	url := L.CheckString(2)
+func (hm *HTTPModule) parseRequestOptions(L *lua.LState, idx int) (*requestOptions, error) {
+	if s, ok := L.Get(idx).(lua.LString); ok {
+		opts := newRequestOptions()
+		opts.url = string(s)
+		return opts, nil
+	}
+	return hm.parseRequestTable(L.CheckTable(idx))
+}
 
-	
-	var body io.Reader
-	if L.GetTop() > 2 {
-		body = bytes.NewBufferString(L.CheckString(3))
+func newRequestOptions() *requestOptions {
+	return &requestOptions{
+		method:          http.MethodGet,
+		headers:         make(http.Header),
+		query:           make(url.Values),
+		followRedirects: true,
+		maxRedirects:    10,
 	}
+}
 
-	
-	headers := make(map[string]string)
-	if L.GetTop() > 3 {
-		headersTable := L.CheckTable(4)
-		headersTable.ForEach(func(key, value lua.LValue) {
-			headers[key.String()] = value.String()
+func (hm *HTTPModule) parseRequestTable(tbl *lua.LTable) (*requestOptions, error) {
+	opts := newRequestOptions()
+
+	if v, ok := tbl.RawGetString("method").(lua.LString); ok {
+		opts.method = strings.ToUpper(string(v))
+	}
+	if v, ok := tbl.RawGetString("url").(lua.LString); ok {
+		opts.url = string(v)
+	}
+
+	if v, ok := tbl.RawGetString("headers").(*lua.LTable); ok {
+		eachValue(v, func(key, value string) {
+			opts.headers.Add(key, value)
+		})
+	}
+	if v, ok := tbl.RawGetString("query").(*lua.LTable); ok {
+		eachValue(v, func(key, value string) {
+			opts.query.Add(key, value)
 		})
 	}
 
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		hm.vm.monitor.handleError(fmt.Errorf("HTTP %s request failed: %v", method, err))
-		L.Push(lua.LNil)
-		return 1
+	if v, ok := tbl.RawGetString("timeout").(lua.LNumber); ok {
+		opts.timeout = secondsToDuration(v)
+		opts.hasTimeout = true
+	}
+	if v, ok := tbl.RawGetString("follow_redirects").(lua.LBool); ok {
+		opts.followRedirects = bool(v)
+	}
+	if v, ok := tbl.RawGetString("max_redirects").(lua.LNumber); ok {
+		opts.maxRedirects = int(v)
+	}
+
+	switch auth := tbl.RawGetString("basic_auth").(type) {
+	case *lua.LTable:
+		user := auth.RawGetString("username")
+		pass := auth.RawGetString("password")
+		if user == lua.LNil {
+			user = auth.RawGetInt(1)
+			pass = auth.RawGetInt(2)
+		}
+		opts.headers.Set("Authorization", "Basic "+basicAuth(lua.LVAsString(user), lua.LVAsString(pass)))
+	case lua.LString:
+		opts.headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if v, ok := tbl.RawGetString("bearer").(lua.LString); ok {
+		opts.headers.Set("Authorization", "Bearer "+string(v))
 	}
 
-	
-	for key, value := range headers {
-		req.Header.Set(key, value)
+	if v := tbl.RawGetString("json"); v != lua.LNil {
+		data, err := json.Marshal(convertToGoValue(v))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode json body: %v", err)
+		}
+		opts.body = bytesBody(data)
+		opts.contentType = "application/json"
+	} else if v, ok := tbl.RawGetString("form").(*lua.LTable); ok {
+		opts.body = bytesBody([]byte(encodeForm(v)))
+		opts.contentType = "application/x-www-form-urlencoded"
+	} else if v, ok := tbl.RawGetString("multipart").(*lua.LTable); ok {
+		parts, err := modules.ParseMultipartParts(v)
+		if err != nil {
+			return nil, err
+		}
+		form := modules.NewMultipartForm(parts)
+		opts.body = func() (io.ReadCloser, int64, error) {
+			body, err := form.Open()
+			return body, -1, err
+		}
+		opts.contentType = form.ContentType()
+	} else if v, ok := tbl.RawGetString("body").(lua.LString); ok {
+		opts.body = bytesBody([]byte(v))
+	} else if v, ok := tbl.RawGetString("body_file").(lua.LString); ok {
+		opts.body = fileBody(string(v))
+	}
+	if v, ok := tbl.RawGetString("stream").(lua.LBool); ok {
+		opts.stream = bool(v)
 	}
 
-	resp, err := hm.client.Do(req)
+	overrides, err := parseClientOverrides(tbl)
 	if err != nil {
-		hm.vm.monitor.handleError(fmt.Errorf("HTTP %s request failed: %v", method, err))
-		L.Push(lua.LNil)
-		return 1
+		return nil, err
+	}
+	opts.overrides = overrides
+	if opts.cache, err = parseCacheOption(tbl.RawGetString("cache")); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	return hm.handleResponse(L, resp)
+	if v := tbl.RawGetString("retry"); v != lua.LNil {
+		retry, err := parseRetryPolicy(v)
+		if err != nil {
+			return nil, err
+		}
+		opts.retry = retry
+		opts.hasRetry = true
+	}
+	if v := tbl.RawGetString("circuit_breaker"); v != lua.LNil {
+		breaker, err := parseBreakerPolicy(v)
+		if err != nil {
+			return nil, err
+		}
+		opts.breaker = breaker
+		opts.hasBreaker = true
+	}
+
+	return opts, nil
 }
 
-func (hm *HTTPModule) handleResponse(L *lua.LState, resp *http.Response) int {
-	
-	body, err := io.ReadAll(resp.Body)
+func (hm *HTTPModule) newRequest(opts *requestOptions) (*http.Request, error) {
+	if opts.url == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	target, err := url.Parse(opts.url)
 	if err != nil {
-		hm.vm.monitor.handleError(fmt.Errorf("Failed to read response body: %v", err))
-		L.Push(lua.LNil)
-		return 1
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+	if len(opts.query) > 0 {
+		query := target.Query()
+		for key, values := range opts.query {
+			for _, value := range values {
+				query.Add(key, value)
+			}
+		}
+		target.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequest(opts.method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.body != nil {
+		body, length, err := opts.body()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+		req.ContentLength = length
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, _, err := opts.body()
+			return body, err
+		}
+	}
+	for key, values := range opts.headers {
+		req.Header[key] = values
+	}
+	if opts.contentType != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", opts.contentType)
+	}
+	return req, nil
+}
+
+func (hm *HTTPModule) clientFor(opts *requestOptions) (*http.Client, error) {
+	client := *hm.client
+	if opts.stream && !opts.hasTimeout {
+		client = *hm.streamClient
+	}
+	if opts.hasTimeout {
+		client.Timeout = opts.timeout
+	}
+	if opts.jar != nil {
+		client.Jar = opts.jar
+	}
+	if len(opts.overrides) > 0 {
+		cfg := hm.vm.httpConfig
+		for _, override := range opts.overrides {
+			override(&cfg)
+		}
+		transport, err := hm.transportFor(cfg)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = transport
+	}
+	if opts.retry != nil || opts.breaker != nil {
+		client.Transport = &policyTransport{
+			hm:      hm,
+			base:    client.Transport,
+			retry:   opts.retry,
+			breaker: opts.breaker,
+			timeout: client.Timeout,
+		}
 	}
+	if cache := hm.currentCache(); cache != nil {
+		if opts.cache == cacheBypass {
+			cache.count(&cache.stats.Bypassed)
+		} else {
+			client.Transport = &cacheTransport{
+				cache:   cache,
+				base:    client.Transport,
+				refresh: opts.cache == cacheRefresh,
+			}
+		}
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !opts.followRedirects {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= opts.maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", opts.maxRedirects)
+		}
+		return nil
+	}
+	return &client, nil
+}
 
-	
+func (hm *HTTPModule) responseTable(L *lua.LState, resp *http.Response, body []byte, elapsed time.Duration) *lua.LTable {
 	response := L.NewTable()
 	response.RawSetString("status", lua.LNumber(resp.StatusCode))
-	response.RawSetString("body", lua.LString(string(body)))
+	response.RawSetString("status_text", lua.LString(http.StatusText(resp.StatusCode)))
+	if body != nil {
+		response.RawSetString("body", lua.LString(string(body)))
+	}
+	response.RawSetString("url", lua.LString(resp.Request.URL.String()))
+	response.RawSetString("elapsed", lua.LNumber(elapsed.Seconds()))
+	response.RawSetString("proto", lua.LString(resp.Proto))
 
-	
 	headers := L.NewTable()
 	for key, values := range resp.Header {
-		if len(values) > 0 {
-			headers.RawSetString(key, lua.LString(values[0]))
+		list := L.NewTable()
+		for _, value := range values {
+			list.Append(lua.LString(value))
 		}
+		headers.RawSetString(key, list)
 	}
 	response.RawSetString("headers", headers)
 
-	L.Push(response)
+	response.RawSetString("header", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		if value := resp.Header.Get(name); value != "" {
+			L.Push(lua.LString(value))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	}))
+
+	response.RawSetString("ok", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(resp.StatusCode >= 200 && resp.StatusCode < 300))
+		return 1
+	}))
+
+	response.RawSetString("json", L.NewFunction(func(L *lua.LState) int {
+		var result interface{}
+		if err := json.Unmarshal(body, &result); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(fmt.Sprintf("failed to decode json body: %v", err)))
+			return 2
+		}
+		L.Push(convertToLuaValue(L, result))
+		return 1
+	}))
+
+	return response
+}
+
+func (hm *HTTPModule) addStreamMethods(L *lua.LState, response *lua.LTable, resp *http.Response) {
+	reader := bufio.NewReader(resp.Body)
+	closed := false
+	closeBody := func() {
+		if !closed {
+			closed = true
+			resp.Body.Close()
+		}
+	}
+
+	response.RawSetString("read", L.NewFunction(func(L *lua.LState) int {
+		size := L.OptInt(2, 32*1024)
+		if closed {
+			L.Push(lua.LNil)
+			return 1
+		}
+		buf := make([]byte, size)
+		n, err := reader.Read(buf)
+		if n > 0 {
+			L.Push(lua.LString(string(buf[:n])))
+			return 1
+		}
+		closeBody()
+		if err != nil && err != io.EOF {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LNil)
+		return 1
+	}))
+
+	response.RawSetString("lines", L.NewFunction(func(L *lua.LState) int {
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if closed {
+				L.Push(lua.LNil)
+				return 1
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				closeBody()
+				if err != io.EOF {
+					L.RaiseError("failed to read response body: %v", err)
+				}
+				if line == "" {
+					L.Push(lua.LNil)
+					return 1
+				}
+			}
+			L.Push(lua.LString(strings.TrimRight(line, "\r\n")))
+			return 1
+		}))
+		return 1
+	}))
+
+	response.RawSetString("json", L.NewFunction(func(L *lua.LState) int {
+		defer closeBody()
+		var result interface{}
+		if err := json.NewDecoder(reader).Decode(&result); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(fmt.Sprintf("failed to decode json body: %v", err)))
+			return 2
+		}
+		L.Push(convertToLuaValue(L, result))
+		return 1
+	}))
+
+	response.RawSetString("close", L.NewFunction(func(L *lua.LState) int {
+		closeBody()
+		return 0
+	}))
+}
+
+func (hm *HTTPModule) download(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	opts, err := hm.parseRequestTable(tbl)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	return hm.performDownload(L, opts, tbl)
+}
+
+func (hm *HTTPModule) performDownload(L *lua.LState, opts *requestOptions, tbl *lua.LTable) int {
+	path, ok := tbl.RawGetString("path").(lua.LString)
+	if !ok || path == "" {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("path is required"))
+		return 2
+	}
+	opts.stream = true
+
+	req, err := hm.newRequest(opts)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	var progress func(written, total int64)
+	if fn, ok := tbl.RawGetString("progress").(*lua.LFunction); ok {
+		progress = func(written, total int64) {
+			totalValue := lua.LValue(lua.LNil)
+			if total >= 0 {
+				totalValue = lua.LNumber(total)
+			}
+			L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: false}, lua.LNumber(written), totalValue)
+		}
+	}
+
+	client, err := hm.clientFor(opts)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	start := time.Now()
+	result, err := modules.DownloadToFile(client, req, string(path), lua.LVAsBool(tbl.RawGetString("resume")), progress)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	info := L.NewTable()
+	info.RawSetString("path", lua.LString(result.Path))
+	info.RawSetString("bytes", lua.LNumber(result.Bytes))
+	if result.Total >= 0 {
+		info.RawSetString("total", lua.LNumber(result.Total))
+	}
+	info.RawSetString("status", lua.LNumber(result.Status))
+	info.RawSetString("resumed", lua.LBool(result.Resumed))
+	info.RawSetString("elapsed", lua.LNumber(time.Since(start).Seconds()))
+	L.Push(info)
 	return 1
 }
+
+// requestBody opens a fresh copy of a request body, so the request can be
+// sent again on redirects and retries. A length of -1 means unknown.
+type requestBody func() (io.ReadCloser, int64, error)
+
+func bytesBody(data []byte) requestBody {
+	return func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+}
+
+func fileBody(path string) requestBody {
+	return func() (io.ReadCloser, int64, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open body file: %v", err)
+		}
+		length := int64(-1)
+		if info, err := file.Stat(); err == nil {
+			length = info.Size()
+		}
+		return file, length, nil
+	}
+}
+
+func encodeForm(tbl *lua.LTable) string {
+	form := make(url.Values)
+	eachValue(tbl, func(key, value string) {
+		form.Add(key, value)
+	})
+	return form.Encode()
+}
+
+// valuesTable converts url.Values to a table mapping each name to its value,
+// or to an array of values when the name was repeated.
+func valuesTable(L *lua.LState, values url.Values) *lua.LTable {
+	tbl := L.NewTable()
+	for key, list := range values {
+		if len(list) == 1 {
+			tbl.RawSetString(key, lua.LString(list[0]))
+			continue
+		}
+		arr := L.NewTable()
+		for _, value := range list {
+			arr.Append(lua.LString(value))
+		}
+		tbl.RawSetString(key, arr)
+	}
+	return tbl
+}
+
+func eachValue(tbl *lua.LTable, fn func(key, value string)) {
+	tbl.ForEach(func(key, value lua.LValue) {
+		if list, ok := value.(*lua.LTable); ok {
+			for i := 1; i <= list.Len(); i++ {
+				fn(key.String(), list.RawGetInt(i).String())
+			}
+			return
+		}
+		fn(key.String(), value.String())
+	})
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
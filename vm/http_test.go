@@ -0,0 +1,158 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/lines":
+			fmt.Fprint(w, "one\r\ntwo\nthree")
+		case "/json":
+			fmt.Fprint(w, `{"items": [1, 2, 3]}`)
+		case "/upload":
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%d %s", r.ContentLength, body)
+		}
+	}))
+	defer srv.Close()
+
+	upload := filepath.Join(t.TempDir(), "upload.txt")
+	if err := os.WriteFile(upload, []byte("file body"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := newTestVM(t, Config{})
+	runLua(t, v, fmt.Sprintf(`
+		local base = %q
+		local resp = assert(http.request{ url = base .. "/lines", stream = true })
+		assert(resp.status == 200 and resp.body == nil)
+		local lines = {}
+		for line in resp:lines() do lines[#lines + 1] = line end
+		assert(table.concat(lines, ",") == "one,two,three", table.concat(lines, ","))
+
+		resp = assert(http.request{ url = base .. "/lines", stream = true })
+		local chunks = {}
+		while true do
+			local chunk = resp:read(4)
+			if not chunk then break end
+			assert(#chunk <= 4)
+			chunks[#chunks + 1] = chunk
+		end
+		assert(table.concat(chunks) == "one\r\ntwo\nthree")
+		assert(resp:read() == nil, "read after the end")
+
+		resp = assert(http.request{ url = base .. "/json", stream = true })
+		local data = assert(resp:json())
+		assert(#data.items == 3 and data.items[3] == 3)
+
+		resp = assert(http.request{ url = base .. "/lines", stream = true })
+		resp:close()
+		assert(resp:read() == nil, "read after close")
+
+		resp = assert(http.request{ url = base .. "/upload", method = "POST", body_file = %q })
+		assert(resp.body == "9 file body", resp.body)
+	`, srv.URL, upload))
+}
+
+func TestHTTPDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	ranged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ranged.Close()
+	// Ignores Range and streams without a Content-Length.
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer plain.Close()
+
+	dir := t.TempDir()
+	v := newTestVM(t, Config{})
+	download := func(name, url string, partial int, resume bool) (string, []byte) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if partial > 0 {
+			if err := os.WriteFile(path, content[:partial], 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runLua(t, v, fmt.Sprintf(`
+			local calls, last, total = 0, 0, nil
+			local info = assert(http.download{
+				url = %q, path = %q, resume = %v,
+				progress = function(done, t)
+					assert(done >= last, "progress went backwards")
+					calls, last, total = calls + 1, done, t
+				end,
+			})
+			assert(calls > 0 and last == info.bytes, "progress ended at " .. last)
+			result = string.format("%%s %%d %%s %%s", tostring(info.resumed), info.bytes, tostring(info.total), tostring(total))
+		`, url, path, resume))
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.state.GetGlobal("result").String(), got
+	}
+
+	size := len(content)
+	tests := []struct {
+		name, url string
+		partial   int
+		resume    bool
+		want      string
+	}{
+		{"fresh", ranged.URL, 0, false, fmt.Sprintf("false %d %d %d", size, size, size)},
+		{"resumed", ranged.URL, 30000, true, fmt.Sprintf("true %d %d %d", size, size, size)},
+		{"range ignored", plain.URL, 30000, true, fmt.Sprintf("false %d nil nil", size)},
+		{"not resuming", ranged.URL, 30000, false, fmt.Sprintf("false %d %d %d", size, size, size)},
+	}
+	for _, tt := range tests {
+		summary, got := download(strings.ReplaceAll(tt.name, " ", "-"), tt.url, tt.partial, tt.resume)
+		if summary != tt.want {
+			t.Errorf("%s: resumed, bytes, total, progress total = %s, want %s", tt.name, summary, tt.want)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s: downloaded %d bytes that differ from the %d served", tt.name, len(got), size)
+		}
+	}
+}
+
+func TestLegacyHTTPFunctions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Add("X-Multi", "a")
+		w.Header().Add("X-Multi", "b")
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.Header.Get("Content-Type"), r.Header.Get("X-Custom"), body)
+	}))
+	defer srv.Close()
+
+	v := newTestVM(t, Config{})
+	runLua(t, v, fmt.Sprintf(`
+		local url = %q
+		local resp = assert(http_get(url))
+		assert(resp.status == 200 and resp.body == "GET   ", resp.body)
+		assert(resp.headers["X-Multi"] == "a, b", tostring(resp.headers["X-Multi"]))
+		assert(http_post(url, "{}").body == "POST application/json  {}")
+		assert(http_put(url, "[]").body == "PUT application/json  []")
+		assert(http_delete(url).body == "DELETE   ")
+		resp = http_request("PATCH", url, "x", { ["X-Custom"] = "yes" })
+		assert(resp.body == "PATCH  yes x", resp.body)
+
+		http.mock.stub{ url = url .. "/stubbed", status = 201, body = "stubbed" }
+		resp = assert(http_request("GET", url .. "/stubbed"))
+		assert(resp.status == 201 and resp.body == "stubbed", resp.body)
+		http.mock.assert_called{ url = "*/stubbed", times = 1 }
+	`, srv.URL))
+}
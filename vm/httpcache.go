@@ -0,0 +1,708 @@
+package vm
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	cacheMemory = "memory"
+	cacheDisk   = "disk"
+
+	defaultCacheDir        = ".solvm/http-cache"
+	defaultCacheMaxEntries = 1000
+	defaultCacheMaxSize    = 100 << 20
+	defaultCacheMaxBody    = 10 << 20
+
+	maxHeuristicLifetime = 24 * time.Hour
+
+	cacheUse     = "use"
+	cacheBypass  = "bypass"
+	cacheRefresh = "refresh"
+)
+
+type cacheEntry struct {
+	URL          string            `json:"url"`
+	Status       int               `json:"status"`
+	Header       http.Header       `json:"headers"`
+	Body         []byte            `json:"body"`
+	Vary         map[string]string `json:"vary,omitempty"`
+	RequestTime  time.Time         `json:"request_time"`
+	ResponseTime time.Time         `json:"response_time"`
+}
+
+type cacheStore interface {
+	get(key string) *cacheEntry
+	set(key string, entry *cacheEntry) error
+	remove(key string)
+	clear() error
+	len() int
+}
+
+type CacheStats struct {
+	Hits        int64
+	Misses      int64
+	Revalidated int64
+	Stores      int64
+	Bypassed    int64
+}
+
+// HTTPCache is a shared HTTP cache in the sense of RFC 9111: it stores GET
+// responses that carry an explicit lifetime or a validator, serves them while
+// they are fresh and revalidates them with conditional requests afterwards.
+// Every session in the VM uses it, so responses to requests with credentials
+// are only stored when the server says they may be shared.
+type HTTPCache struct {
+	mu      sync.Mutex
+	store   cacheStore
+	storage string
+	maxBody int64
+	clock   Clock
+	stats   CacheStats
+}
+
+func NewHTTPCache(store cacheStore, storage string, maxBody int64, clock Clock) *HTTPCache {
+	return &HTTPCache{store: store, storage: storage, maxBody: maxBody, clock: clock}
+}
+
+func (c *HTTPCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *HTTPCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.store.clear()
+}
+
+func (c *HTTPCache) count(counter *int64) {
+	c.mu.Lock()
+	*counter++
+	c.mu.Unlock()
+}
+
+func (c *HTTPCache) lookup(req *http.Request) *cacheEntry {
+	c.mu.Lock()
+	entry := c.store.get(req.URL.String())
+	c.mu.Unlock()
+
+	if entry == nil {
+		return nil
+	}
+	for name, value := range entry.Vary {
+		if req.Header.Get(name) != value {
+			return nil
+		}
+	}
+	return entry
+}
+
+func (c *HTTPCache) save(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store.set(entry.URL, entry); err == nil {
+		c.stats.Stores++
+	}
+}
+
+func (c *HTTPCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store.remove(key)
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := make(cacheControl)
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(directive, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, true
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+func (e *cacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+func (e *cacheEntry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Header.Values("Cache-Control"))
+	if cc.has("no-cache") {
+		return 0
+	}
+	if sMaxAge, ok := cc.seconds("s-maxage"); ok {
+		return sMaxAge
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+		heuristic := e.date().Sub(lastModified) / 10
+		if heuristic > maxHeuristicLifetime {
+			heuristic = maxHeuristicLifetime
+		}
+		return heuristic
+	}
+	return 0
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := e.ResponseTime.Sub(e.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+	corrected := e.ResponseTime.Sub(e.RequestTime)
+	if secs, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil {
+		corrected += time.Duration(secs) * time.Second
+	}
+	if corrected > apparent {
+		apparent = corrected
+	}
+	return apparent + now.Sub(e.ResponseTime)
+}
+
+func (e *cacheEntry) fresh(now time.Time, reqCC cacheControl) bool {
+	if reqCC.has("no-cache") {
+		return false
+	}
+	age := e.age(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < e.lifetime()
+}
+
+func (e *cacheEntry) response(req *http.Request, state string, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	header.Set("X-Cache", state)
+	return newMockResponse(req, e.Status, header, e.Body)
+}
+
+// freshen applies the headers of a 304 response to a stored entry, as the
+// server is allowed to update metadata such as Cache-Control or Expires.
+func (e *cacheEntry) freshen(header http.Header, requestTime, responseTime time.Time) *cacheEntry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+func cacheableStatus(status int) bool {
+	switch status {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+// storable reports whether a response may be stored and, if so, which request
+// headers it varies on.
+func storable(req *http.Request, resp *http.Response) (map[string]string, bool) {
+	if !cacheableStatus(resp.StatusCode) {
+		return nil, false
+	}
+	cc := parseCacheControl(resp.Header.Values("Cache-Control"))
+	if cc.has("no-store") || cc.has("private") || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return nil, false
+	}
+	credentials := req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != ""
+	if credentials && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return nil, false
+	}
+
+	explicit := cc.has("max-age") || cc.has("s-maxage") || resp.Header.Get("Expires") != ""
+	validator := resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+	if !explicit && !validator {
+		return nil, false
+	}
+
+	var vary map[string]string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+			if vary == nil {
+				vary = make(map[string]string)
+			}
+			vary[name] = req.Header.Get(name)
+		}
+	}
+	return vary, true
+}
+
+type cacheTransport struct {
+	cache   *HTTPCache
+	base    http.RoundTripper
+	refresh bool
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.cache
+
+	if req.Method != http.MethodGet {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil && req.Method != http.MethodHead && req.Method != http.MethodOptions && resp.StatusCode < 400 {
+			c.invalidate(req.URL.String())
+		}
+		return resp, err
+	}
+
+	reqCC := parseCacheControl(req.Header.Values("Cache-Control"))
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" ||
+		req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		c.count(&c.stats.Bypassed)
+		return t.base.RoundTrip(req)
+	}
+
+	var entry *cacheEntry
+	if !t.refresh {
+		entry = c.lookup(req)
+	}
+	if entry != nil && entry.fresh(c.clock.Now(), reqCC) {
+		c.count(&c.stats.Hits)
+		return entry.response(req, "HIT", c.clock.Now()), nil
+	}
+
+	outgoing := req
+	if entry != nil {
+		etag := entry.Header.Get("ETag")
+		lastModified := entry.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			outgoing = req.Clone(req.Context())
+			if etag != "" {
+				outgoing.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				outgoing.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	requestTime := c.clock.Now()
+	resp, err := t.base.RoundTrip(outgoing)
+	if err != nil {
+		return nil, err
+	}
+	responseTime := c.clock.Now()
+
+	if outgoing != req && resp.StatusCode == http.StatusNotModified {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		entry = entry.freshen(resp.Header, requestTime, responseTime)
+		c.save(entry)
+		c.count(&c.stats.Revalidated)
+		return entry.response(req, "REVALIDATED", responseTime), nil
+	}
+
+	c.count(&c.stats.Misses)
+	vary, ok := storable(req, resp)
+	if !ok {
+		if entry != nil {
+			c.invalidate(req.URL.String())
+		}
+		return resp, nil
+	}
+
+	pending := &cacheEntry{
+		URL:          req.URL.String(),
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Vary:         vary,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		limit:      c.maxBody,
+		done: func(body []byte) {
+			pending.Body = append([]byte(nil), body...)
+			c.save(pending)
+		},
+	}
+	return resp, nil
+}
+
+// cachingBody copies a response body as it is read and stores it once the
+// whole body has been seen, so streamed responses can be cached too. Bodies
+// that are closed early or exceed the limit are not stored.
+type cachingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	done     func(body []byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
+
+type memoryStore struct {
+	maxEntries int
+	order      *list.List
+	items      map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *cacheEntry
+}
+
+func newMemoryStore(maxEntries int) *memoryStore {
+	return &memoryStore{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (s *memoryStore) get(key string) *cacheEntry {
+	elem, exists := s.items[key]
+	if !exists {
+		return nil
+	}
+	s.order.MoveToFront(elem)
+	return elem.Value.(*memoryItem).entry
+}
+
+func (s *memoryStore) set(key string, entry *cacheEntry) error {
+	if elem, exists := s.items[key]; exists {
+		elem.Value.(*memoryItem).entry = entry
+		s.order.MoveToFront(elem)
+		return nil
+	}
+	s.items[key] = s.order.PushFront(&memoryItem{key: key, entry: entry})
+	for s.maxEntries > 0 && s.order.Len() > s.maxEntries {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+func (s *memoryStore) remove(key string) {
+	if elem, exists := s.items[key]; exists {
+		s.order.Remove(elem)
+		delete(s.items, key)
+	}
+}
+
+func (s *memoryStore) clear() error {
+	s.order.Init()
+	s.items = make(map[string]*list.Element)
+	return nil
+}
+
+func (s *memoryStore) len() int {
+	return s.order.Len()
+}
+
+// diskStore keeps one JSON file per URL, named after the hash of the URL.
+// Once the files add up to more than maxSize bytes, the oldest are removed.
+type diskStore struct {
+	dir     string
+	maxSize int64
+	size    int64
+}
+
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	s := &diskStore{dir: dir, maxSize: maxSize}
+	for _, file := range s.files() {
+		s.size += file.size
+	}
+	s.evict("")
+	return s, nil
+}
+
+type diskFile struct {
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// files lists the entries, oldest first.
+func (s *diskStore) files() []diskFile {
+	paths, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	var files []diskFile
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			files = append(files, diskFile{path: path, size: info.Size(), modified: info.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modified.Before(files[j].modified) })
+	return files
+}
+
+// evict removes the oldest entries until the store fits in maxSize, keeping
+// the one at keep, which was just written.
+func (s *diskStore) evict(keep string) {
+	if s.maxSize <= 0 || s.size <= s.maxSize {
+		return
+	}
+	for _, file := range s.files() {
+		if s.size <= s.maxSize {
+			return
+		}
+		if file.path != keep && os.Remove(file.path) == nil {
+			s.size -= file.size
+		}
+	}
+}
+
+func (s *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *diskStore) get(key string) *cacheEntry {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.URL != key {
+		return nil
+	}
+	return &entry
+}
+
+func (s *diskStore) set(key string, entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	path := s.path(key)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	old, _ := os.Stat(path)
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if old != nil {
+		s.size -= old.Size()
+	}
+	s.size += int64(len(data))
+	s.evict(path)
+	return nil
+}
+
+func (s *diskStore) remove(key string) {
+	path := s.path(key)
+	if info, err := os.Stat(path); err == nil && os.Remove(path) == nil {
+		s.size -= info.Size()
+	}
+}
+
+func (s *diskStore) clear() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	s.size = 0
+	return nil
+}
+
+func (s *diskStore) len() int {
+	files, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	return len(files)
+}
+
+func parseCacheOption(value lua.LValue) (string, error) {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return "", nil
+	case lua.LBool:
+		if v {
+			return cacheUse, nil
+		}
+		return cacheBypass, nil
+	case lua.LString:
+		if v == cacheRefresh {
+			return cacheRefresh, nil
+		}
+	}
+	return "", fmt.Errorf("cache must be true, false or \"refresh\"")
+}
+
+func (hm *HTTPModule) currentCache() *HTTPCache {
+	hm.cacheMu.RLock()
+	defer hm.cacheMu.RUnlock()
+	return hm.cache
+}
+
+func (hm *HTTPModule) cacheFunctions() map[string]lua.LGFunction {
+	return map[string]lua.LGFunction{
+		"enable": func(L *lua.LState) int {
+			opts := L.OptTable(1, L.NewTable())
+
+			storage := cacheMemory
+			if v, ok := opts.RawGetString("storage").(lua.LString); ok {
+				storage = string(v)
+			}
+			maxBody := int64(defaultCacheMaxBody)
+			if v, ok := opts.RawGetString("max_body_size").(lua.LNumber); ok {
+				maxBody = int64(v)
+			}
+
+			var store cacheStore
+			switch storage {
+			case cacheMemory:
+				maxEntries := defaultCacheMaxEntries
+				if v, ok := opts.RawGetString("max_entries").(lua.LNumber); ok {
+					maxEntries = int(v)
+				}
+				store = newMemoryStore(maxEntries)
+			case cacheDisk:
+				dir := defaultCacheDir
+				if v, ok := opts.RawGetString("dir").(lua.LString); ok {
+					dir = string(v)
+				}
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(hm.vm.workingDir, dir)
+				}
+				maxSize := int64(defaultCacheMaxSize)
+				if v, ok := opts.RawGetString("max_size").(lua.LNumber); ok {
+					maxSize = int64(v)
+				}
+				var err error
+				if store, err = newDiskStore(dir, maxSize); err != nil {
+					L.RaiseError("%v", err)
+				}
+			default:
+				L.ArgError(1, fmt.Sprintf("invalid cache storage %q", storage))
+			}
+
+			hm.cacheMu.Lock()
+			hm.cache = NewHTTPCache(store, storage, maxBody, hm.vm.clock)
+			hm.cacheMu.Unlock()
+			return 0
+		},
+		"disable": func(L *lua.LState) int {
+			hm.cacheMu.Lock()
+			hm.cache = nil
+			hm.cacheMu.Unlock()
+			return 0
+		},
+		"clear": func(L *lua.LState) int {
+			if cache := hm.currentCache(); cache != nil {
+				if err := cache.Clear(); err != nil {
+					L.RaiseError("failed to clear cache: %v", err)
+				}
+			}
+			return 0
+		},
+		"stats": func(L *lua.LState) int {
+			result := L.NewTable()
+			cache := hm.currentCache()
+			result.RawSetString("enabled", lua.LBool(cache != nil))
+			if cache == nil {
+				L.Push(result)
+				return 1
+			}
+
+			stats := cache.Stats()
+			cache.mu.Lock()
+			entries := cache.store.len()
+			cache.mu.Unlock()
+
+			result.RawSetString("storage", lua.LString(cache.storage))
+			result.RawSetString("entries", lua.LNumber(entries))
+			result.RawSetString("hits", lua.LNumber(stats.Hits))
+			result.RawSetString("misses", lua.LNumber(stats.Misses))
+			result.RawSetString("revalidated", lua.LNumber(stats.Revalidated))
+			result.RawSetString("stores", lua.LNumber(stats.Stores))
+			result.RawSetString("bypassed", lua.LNumber(stats.Bypassed))
+			L.Push(result)
+			return 1
+		},
+	}
+}
@@ -0,0 +1,187 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type cacheFixture struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+	clock  *FakeClock
+	hits   int32
+}
+
+func newCacheFixture(t *testing.T, handler http.HandlerFunc) *cacheFixture {
+	t.Helper()
+	f := &cacheFixture{t: t, clock: NewFakeClock(time.Now())}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.hits, 1)
+		w.Header().Set("Date", f.clock.Now().UTC().Format(http.TimeFormat))
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	cache := NewHTTPCache(newMemoryStore(100), "memory", 1<<20, f.clock)
+	f.url = srv.URL
+	f.client = &http.Client{Transport: &cacheTransport{cache: cache, base: http.DefaultTransport}}
+	return f
+}
+
+// get returns the body and X-Cache header of a GET request.
+func (f *cacheFixture) get(headers ...string) (string, string) {
+	f.t.Helper()
+	req, _ := http.NewRequest("GET", f.url, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body), resp.Header.Get("X-Cache")
+}
+
+func (f *cacheFixture) expect(wantBody, wantState string, wantHits int32, headers ...string) {
+	f.t.Helper()
+	body, state := f.get(headers...)
+	if body != wantBody || state != wantState {
+		f.t.Fatalf("got %q (X-Cache %q), want %q (%q)", body, state, wantBody, wantState)
+	}
+	if hits := atomic.LoadInt32(&f.hits); hits != wantHits {
+		f.t.Fatalf("server saw %d requests, want %d", hits, wantHits)
+	}
+}
+
+func TestHTTPCacheFreshnessAndRevalidation(t *testing.T) {
+	version := "v1"
+	f := newCacheFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + version + `"`
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, version)
+	})
+
+	f.expect("v1", "", 1)
+	f.expect("v1", "HIT", 1)
+	f.clock.Advance(30 * time.Second)
+	f.expect("v1", "HIT", 1)
+
+	f.clock.Advance(31 * time.Second)
+	f.expect("v1", "REVALIDATED", 2)
+	f.expect("v1", "HIT", 2)
+
+	f.expect("v1", "REVALIDATED", 3, "Cache-Control", "no-cache")
+
+	version = "v2"
+	f.clock.Advance(61 * time.Second)
+	f.expect("v2", "", 4)
+	f.expect("v2", "HIT", 4)
+}
+
+func TestHTTPCacheNoStore(t *testing.T) {
+	f := newCacheFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store, max-age=60")
+		io.WriteString(w, "x")
+	})
+	f.expect("x", "", 1)
+	f.expect("x", "", 2)
+}
+
+func TestHTTPCacheCredentials(t *testing.T) {
+	private := newCacheFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "user:"+r.Header.Get("Authorization")+r.Header.Get("Cookie"))
+	})
+	private.expect("user:Bearer a", "", 1, "Authorization", "Bearer a")
+	private.expect("user:Bearer b", "", 2, "Authorization", "Bearer b")
+	private.expect("user:session=a", "", 3, "Cookie", "session=a")
+	private.expect("user:", "", 4)
+	private.expect("user:", "HIT", 4)
+
+	shared := newCacheFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		io.WriteString(w, "shared")
+	})
+	shared.expect("shared", "", 1, "Authorization", "Bearer a")
+	shared.expect("shared", "HIT", 1)
+
+	for _, header := range []string{"Cache-Control", "Set-Cookie"} {
+		value := "private, max-age=60"
+		if header == "Set-Cookie" {
+			value = "session=secret"
+		}
+		f := newCacheFixture(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set(header, value)
+			io.WriteString(w, "x")
+		})
+		f.expect("x", "", 1)
+		f.expect("x", "", 2)
+	}
+}
+
+func TestHTTPCacheSharedMaxAge(t *testing.T) {
+	f := newCacheFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=10, s-maxage=100")
+		io.WriteString(w, "x")
+	})
+	f.expect("x", "", 1)
+	f.clock.Advance(50 * time.Second)
+	f.expect("x", "HIT", 1)
+}
+
+func TestHTTPCacheDiskMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	entry := func(key string) *cacheEntry {
+		return &cacheEntry{URL: key, Status: 200, Body: []byte(strings.Repeat("x", 1000))}
+	}
+	data, _ := json.Marshal(entry("https://example.com/0"))
+	s, err := newDiskStore(dir, int64(2*len(data)+len(data)/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Give each entry a distinct age, oldest first.
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("https://example.com/%d", i)
+		if err := s.set(key, entry(key)); err != nil {
+			t.Fatal(err)
+		}
+		modified := base.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(s.path(key), modified, modified)
+	}
+	if n := s.len(); n != 2 {
+		t.Fatalf("%d entries kept, want the 2 that fit", n)
+	}
+	for i, want := range []bool{false, false, true, true} {
+		if got := s.get(fmt.Sprintf("https://example.com/%d", i)) != nil; got != want {
+			t.Errorf("entry %d kept %v, want %v", i, got, want)
+		}
+	}
+
+	// Reopening with a smaller limit trims the directory to it.
+	s, err = newDiskStore(dir, int64(len(data)+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.len() != 1 || s.get("https://example.com/3") == nil {
+		t.Fatalf("after reopening: %d entries, newest kept %v", s.len(), s.get("https://example.com/3") != nil)
+	}
+}
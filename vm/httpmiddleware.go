@@ -0,0 +1,886 @@
+package vm
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// middlewareFunctions builds the middleware table. Every entry takes an
+// options table and returns a native middleware for server:use.
+func (sm *ServerModule) middlewareFunctions() map[string]lua.LGFunction {
+	return map[string]lua.LGFunction{
+		"cors":             sm.corsMiddleware,
+		"csrf":             sm.csrfMiddleware,
+		"compress":         sm.compressMiddleware,
+		"jwt":              sm.jwtMiddleware,
+		"logger":           sm.loggerMiddleware,
+		"rate_limit":       sm.rateLimitMiddleware,
+		"recovery":         sm.recoveryMiddleware,
+		"request_id":       sm.requestIDMiddleware,
+		"security_headers": sm.securityHeadersMiddleware,
+		"session":          sm.sessionMiddleware,
+		"timeout":          sm.timeoutMiddleware,
+	}
+}
+
+// luaStringList reads a string or an array of strings.
+func luaStringList(v lua.LValue) ([]string, bool) {
+	switch v := v.(type) {
+	case lua.LString:
+		return []string{string(v)}, true
+	case *lua.LTable:
+		var list []string
+		for i := 1; i <= v.Len(); i++ {
+			item, ok := v.RawGetInt(i).(lua.LString)
+			if !ok {
+				return nil, false
+			}
+			list = append(list, string(item))
+		}
+		return list, true
+	case *lua.LNilType:
+		return nil, true
+	}
+	return nil, false
+}
+
+// remoteHost is the client address without the port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func flushWriter(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func hijackWriter(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// statusRecorder notes the status and size of a response for middleware
+// that looks at it after the handler has run.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if !sr.wroteHeader {
+		sr.wroteHeader = true
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+	if !sr.wroteHeader {
+		sr.WriteHeader(http.StatusOK)
+	}
+	n, err := sr.ResponseWriter.Write(data)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if !sr.wroteHeader {
+		sr.WriteHeader(http.StatusOK)
+	}
+	flushWriter(sr.ResponseWriter)
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := hijackWriter(sr.ResponseWriter)
+	if err == nil && !sr.wroteHeader {
+		sr.wroteHeader = true
+		sr.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+type corsOptions struct {
+	origins     []string
+	methods     string
+	headers     string
+	expose      string
+	credentials bool
+	maxAge      int
+}
+
+func (o *corsOptions) allowed(origin string) bool {
+	for _, allowed := range o.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// "https://*.example.com" matches any subdomain.
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok {
+			if len(origin) > len(prefix)+len(suffix) &&
+				strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+				strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (o *corsOptions) anyOrigin() bool {
+	for _, allowed := range o.origins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (sm *ServerModule) corsMiddleware(L *lua.LState) int {
+	tbl := L.OptTable(1, L.NewTable())
+	opts := &corsOptions{
+		origins: []string{"*"},
+		methods: "GET, HEAD, POST, PUT, PATCH, DELETE",
+	}
+	list := func(name string) []string {
+		values, ok := luaStringList(tbl.RawGetString(name))
+		if !ok {
+			L.ArgError(1, name+" must be a string or an array of strings")
+		}
+		return values
+	}
+	if origins := list("origins"); origins != nil {
+		opts.origins = origins
+	}
+	if methods := list("methods"); methods != nil {
+		opts.methods = strings.ToUpper(strings.Join(methods, ", "))
+	}
+	opts.headers = strings.Join(list("headers"), ", ")
+	opts.expose = strings.Join(list("expose"), ", ")
+	opts.credentials = lua.LVAsBool(tbl.RawGetString("credentials"))
+	if opts.credentials && opts.anyOrigin() {
+		// Reflecting any origin with credentials would let every site make
+		// authenticated requests on behalf of the user.
+		L.ArgError(1, `credentials require an explicit list of origins, not "*"`)
+	}
+	if v, ok := tbl.RawGetString("max_age").(lua.LNumber); ok {
+		opts.maxAge = int(v)
+	}
+
+	L.Push(middlewareValue(L, "cors", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if origin == "" || !opts.allowed(origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if opts.anyOrigin() {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if opts.credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+				if opts.expose != "" {
+					h.Set("Access-Control-Expose-Headers", opts.expose)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// A preflight request is answered here, before routing.
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", opts.methods)
+			if opts.headers != "" {
+				h.Set("Access-Control-Allow-Headers", opts.headers)
+			} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+			if opts.maxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(opts.maxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}))
+	return 1
+}
+
+var defaultCompressTypes = []string{
+	"text/html", "text/css", "text/plain", "text/javascript", "text/xml", "text/csv",
+	"application/json", "application/javascript", "application/xml", "image/svg+xml",
+}
+
+type compressOptions struct {
+	level   int
+	minSize int
+	types   []string
+}
+
+func (o *compressOptions) compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, t := range o.types {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks gzip or deflate from Accept-Encoding, preferring
+// gzip when both are equally acceptable.
+func negotiateEncoding(r *http.Request) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "deflate" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.ReplaceAll(strings.TrimSpace(params), " ", ""), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > bestQ || (q == bestQ && coding == "gzip") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds the start of a response back until it knows whether
+// it is worth compressing: the content type has to be in the list, the
+// response must not already be encoded or partial, and the body must reach
+// the minimum size unless the handler flushes first.
+type compressWriter struct {
+	http.ResponseWriter
+	opts        *compressOptions
+	encoding    string
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	enc         io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader || cw.decided {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, data...)
+		if len(cw.buf) >= cw.opts.minSize {
+			if err := cw.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(data)
+	}
+	return cw.ResponseWriter.Write(data)
+}
+
+func (cw *compressWriter) decide(bigEnough bool) error {
+	cw.decided = true
+	if !cw.wroteHeader {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	eligible := cw.opts.compressible(h.Get("Content-Type")) &&
+		h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified &&
+		cw.status != http.StatusPartialContent && cw.status >= http.StatusOK
+	if eligible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if size, err := strconv.Atoi(h.Get("Content-Length")); err == nil && size < cw.opts.minSize {
+		bigEnough = false
+	}
+	if eligible && bigEnough {
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		h.Set("Content-Encoding", cw.encoding)
+		// The encoded body differs byte for byte from the original.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		var err error
+		if cw.encoding == "gzip" {
+			cw.enc, err = gzip.NewWriterLevel(cw.ResponseWriter, cw.opts.level)
+		} else {
+			cw.enc, err = zlib.NewWriterLevel(cw.ResponseWriter, cw.opts.level)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+	if flusher, ok := cw.enc.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	flushWriter(cw.ResponseWriter)
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.decided = true
+	return hijackWriter(cw.ResponseWriter)
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			// Nothing was written at all; leave the response to the server.
+			return
+		}
+		cw.decide(len(cw.buf) >= cw.opts.minSize)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+	}
+}
+
+func (sm *ServerModule) compressMiddleware(L *lua.LState) int {
+	tbl := L.OptTable(1, L.NewTable())
+	opts := &compressOptions{level: gzip.DefaultCompression, minSize: 1024, types: defaultCompressTypes}
+	if v, ok := tbl.RawGetString("level").(lua.LNumber); ok {
+		opts.level = int(v)
+		if opts.level < gzip.HuffmanOnly || opts.level > gzip.BestCompression {
+			L.ArgError(1, "level must be between -2 and 9")
+		}
+	}
+	if v, ok := tbl.RawGetString("min_size").(lua.LNumber); ok {
+		opts.minSize = int(v)
+	}
+	types, ok := luaStringList(tbl.RawGetString("types"))
+	if !ok {
+		L.ArgError(1, "types must be a string or an array of strings")
+	}
+	if types != nil {
+		opts.types = nil
+		for _, t := range types {
+			opts.types = append(opts.types, strings.ToLower(t))
+		}
+	}
+
+	L.Push(middlewareValue(L, "compress", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := negotiateEncoding(r)
+			if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, opts: opts, encoding: encoding}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}))
+	return 1
+}
+
+// accessLog writes one line per request in the Common Log Format, the
+// Combined format (which adds the referer and user agent) or as JSON.
+type accessLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	skip   map[string]bool
+}
+
+func (al *accessLog) write(r *http.Request, rec *statusRecorder, start time.Time, duration time.Duration) {
+	status := rec.status
+	if !rec.wroteHeader {
+		status = http.StatusOK
+	}
+	host := remoteHost(r)
+
+	var line []byte
+	switch al.format {
+	case "json":
+		entry := map[string]interface{}{
+			"time":        start.Format(time.RFC3339Nano),
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"query":       r.URL.RawQuery,
+			"proto":       r.Proto,
+			"host":        r.Host,
+			"status":      status,
+			"bytes":       rec.bytes,
+			"duration_ms": float64(duration) / float64(time.Millisecond),
+			"remote_addr": host,
+			"user_agent":  r.UserAgent(),
+		}
+		if id, ok := requestValue(r, "request_id"); ok {
+			entry["request_id"] = id
+		}
+		line, _ = json.Marshal(entry)
+	default:
+		size := "-"
+		if rec.bytes > 0 {
+			size = strconv.FormatInt(rec.bytes, 10)
+		}
+		text := fmt.Sprintf("%s - - [%s] %q %d %s", host, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.URL.RequestURI()+" "+r.Proto, status, size)
+		if al.format == "combined" {
+			text += fmt.Sprintf(" %q %q", r.Referer(), r.UserAgent())
+		}
+		line = []byte(text)
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.out.Write(append(line, '\n'))
+}
+
+func (sm *ServerModule) loggerMiddleware(L *lua.LState) int {
+	tbl := L.OptTable(1, L.NewTable())
+	al := &accessLog{out: os.Stdout, format: "common", skip: make(map[string]bool)}
+	var closeLog func() error
+
+	if v, ok := tbl.RawGetString("format").(lua.LString); ok {
+		al.format = strings.ToLower(string(v))
+		if al.format != "common" && al.format != "combined" && al.format != "json" {
+			L.ArgError(1, "format must be common, combined or json")
+		}
+	}
+	switch output := lua.LVAsString(tbl.RawGetString("output")); output {
+	case "", "stdout":
+	case "stderr":
+		al.out = os.Stderr
+	default:
+		if !filepath.IsAbs(output) {
+			output = filepath.Join(sm.vm.workingDir, output)
+		}
+		file, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			L.ArgError(1, fmt.Sprintf("cannot open log file: %v", err))
+		}
+		al.out = file
+		closeLog = file.Close
+	}
+	skip, ok := luaStringList(tbl.RawGetString("skip"))
+	if !ok {
+		L.ArgError(1, "skip must be a string or an array of strings")
+	}
+	for _, path := range skip {
+		al.skip[path] = true
+	}
+
+	logger := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if al.skip[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := sm.vm.clock.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			defer func() {
+				al.write(r, rec, start, sm.vm.clock.Now().Sub(start))
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+	if closeLog != nil {
+		L.Push(closingMiddlewareValue(L, "logger", logger, closeLog))
+	} else {
+		L.Push(middlewareValue(L, "logger", logger))
+	}
+	return 1
+}
+
+// recoveryMiddleware turns panics in Go code below it into a 500 response
+// and installs custom pages for the errors the server sends itself: 404s,
+// 405s, 401s from before-hooks and failed Lua handlers.
+func (sm *ServerModule) recoveryMiddleware(L *lua.LState) int {
+	tbl := L.OptTable(1, L.NewTable())
+	pages := make(map[int]errorPage)
+	if pagesTbl, ok := tbl.RawGetString("pages").(*lua.LTable); ok {
+		var err error
+		pagesTbl.ForEach(func(key, value lua.LValue) {
+			status, ok := key.(lua.LNumber)
+			if !ok || status < 400 || status > 599 {
+				err = fmt.Errorf("pages must be keyed by error status codes")
+				return
+			}
+			page := errorPage{contentType: "text/html; charset=utf-8"}
+			switch v := value.(type) {
+			case lua.LString:
+				page.body = []byte(v)
+			case *lua.LTable:
+				if ct, ok := v.RawGetString("content_type").(lua.LString); ok {
+					page.contentType = string(ct)
+				}
+				if file, ok := v.RawGetString("file").(lua.LString); ok {
+					data, readErr := os.ReadFile(string(file))
+					if readErr != nil {
+						err = fmt.Errorf("cannot read error page: %v", readErr)
+						return
+					}
+					page.body = data
+				} else {
+					page.body = []byte(lua.LVAsString(v.RawGetString("body")))
+				}
+			default:
+				err = fmt.Errorf("an error page must be a string or a table")
+				return
+			}
+			pages[int(status)] = page
+		})
+		if err != nil {
+			L.ArgError(1, err.Error())
+		}
+	}
+
+	L.Push(middlewareValue(L, "recovery", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, state := ensureRequestState(r, nil)
+			state.mu.Lock()
+			if state.pages == nil {
+				state.pages = make(map[int]errorPage)
+			}
+			for status, page := range pages {
+				state.pages[status] = page
+			}
+			state.mu.Unlock()
+
+			rec := &statusRecorder{ResponseWriter: w}
+			defer func() {
+				if err := recover(); err != nil {
+					if err == http.ErrAbortHandler {
+						panic(err)
+					}
+					sm.vm.monitor.handleError(fmt.Errorf("HTTP handler panic: %v\n%s", err, debug.Stack()))
+					if !rec.wroteHeader {
+						writeError(rec, r, "Internal Server Error", http.StatusInternalServerError)
+					}
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}))
+	return 1
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware gives every request an ID, keeping the one sent by
+// the client (or a proxy) unless trust is false. The ID is set on the
+// request and response headers and exposed as req.context.request_id.
+func (sm *ServerModule) requestIDMiddleware(L *lua.LState) int {
+	tbl := L.OptTable(1, L.NewTable())
+	header := "X-Request-ID"
+	if v, ok := tbl.RawGetString("header").(lua.LString); ok && v != "" {
+		header = string(v)
+	}
+	trust := true
+	if v, ok := tbl.RawGetString("trust").(lua.LBool); ok {
+		trust = bool(v)
+	}
+
+	L.Push(middlewareValue(L, "request_id", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if !trust || !validRequestID(id) {
+				id = uuid.NewString()
+			}
+			r.Header.Set(header, id)
+			w.Header().Set(header, id)
+			setRequestValue(r, "request_id", id)
+			next.ServeHTTP(w, r)
+		})
+	}))
+	return 1
+}
+
+// headerOption reads a header value that defaults to def and is turned off
+// with false.
+func headerOption(L *lua.LState, tbl *lua.LTable, name, def string) string {
+	switch v := tbl.RawGetString(name).(type) {
+	case lua.LString:
+		return string(v)
+	case lua.LBool:
+		if !v {
+			return ""
+		}
+		return def
+	case *lua.LNilType:
+		return def
+	}
+	L.ArgError(1, name+" must be a string or false")
+	return ""
+}
+
+func (sm *ServerModule) securityHeadersMiddleware(L *lua.LState) int {
+	tbl := L.OptTable(1, L.NewTable())
+	headers := map[string]string{
+		"X-Content-Type-Options":       headerOption(L, tbl, "content_type_options", "nosniff"),
+		"X-Frame-Options":              headerOption(L, tbl, "frame_options", "DENY"),
+		"Referrer-Policy":              headerOption(L, tbl, "referrer_policy", "strict-origin-when-cross-origin"),
+		"Content-Security-Policy":      headerOption(L, tbl, "content_security_policy", ""),
+		"Permissions-Policy":           headerOption(L, tbl, "permissions_policy", ""),
+		"Cross-Origin-Opener-Policy":   headerOption(L, tbl, "cross_origin_opener_policy", ""),
+		"Cross-Origin-Resource-Policy": headerOption(L, tbl, "cross_origin_resource_policy", ""),
+	}
+
+	// Strict-Transport-Security is only meaningful over HTTPS, where it is
+	// sent for 180 days unless hsts gives another max age or is false.
+	hsts := ""
+	maxAge := 180 * 24 * 60 * 60
+	switch v := tbl.RawGetString("hsts").(type) {
+	case lua.LNumber:
+		maxAge = int(v)
+	case lua.LBool:
+		if !v {
+			maxAge = 0
+		}
+	case *lua.LNilType:
+	default:
+		L.ArgError(1, "hsts must be a number of seconds or false")
+	}
+	if maxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", maxAge)
+		if lua.LVAsBool(tbl.RawGetString("hsts_subdomains")) {
+			hsts += "; includeSubDomains"
+		}
+		if lua.LVAsBool(tbl.RawGetString("hsts_preload")) {
+			hsts += "; preload"
+		}
+	}
+
+	L.Push(middlewareValue(L, "security_headers", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			for name, value := range headers {
+				if value != "" {
+					h.Set(name, value)
+				}
+			}
+			if hsts != "" && r.TLS != nil {
+				h.Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}))
+	return 1
+}
+
+// timeoutWriter keeps a handler that has run out of time from writing
+// after the timeout response. Headers are collected separately and only
+// copied to the real response when the handler starts it.
+type timeoutWriter struct {
+	w           http.ResponseWriter
+	h           http.Header
+	mu          sync.Mutex
+	timedOut    bool
+	wroteHeader bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(status)
+}
+
+func (tw *timeoutWriter) writeHeader(status int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for name, values := range tw.h {
+		dst[name] = values
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(data []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeader(http.StatusOK)
+	return tw.w.Write(data)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeader(http.StatusOK)
+	flushWriter(tw.w)
+}
+
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	tw.wroteHeader = true
+	return hijackWriter(tw.w)
+}
+
+// timeoutMiddleware cancels the request context when the handler has not
+// started its response in time, which stops Lua handlers, and answers with
+// 503. Once the response has started the handler is left to finish, so
+// streams and WebSockets are not cut off.
+func (sm *ServerModule) timeoutMiddleware(L *lua.LState) int {
+	var timeout time.Duration
+	status := http.StatusServiceUnavailable
+	message := http.StatusText(status)
+	switch v := L.Get(1).(type) {
+	case lua.LNumber:
+		timeout = secondsToDuration(v)
+	case *lua.LTable:
+		timeout = secondsToDuration(lua.LVAsNumber(v.RawGetString("seconds")))
+		if s, ok := v.RawGetString("status").(lua.LNumber); ok {
+			status = int(s)
+		}
+		if m, ok := v.RawGetString("message").(lua.LString); ok {
+			message = string(m)
+		}
+	default:
+		L.ArgError(1, "expected a number of seconds or an options table")
+	}
+	if timeout <= 0 {
+		L.ArgError(1, "timeout must be positive")
+	}
+	if status < 400 || status > 599 {
+		L.ArgError(1, "status must be an error status")
+	}
+
+	L.Push(middlewareValue(L, "timeout", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			tw := &timeoutWriter{w: w, h: make(http.Header)}
+			for name, values := range w.Header() {
+				tw.h[name] = values
+			}
+
+			done := make(chan struct{})
+			var panicked interface{}
+			go func() {
+				defer close(done)
+				defer func() { panicked = recover() }()
+				next.ServeHTTP(tw, r.WithContext(ctx))
+			}()
+
+			select {
+			case <-done:
+			case <-sm.vm.clock.After(timeout):
+				tw.mu.Lock()
+				if !tw.wroteHeader {
+					tw.timedOut = true
+					cancel()
+					// The connection stays busy until the handler returns.
+					w.Header().Set("Connection", "close")
+					writeError(w, r, message, status)
+					flushWriter(w)
+				}
+				tw.mu.Unlock()
+				// The handler may share a Lua state with middleware
+				// further out, so it must be gone before they resume.
+				<-done
+			}
+			if panicked != nil {
+				panic(panicked)
+			}
+		})
+	}))
+	return 1
+}
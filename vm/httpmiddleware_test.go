@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestCORSCredentialsRequireOrigins(t *testing.T) {
+	v := newTestVM(t, Config{})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		local ok, err = pcall(middleware.cors, { credentials = true })
+		assert(not ok and err:find("explicit list of origins"), tostring(err))
+		ok = pcall(middleware.cors, { origins = { "*" }, credentials = true })
+		assert(not ok)
+
+		local app = create_server("cors", %d)
+		app:use(middleware.cors{ origins = { "https://app.example.com" }, credentials = true })
+		app:get("/", function(req) return { body = "ok" } end)
+		app:start()
+	`, port))
+	t.Cleanup(func() { runLua(t, v, `stop_server("cors")`) })
+	addr := waitForServer(t, port)
+
+	for origin, want := range map[string]string{
+		"https://app.example.com":  "https://app.example.com",
+		"https://evil.example.com": "",
+	} {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("origin %s: Access-Control-Allow-Origin %q, want %q", origin, got, want)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Credentials") == "true"; got != (want != "") {
+			t.Errorf("origin %s: Access-Control-Allow-Credentials %v", origin, got)
+		}
+	}
+}
+
+// A relative log file is opened in the script's directory, and stays open
+// until the last server using it stops.
+func TestLoggerFileFollowsServers(t *testing.T) {
+	v := newTestVM(t, Config{})
+	first, second := freePort(t), freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		access_log = middleware.logger{ output = "access.log" }
+		for name, port in pairs({ log_a = %d, log_b = %d }) do
+			local app = create_server(name, port)
+			app:use(access_log)
+			app:get("/", function(req) return { body = "ok" } end)
+			app:start()
+		end
+	`, first, second))
+	logger := evalLua(t, v, "access_log").(*lua.LUserData).Value.(*closingMiddleware)
+
+	get := func(port int, path string) {
+		t.Helper()
+		resp, err := http.Get("http://" + waitForServer(t, port) + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	get(first, "/first")
+	runLua(t, v, `stop_server("log_a")`)
+	get(second, "/second")
+	runLua(t, v, `stop_server("log_b")`)
+
+	data, err := os.ReadFile(filepath.Join(v.workingDir, "access.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "GET /first") || !strings.Contains(string(data), "GET /second") {
+		t.Fatalf("access log:\n%s", data)
+	}
+	if err := logger.close(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("log file still open after both servers stopped: %v", err)
+	}
+}
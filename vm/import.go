@@ -41,18 +41,24 @@ type ImportModule struct {
 }
 
 func NewImportModule(vm *SolVM) *ImportModule {
+	var transport http.RoundTripper
+	base, err := newHTTPTransport(vm.httpConfig)
+	if err != nil {
+		transport = errorTransport{err: err}
+	} else {
+		base.MaxIdleConns = 10
+		base.IdleConnTimeout = 30 * time.Second
+		base.MaxIdleConnsPerHost = 2
+		transport = vm.httpMock.Wrap(base)
+	}
+
 	return &ImportModule{
 		vm:     vm,
 		loaded: make(map[string]bool),
 		cache:  make(map[string]*ModuleCache),
 		httpClient: &http.Client{
-			Timeout: httpTimeout,
-			Transport: &http.Transport{
-				MaxIdleConns:        10,
-				IdleConnTimeout:     30 * time.Second,
-				DisableCompression:  false,
-				MaxIdleConnsPerHost: 2,
-			},
+			Timeout:   httpTimeout,
+			Transport: transport,
 		},
 	}
 }
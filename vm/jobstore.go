@@ -0,0 +1,113 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type JobRecord struct {
+	Name     string    `json:"name"`
+	Kind     string    `json:"kind"`
+	Schedule string    `json:"schedule,omitempty"`
+	Timezone string    `json:"timezone,omitempty"`
+	Interval float64   `json:"interval,omitempty"`
+	NextRun  time.Time `json:"next_run"`
+	LastRun  time.Time `json:"last_run,omitempty"`
+	RunCount int       `json:"run_count"`
+}
+
+type JobStore struct {
+	path    string
+	mu      sync.Mutex
+	records map[string]*JobRecord
+}
+
+func OpenJobStore(path string) (*JobStore, error) {
+	store := &JobStore{
+		path:    path,
+		records: make(map[string]*JobRecord),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job store: %w", err)
+	}
+
+	var records []*JobRecord
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, fmt.Errorf("failed to parse job store: %w", err)
+		}
+	}
+	for _, record := range records {
+		store.records[record.Name] = record
+	}
+
+	return store, nil
+}
+
+func (js *JobStore) Get(name string) (JobRecord, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	record, exists := js.records[name]
+	if !exists {
+		return JobRecord{}, false
+	}
+	return *record, true
+}
+
+func (js *JobStore) Put(record JobRecord) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.records[record.Name] = &record
+	return js.save()
+}
+
+func (js *JobStore) Delete(name string) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if _, exists := js.records[name]; !exists {
+		return nil
+	}
+	delete(js.records, name)
+	return js.save()
+}
+
+func (js *JobStore) save() error {
+	records := make([]*JobRecord, 0, len(js.records))
+	for _, record := range js.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode job store: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(js.path), 0755); err != nil {
+		return fmt.Errorf("failed to create job store directory: %w", err)
+	}
+
+	tmp := js.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write job store: %w", err)
+	}
+	if err := os.Rename(tmp, js.path); err != nil {
+		return fmt.Errorf("failed to write job store: %w", err)
+	}
+	return nil
+}
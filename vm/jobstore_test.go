@@ -0,0 +1,141 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestJobStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "jobs.json")
+	store, err := OpenJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get("missing"); ok {
+		t.Fatal("empty store returned a record")
+	}
+
+	next := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	records := []JobRecord{
+		{Name: "report", Kind: jobCron, Schedule: "0 0 * * * *", Timezone: "UTC", NextRun: next, RunCount: 3},
+		{Name: "poll", Kind: jobInterval, Interval: 30, NextRun: next, LastRun: next.Add(-30 * time.Second), RunCount: 7},
+	}
+	for _, record := range records {
+		if err := store.Put(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := OpenJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range records {
+		got, ok := reopened.Get(want.Name)
+		if !ok || !got.NextRun.Equal(want.NextRun) || !got.LastRun.Equal(want.LastRun) ||
+			got.Kind != want.Kind || got.Schedule != want.Schedule || got.Timezone != want.Timezone ||
+			got.Interval != want.Interval || got.RunCount != want.RunCount {
+			t.Fatalf("%s: got %+v, want %+v", want.Name, got, want)
+		}
+	}
+
+	if err := reopened.Delete("poll"); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _ = OpenJobStore(path)
+	if _, ok := reopened.Get("poll"); ok {
+		t.Fatal("deleted record came back")
+	}
+	if _, ok := reopened.Get("report"); !ok {
+		t.Fatal("delete removed another record")
+	}
+
+	if err := os.WriteFile(path, []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenJobStore(path); err == nil {
+		t.Fatal("corrupt store opened without an error")
+	}
+}
+
+func TestSchedulerPersistedJob(t *testing.T) {
+	dir := t.TempDir()
+	const script = `poll = set_interval(function() end, 60, { name = "poll", persist = true })`
+
+	// The first run is closed before the test ends, like a process exiting.
+	first := NewSolVM(Config{WorkingDir: dir})
+	first.RegisterCustomFunctions()
+	runLua(t, first, script)
+	next := evalLua(t, first, "poll:next_run()")
+	first.Close()
+
+	store, err := OpenJobStore(filepath.Join(dir, defaultJobStore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get("poll"); !ok {
+		t.Fatal("job was not written to the store")
+	}
+
+	second := newTestVM(t, Config{WorkingDir: dir})
+	runLua(t, second, script)
+	if got := evalLua(t, second, "poll:next_run()"); got != next {
+		t.Fatalf("next_run after a restart %v, want the stored %v", got, next)
+	}
+	runLua(t, second, `poll:cancel()`)
+	store, _ = OpenJobStore(filepath.Join(dir, defaultJobStore))
+	if _, ok := store.Get("poll"); ok {
+		t.Fatal("cancelled job stayed in the store")
+	}
+}
+
+func TestSchedulerCatchUp(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		runs   int
+	}{
+		{"once", 1},
+		{"all", 5},
+		{"skip", 0},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := OpenJobStore(filepath.Join(dir, "jobs.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Five runs were due while the script was not running.
+			missedSince := time.Now().Add(-250 * time.Second)
+			if err := store.Put(JobRecord{Name: "tick", Kind: jobInterval, Interval: 60, NextRun: missedSince, RunCount: 3}); err != nil {
+				t.Fatal(err)
+			}
+
+			v := newTestVM(t, Config{WorkingDir: dir, JobStore: "jobs.json"})
+			runs := newJobLog(t)
+			runLua(t, v, fmt.Sprintf(`
+				tick = set_interval(function() %s end, 60, {
+					name = "tick", persist = true, catch_up = %q, overlap = "queue",
+				})
+			`, runs.appendLine(`"run"`), tt.policy))
+
+			want := lua.LNumber(3 + tt.runs)
+			waitFor(t, "catch-up runs", func() bool { return evalLua(t, v, "tick:run_count()") == want })
+			time.Sleep(50 * time.Millisecond)
+			if got := len(runs.lines()); got != tt.runs {
+				t.Fatalf("%d catch-up runs, want %d", got, tt.runs)
+			}
+			if got := evalLua(t, v, "tick:run_count()"); got != want {
+				t.Fatalf("run_count %v, want %v", got, want)
+			}
+			next := float64(evalLua(t, v, "tick:next_run()").(lua.LNumber))
+			if wantNext := missedSince.Add(5 * time.Minute); next != float64(wantNext.UnixNano())/1e9 {
+				t.Fatalf("next_run %v, want the next slot of the old schedule %v", next, wantNext)
+			}
+		})
+	}
+}
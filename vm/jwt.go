@@ -0,0 +1,461 @@
+package vm
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// jwtVerifier checks compact JWS tokens signed with HS256, RS256 or EdDSA.
+// The algorithm named in the token header must be one the verifier was
+// configured for and must match the kind of key it holds, so a token can
+// never choose how it is checked.
+type jwtVerifier struct {
+	clock      Clock
+	secrets    [][]byte
+	rsaKeys    []*rsa.PublicKey
+	edKeys     []ed25519.PublicKey
+	algorithms map[string]bool
+	issuer     string
+	audience   []string
+	leeway     time.Duration
+}
+
+// maxNumericDate is the last second of year 9999; claims beyond it are
+// rejected rather than overflowing.
+const maxNumericDate = 253402300799
+
+// jwtOptionNames are the options that configure a jwtVerifier.
+var jwtOptionNames = []string{"secret", "public_key", "algorithms", "issuer", "audience", "leeway"}
+
+// jwtVerifierCache keeps the verifiers built by jwt.verify, so keys are
+// not parsed again on every call. Handlers often get a fresh copy of the
+// options table per request, so verifiers are found by the options'
+// contents rather than by table.
+type jwtVerifierCache struct {
+	mu        sync.Mutex
+	verifiers map[string]*jwtVerifier
+}
+
+const maxCachedJWTVerifiers = 64
+
+func (c *jwtVerifierCache) get(clock Clock, tbl *lua.LTable) (*jwtVerifier, error) {
+	var key strings.Builder
+	for _, name := range jwtOptionNames {
+		value := tbl.RawGetString(name)
+		key.WriteString(value.Type().String())
+		if list, ok := value.(*lua.LTable); ok {
+			for i := 1; i <= list.Len(); i++ {
+				fmt.Fprintf(&key, "\x00%s", lua.LVAsString(list.RawGetInt(i)))
+			}
+		} else {
+			fmt.Fprintf(&key, "\x00%s", lua.LVAsString(value))
+		}
+		key.WriteByte('\x01')
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.verifiers[key.String()]; ok {
+		return v, nil
+	}
+	v, err := newJWTVerifier(clock, tbl)
+	if err != nil {
+		return nil, err
+	}
+	if c.verifiers == nil || len(c.verifiers) >= maxCachedJWTVerifiers {
+		c.verifiers = make(map[string]*jwtVerifier)
+	}
+	c.verifiers[key.String()] = v
+	return v, nil
+}
+
+func newJWTVerifier(clock Clock, tbl *lua.LTable) (*jwtVerifier, error) {
+	v := &jwtVerifier{clock: clock, algorithms: make(map[string]bool)}
+
+	secrets, ok := luaStringList(tbl.RawGetString("secret"))
+	if !ok {
+		return nil, fmt.Errorf("secret must be a string or an array of strings")
+	}
+	for _, secret := range secrets {
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("secret must be at least %d characters", minSecretLength)
+		}
+		v.secrets = append(v.secrets, []byte(secret))
+	}
+	keys, ok := luaStringList(tbl.RawGetString("public_key"))
+	if !ok {
+		return nil, fmt.Errorf("public_key must be a PEM string or an array of them")
+	}
+	for _, data := range keys {
+		key, err := parsePEMKey(data)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			v.rsaKeys = append(v.rsaKeys, key)
+		case ed25519.PublicKey:
+			v.edKeys = append(v.edKeys, key)
+		default:
+			return nil, fmt.Errorf("public_key must be an RSA or Ed25519 public key")
+		}
+	}
+	if len(v.secrets) == 0 && len(v.rsaKeys) == 0 && len(v.edKeys) == 0 {
+		return nil, fmt.Errorf("secret or public_key is required")
+	}
+
+	algorithms, ok := luaStringList(tbl.RawGetString("algorithms"))
+	if !ok {
+		return nil, fmt.Errorf("algorithms must be a string or an array of strings")
+	}
+	if algorithms == nil {
+		if len(v.secrets) > 0 {
+			algorithms = append(algorithms, "HS256")
+		}
+		if len(v.rsaKeys) > 0 {
+			algorithms = append(algorithms, "RS256")
+		}
+		if len(v.edKeys) > 0 {
+			algorithms = append(algorithms, "EdDSA")
+		}
+	}
+	for _, alg := range algorithms {
+		if alg != "HS256" && alg != "RS256" && alg != "EdDSA" {
+			return nil, fmt.Errorf("unsupported algorithm %q", alg)
+		}
+		v.algorithms[alg] = true
+	}
+
+	v.issuer = lua.LVAsString(tbl.RawGetString("issuer"))
+	if v.audience, ok = luaStringList(tbl.RawGetString("audience")); !ok {
+		return nil, fmt.Errorf("audience must be a string or an array of strings")
+	}
+	if leeway, ok := tbl.RawGetString("leeway").(lua.LNumber); ok {
+		v.leeway = secondsToDuration(leeway)
+	}
+	return v, nil
+}
+
+// parsePEMKey reads the first key in PEM data: a public key, a
+// certificate or a private key.
+func parsePEMKey(data string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func (v *jwtVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if !v.algorithms[header.Alg] {
+		return nil, fmt.Errorf("algorithm %q is not allowed", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	input := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	switch header.Alg {
+	case "HS256":
+		for _, secret := range v.secrets {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(input)
+			if hmac.Equal(sig, mac.Sum(nil)) {
+				verified = true
+				break
+			}
+		}
+	case "RS256":
+		digest := sha256.Sum256(input)
+		for _, key := range v.rsaKeys {
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				verified = true
+				break
+			}
+		}
+	case "EdDSA":
+		for _, key := range v.edKeys {
+			if ed25519.Verify(key, input, sig) {
+				verified = true
+				break
+			}
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil || claims == nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *jwtVerifier) checkClaims(claims map[string]interface{}) error {
+	now := v.clock.Now()
+	numericDate := func(name string) (time.Time, bool, error) {
+		raw, present := claims[name]
+		if !present {
+			return time.Time{}, false, nil
+		}
+		seconds, ok := raw.(float64)
+		if !ok {
+			return time.Time{}, false, fmt.Errorf("%s claim must be a number", name)
+		}
+		if math.Abs(seconds) > maxNumericDate {
+			return time.Time{}, false, fmt.Errorf("%s claim is out of range", name)
+		}
+		sec, frac := math.Modf(seconds)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), true, nil
+	}
+
+	if exp, ok, err := numericDate("exp"); err != nil {
+		return err
+	} else if ok && !now.Before(exp.Add(v.leeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok, err := numericDate("nbf"); err != nil {
+		return err
+	} else if ok && now.Before(nbf.Add(-v.leeway)) {
+		return errors.New("token is not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return errors.New("unexpected issuer")
+	}
+	if len(v.audience) > 0 {
+		var audiences []string
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = []string{aud}
+		case []interface{}:
+			for _, item := range aud {
+				if s, ok := item.(string); ok {
+					audiences = append(audiences, s)
+				}
+			}
+		}
+		for _, want := range v.audience {
+			for _, got := range audiences {
+				if want == got {
+					return nil
+				}
+			}
+		}
+		return errors.New("unexpected audience")
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// signJWT signs claims with a secret (HS256) or a PEM private key, RSA for
+// RS256 and Ed25519 for EdDSA.
+func signJWT(claims interface{}, key string, extra map[string]interface{}) (string, error) {
+	header := map[string]interface{}{"typ": "JWT"}
+	for name, value := range extra {
+		header[name] = value
+	}
+
+	var signer interface{}
+	if strings.Contains(key, "-----BEGIN") {
+		parsed, err := parsePEMKey(key)
+		if err != nil {
+			return "", err
+		}
+		switch parsed.(type) {
+		case *rsa.PrivateKey:
+			header["alg"] = "RS256"
+		case ed25519.PrivateKey:
+			header["alg"] = "EdDSA"
+		default:
+			return "", fmt.Errorf("signing key must be an RSA or Ed25519 private key")
+		}
+		signer = parsed
+	} else {
+		if len(key) < minSecretLength {
+			return "", fmt.Errorf("secret must be at least %d characters", minSecretLength)
+		}
+		header["alg"] = "HS256"
+	}
+
+	encode := func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(data), nil
+	}
+	h, err := encode(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := encode(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode claims: %v", err)
+	}
+	input := h + "." + c
+
+	var sig []byte
+	switch k := signer.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(input))
+	default:
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (vm *SolVM) registerJWT() {
+	verifiers := &jwtVerifierCache{}
+	vm.RegisterTable("jwt", map[string]lua.LGFunction{
+		// sign(claims, key, [options]) returns a token. expires_in adds an
+		// exp claim that many seconds from now, and header adds header
+		// fields such as kid.
+		"sign": func(L *lua.LState) int {
+			claims, _ := convertToGoValue(L.CheckTable(1)).(map[string]interface{})
+			if claims == nil {
+				claims = make(map[string]interface{})
+			}
+			opts := L.OptTable(3, L.NewTable())
+			now := vm.clock.Now()
+			if _, ok := claims["iat"]; !ok {
+				claims["iat"] = now.Unix()
+			}
+			if v, ok := opts.RawGetString("expires_in").(lua.LNumber); ok {
+				claims["exp"] = now.Add(secondsToDuration(v)).Unix()
+			}
+			extra, _ := convertToGoValue(opts.RawGetString("header")).(map[string]interface{})
+
+			token, err := signJWT(claims, L.CheckString(2), extra)
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LString(token))
+			return 1
+		},
+		"verify": func(L *lua.LState) int {
+			token := L.CheckString(1)
+			verifier, err := verifiers.get(vm.clock, L.CheckTable(2))
+			if err != nil {
+				L.ArgError(2, err.Error())
+			}
+			claims, err := verifier.verify(token)
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(convertToLuaValue(L, claims))
+			return 1
+		},
+	})
+}
+
+// jwtMiddleware requires a valid bearer token, from the Authorization
+// header or the cookie named by the cookie option, and exposes its claims
+// as req.claims. With optional, requests without a token pass through.
+func (sm *ServerModule) jwtMiddleware(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	verifier, err := newJWTVerifier(sm.vm.clock, tbl)
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	cookie := lua.LVAsString(tbl.RawGetString("cookie"))
+	optional := lua.LVAsBool(tbl.RawGetString("optional"))
+
+	L.Push(middlewareValue(L, "jwt", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := ""
+			if scheme, value, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(value)
+			} else if cookie != "" {
+				if c, err := r.Cookie(cookie); err == nil {
+					token = c.Value
+				}
+			}
+
+			if token == "" {
+				if optional {
+					next.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			claims, err := verifier.verify(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error()))
+				writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			setRequestField(r, "claims", claims)
+			next.ServeHTTP(w, r)
+		})
+	}))
+	return 1
+}
@@ -0,0 +1,211 @@
+package vm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const testJWTSecret = "0123456789abcdef"
+
+// jwtOptions builds a jwt.verify options table from name/value pairs.
+func jwtOptions(L *lua.LState, pairs ...interface{}) *lua.LTable {
+	tbl := L.NewTable()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		var value lua.LValue
+		switch v := pairs[i+1].(type) {
+		case string:
+			value = lua.LString(v)
+		case float64:
+			value = lua.LNumber(v)
+		case []string:
+			list := L.NewTable()
+			for _, s := range v {
+				list.Append(lua.LString(s))
+			}
+			value = list
+		}
+		tbl.RawSetString(pairs[i].(string), value)
+	}
+	return tbl
+}
+
+func mustSignJWT(t *testing.T, claims map[string]interface{}, key string, header map[string]interface{}) string {
+	t.Helper()
+	token, err := signJWT(claims, key, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	clock := NewFakeClock(time.Now())
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	privDER, _ := x509.MarshalPKCS8PrivateKey(priv)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+	privPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}))
+	pubPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+
+	hmacVerifier, err := newJWTVerifier(clock, jwtOptions(L, "secret", testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edVerifier, err := newJWTVerifier(clock, jwtOptions(L, "public_key", pubPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]interface{}{"sub": "alice"}
+	hsToken := mustSignJWT(t, claims, testJWTSecret, nil)
+	edToken := mustSignJWT(t, claims, privPEM, nil)
+
+	if got, err := hmacVerifier.verify(hsToken); err != nil || got["sub"] != "alice" {
+		t.Fatalf("HS256: %v %v", got, err)
+	}
+	if _, err := edVerifier.verify(edToken); err != nil {
+		t.Fatalf("EdDSA: %v", err)
+	}
+	if _, err := hmacVerifier.verify(edToken); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("EdDSA token against a secret: %v", err)
+	}
+	if _, err := edVerifier.verify(hsToken); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("HS256 token against a public key: %v", err)
+	}
+
+	// An unsigned token, or one whose header claims another algorithm,
+	// must not get through.
+	parts := strings.Split(hsToken, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	if _, err := hmacVerifier.verify(none); err == nil {
+		t.Fatal("alg none was accepted")
+	}
+	if _, err := hmacVerifier.verify(parts[0] + "." + parts[1] + ".AAAA"); err == nil {
+		t.Fatal("bad signature was accepted")
+	}
+	if _, err := hmacVerifier.verify(mustSignJWT(t, claims, testJWTSecret+"x", nil)); err == nil {
+		t.Fatal("token signed with another secret was accepted")
+	}
+
+	narrowed, err := newJWTVerifier(clock, jwtOptions(L, "secret", testJWTSecret, "algorithms", []string{"RS256"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := narrowed.verify(hsToken); err == nil {
+		t.Fatal("HS256 token accepted although only RS256 is allowed")
+	}
+
+	for _, secret := range []string{"", "short"} {
+		if _, err := newJWTVerifier(clock, jwtOptions(L, "secret", secret)); err == nil {
+			t.Fatalf("secret %q was accepted", secret)
+		}
+		if _, err := signJWT(claims, secret, nil); err == nil {
+			t.Fatalf("signing with secret %q succeeded", secret)
+		}
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	clock := NewFakeClock(time.Unix(1_700_000_000, 0))
+	now := float64(clock.Now().Unix())
+
+	v, err := newJWTVerifier(clock, jwtOptions(L,
+		"secret", testJWTSecret,
+		"issuer", "auth",
+		"audience", []string{"api", "admin"},
+		"leeway", 5.0,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]interface{}{"iss": "auth", "aud": "api"}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[name] = value
+		return claims
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		err    string
+	}{
+		{"valid", valid, ""},
+		{"expired", with("exp", now-10), "expired"},
+		{"expired within leeway", with("exp", now-3), ""},
+		{"not expired", with("exp", now+60), ""},
+		{"fractional exp", with("exp", now-4.5), ""},
+		{"huge exp", with("exp", 1e300), "out of range"},
+		{"huge negative nbf", with("nbf", -1e300), "out of range"},
+		{"not valid yet", with("nbf", now+10), "not valid yet"},
+		{"nbf within leeway", with("nbf", now+3), ""},
+		{"exp not a number", with("exp", "soon"), "must be a number"},
+		{"wrong issuer", with("iss", "other"), "issuer"},
+		{"wrong audience", with("aud", "web"), "audience"},
+		{"audience list", with("aud", []interface{}{"web", "admin"}), ""},
+		{"missing audience", map[string]interface{}{"iss": "auth"}, "audience"},
+	}
+	for _, tt := range tests {
+		_, err := v.verify(mustSignJWT(t, tt.claims, testJWTSecret, nil))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+
+	token := mustSignJWT(t, with("exp", now+60), testJWTSecret, nil)
+	clock.Advance(64 * time.Second)
+	if _, err := v.verify(token); err != nil {
+		t.Fatalf("token rejected within leeway: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := v.verify(token); err == nil {
+		t.Fatal("token accepted after expiring")
+	}
+}
+
+func TestJWTVerifierCache(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	cache := &jwtVerifierCache{}
+	clock := realClock{}
+
+	first, err := cache.get(clock, jwtOptions(L, "secret", testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A copy of the same options, as an isolated handler would see.
+	second, _ := cache.get(clock, jwtOptions(L, "secret", testJWTSecret))
+	if first != second {
+		t.Fatal("equal options built a second verifier")
+	}
+	other, _ := cache.get(clock, jwtOptions(L, "secret", testJWTSecret, "issuer", "auth"))
+	if other == first {
+		t.Fatal("different options shared a verifier")
+	}
+	listed, _ := cache.get(clock, jwtOptions(L, "secret", []string{testJWTSecret}))
+	if listed == first {
+		t.Fatal("a list of secrets shared a verifier with a single secret")
+	}
+	if _, err := cache.get(clock, jwtOptions(L, "secret", "short")); err == nil {
+		t.Fatal("invalid options were accepted")
+	}
+}
@@ -0,0 +1,426 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Middleware is the Go form of a server middleware, the usual net/http
+// decorator. Lua middleware is adapted to it, so native and Lua middleware
+// share one chain and run in the order they were registered.
+type Middleware func(next http.Handler) http.Handler
+
+func chainHandler(chain []Middleware, final http.Handler) http.Handler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		final = chain[i](final)
+	}
+	return final
+}
+
+// Use adds native middleware to every request of a server, after the
+// middleware already registered on it.
+func (sm *ServerModule) Use(serverID string, middleware ...Middleware) error {
+	sm.mu.RLock()
+	srv, exists := sm.servers[serverID]
+	sm.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("Server %s does not exist", serverID)
+	}
+	srv.root.mu.Lock()
+	srv.root.middleware = append(srv.root.middleware, middleware...)
+	srv.root.mu.Unlock()
+	return nil
+}
+
+type requestStateKey struct{}
+
+// requestState travels with a request through the middleware chain. It
+// carries the route parameters once the router has matched, values that
+// native middleware exposes to Lua as req.context, and the Lua state of the
+// request once a Lua middleware or handler has started.
+type requestState struct {
+	srv     *httpServer
+	mu      sync.Mutex
+	params  []routeParam
+	version int
+	values  map[string]interface{}
+	fields  map[string]interface{}
+	session *requestSession
+	pages   map[int]errorPage
+	lua     *luaRequest
+	uploads []io.Closer
+}
+
+func ensureRequestState(r *http.Request, srv *httpServer) (*http.Request, *requestState) {
+	if state, ok := r.Context().Value(requestStateKey{}).(*requestState); ok {
+		return r, state
+	}
+	state := &requestState{srv: srv, values: make(map[string]interface{}), fields: make(map[string]interface{})}
+	return r.WithContext(context.WithValue(r.Context(), requestStateKey{}, state)), state
+}
+
+// trackUpload remembers an opened upload so cleanupRequest can close it if
+// the handler stops reading part way.
+func (s *requestState) trackUpload(c io.Closer) {
+	s.mu.Lock()
+	s.uploads = append(s.uploads, c)
+	s.mu.Unlock()
+}
+
+func requestStateOf(r *http.Request) *requestState {
+	state, _ := r.Context().Value(requestStateKey{}).(*requestState)
+	return state
+}
+
+func (s *requestState) setParams(params []routeParam) {
+	s.mu.Lock()
+	s.params = params
+	s.version++
+	s.mu.Unlock()
+}
+
+func (s *requestState) routeParams() []routeParam {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.params
+}
+
+// setRequestValue makes value available to Lua as req.context[key].
+func setRequestValue(r *http.Request, key string, value interface{}) {
+	if state := requestStateOf(r); state != nil {
+		state.mu.Lock()
+		state.values[key] = value
+		state.mu.Unlock()
+	}
+}
+
+// setRequestField sets req[name] for Lua, for values that middleware
+// provides as part of the request itself, such as verified token claims.
+func setRequestField(r *http.Request, name string, value interface{}) {
+	if state := requestStateOf(r); state != nil {
+		state.mu.Lock()
+		state.fields[name] = value
+		state.mu.Unlock()
+	}
+}
+
+func requestValue(r *http.Request, key string) (interface{}, bool) {
+	state := requestStateOf(r)
+	if state == nil {
+		return nil, false
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	value, ok := state.values[key]
+	return value, ok
+}
+
+type errorPage struct {
+	body        []byte
+	contentType string
+}
+
+func errorPageFor(r *http.Request, status int) (errorPage, bool) {
+	state := requestStateOf(r)
+	if state == nil {
+		return errorPage{}, false
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	page, ok := state.pages[status]
+	return page, ok
+}
+
+// errorResponse returns the page set up by the recovery middleware for the
+// status, or a plain text one with message.
+func errorResponse(r *http.Request, message string, status int) errorPage {
+	if page, ok := errorPageFor(r, status); ok {
+		return page
+	}
+	return errorPage{body: []byte(message + "\n"), contentType: "text/plain; charset=utf-8"}
+}
+
+// writeError replaces http.Error for every error the server sends itself,
+// so they all get the custom pages.
+func writeError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	page := errorResponse(r, message, status)
+	h := w.Header()
+	h.Set("Content-Type", page.contentType)
+	h.Set("Content-Length", strconv.Itoa(len(page.body)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(page.body)
+}
+
+// luaRequest is the Lua side of a request: the state every Lua middleware
+// and the handler run on, and the req and res tables they share. rw and r
+// are the writer and request of the stage currently running, since native
+// middleware between two Lua stages may have replaced them.
+type luaRequest struct {
+	L       *lua.LState
+	rw      *responseWriter
+	r       *http.Request
+	req     *lua.LTable
+	res     *lua.LTable
+	version int
+	session bool
+	err     error
+}
+
+func (lr *luaRequest) takeError() error {
+	err := lr.err
+	lr.err = nil
+	return err
+}
+
+// withLua runs f on the request's Lua state. The first Lua stage of a
+// request takes a state from RunCallbacks, builds req and res, and sends
+// whatever response is pending when it returns; later stages, reached
+// through next(), reuse them. detach keeps the state running after the
+// client disconnects, for handlers that own the connection.
+func (sm *ServerModule) withLua(w http.ResponseWriter, r *http.Request, mode string, detach bool, f func(lr *luaRequest) error) {
+	r, state := ensureRequestState(r, nil)
+	if lr := state.lua; lr != nil {
+		sm.nestedLua(lr, state, w, r, detach, f)
+		return
+	}
+
+	rw := newResponseWriter(w)
+	defer cleanupRequest(r)
+	defer func() {
+		if err := recover(); err != nil {
+			sm.vm.monitor.handleError(fmt.Errorf("HTTP handler panic: %v", err))
+			if !rw.started() {
+				rw.discard()
+				writeError(rw, r, "Internal Server Error", http.StatusInternalServerError)
+			}
+		}
+	}()
+
+	ctx := r.Context()
+	if detach {
+		ctx = context.WithoutCancel(ctx)
+	}
+	err := sm.vm.RunCallbacks(ctx, mode, func(L *lua.LState) error {
+		lr := &luaRequest{L: L, rw: rw, r: r}
+		req, err := sm.requestTable(L, rw, r, state)
+		if err != nil {
+			return err
+		}
+		lr.req = req
+		lr.res = sm.responseTable(L, lr)
+		lr.version = -1
+		sm.syncRequest(lr, state)
+
+		state.lua = lr
+		defer func() {
+			state.syncSession()
+			state.lua = nil
+		}()
+		return f(lr)
+	})
+	sm.finishLua(rw, r, err)
+}
+
+func (sm *ServerModule) nestedLua(lr *luaRequest, state *requestState, w http.ResponseWriter, r *http.Request, detach bool, f func(lr *luaRequest) error) {
+	prevRW, prevR := lr.rw, lr.r
+	if rw, ok := w.(*responseWriter); !ok || rw != lr.rw {
+		lr.rw = newResponseWriter(w)
+	}
+	lr.r = r
+	defer func() { lr.rw, lr.r = prevRW, prevR }()
+
+	// Native middleware in between may have given the request a shorter
+	// deadline, which the Lua state must follow for this stage.
+	if prev := lr.L.Context(); prev != nil {
+		ctx := r.Context()
+		if detach {
+			ctx = context.WithoutCancel(ctx)
+		}
+		lr.L.SetContext(ctx)
+		defer lr.L.SetContext(prev)
+	}
+	sm.syncRequest(lr, state)
+
+	err := f(lr)
+	if lr.rw != prevRW && err == nil {
+		lr.rw.commit()
+	}
+	lr.err = err
+}
+
+// syncRequest brings req up to date with what native middleware and the
+// router have added since it was built.
+func (sm *ServerModule) syncRequest(lr *luaRequest, state *requestState) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if lr.version != state.version {
+		lr.req.RawSetString("params", paramsTable(lr.L, state.params))
+		lr.version = state.version
+	}
+	if ctx, ok := lr.req.RawGetString("context").(*lua.LTable); ok {
+		for key, value := range state.values {
+			ctx.RawSetString(key, convertToLuaValue(lr.L, value))
+		}
+	}
+	for name, value := range state.fields {
+		lr.req.RawSetString(name, convertToLuaValue(lr.L, value))
+	}
+	if state.session != nil && !lr.session {
+		lr.req.RawSetString("session", convertToLuaValue(lr.L, state.session.values))
+		lr.session = true
+	}
+}
+
+// finishLua sends the pending response of the first Lua stage, or an error
+// page if the handler failed before anything was sent.
+func (sm *ServerModule) finishLua(rw *responseWriter, r *http.Request, err error) {
+	if err == nil {
+		rw.commit()
+		return
+	}
+	if herr, ok := isHTTPError(err); ok {
+		if !rw.started() {
+			rw.discard()
+			writeError(rw, r, herr.message, herr.status)
+		}
+		return
+	}
+	if r.Context().Err() != nil {
+		// The client went away; there is nobody to answer.
+		return
+	}
+	sm.vm.monitor.handleError(err)
+	if !rw.started() {
+		rw.discard()
+		writeError(rw, r, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// luaMiddleware adapts a Lua function to Middleware. Pipeline middleware is
+// called as (req, res, next) and decides whether and when the rest of the
+// chain runs. Otherwise the function is one of the original before-hooks:
+// called with (req, res), it rejects the request with 401 by returning
+// false, answers it by returning a table or sending a response, and
+// otherwise lets it through.
+func (sm *ServerModule) luaMiddleware(cb *Callback, pipeline bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sm.withLua(w, r, cb.Mode(), false, func(lr *luaRequest) error {
+				called := false
+				args := []lua.LValue{lr.req, lr.res}
+				if pipeline {
+					args = append(args, lr.L.NewFunction(func(L *lua.LState) int {
+						if called {
+							L.RaiseError("next called more than once")
+						}
+						called = true
+						next.ServeHTTP(lr.rw, lr.r)
+						if err := lr.takeError(); err != nil {
+							L.RaiseError("%s", err.Error())
+						}
+						return 0
+					}))
+				}
+
+				results, err := cb.CallOn(lr.L, 1, args...)
+				if err != nil {
+					return fmt.Errorf("Middleware error: %v", err)
+				}
+				if called || lr.rw.responded() {
+					return nil
+				}
+				switch result := results[0].(type) {
+				case lua.LBool:
+					if !result {
+						lr.rw.setError(lr.r, "Unauthorized", http.StatusUnauthorized)
+						return nil
+					}
+				case *lua.LTable:
+					return applyTableResponse(lr.rw, result)
+				}
+				if pipeline {
+					return nil
+				}
+				next.ServeHTTP(lr.rw, lr.r)
+				return lr.takeError()
+			})
+		})
+	}
+}
+
+// middlewareArg reads the middleware at n, with its options at n+1, for a
+// route group or path of srv. A Lua function is a before-hook unless the
+// options set pipeline = true.
+func (sm *ServerModule) middlewareArg(L *lua.LState, n int, srv *httpServer) Middleware {
+	switch v := L.Get(n).(type) {
+	case *lua.LFunction:
+		opts := L.OptTable(n+1, L.NewTable())
+		pipeline := lua.LVAsBool(opts.RawGetString("pipeline"))
+		return sm.luaMiddleware(sm.vm.NewCallback(L, v, nil, ""), pipeline)
+	case *lua.LUserData:
+		switch middleware := v.Value.(type) {
+		case Middleware:
+			return middleware
+		case *closingMiddleware:
+			middleware.acquire()
+			srv.onStop(middleware.release)
+			return middleware.Middleware
+		}
+	}
+	L.ArgError(n, "middleware must be a function or a native middleware")
+	return nil
+}
+
+// closingMiddleware is native middleware holding a resource, such as a log
+// file, that is closed once every server it was added to has stopped.
+type closingMiddleware struct {
+	Middleware
+	mu    sync.Mutex
+	users int
+	close func() error
+}
+
+func (m *closingMiddleware) acquire() {
+	m.mu.Lock()
+	m.users++
+	m.mu.Unlock()
+}
+
+func (m *closingMiddleware) release() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.users--; m.users > 0 {
+		return nil
+	}
+	return m.close()
+}
+
+// middlewareValue wraps native middleware for Lua, to be passed to use.
+func middlewareValue(L *lua.LState, name string, middleware Middleware) *lua.LUserData {
+	return nativeMiddleware(L, name, middleware)
+}
+
+// closingMiddlewareValue is middlewareValue for middleware that holds a
+// resource, which close releases when the last server using it stops.
+func closingMiddlewareValue(L *lua.LState, name string, middleware Middleware, close func() error) *lua.LUserData {
+	return nativeMiddleware(L, name, &closingMiddleware{Middleware: middleware, close: close})
+}
+
+func nativeMiddleware(L *lua.LState, name string, value interface{}) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = value
+	meta := L.NewTable()
+	meta.RawSetString("__tostring", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString("middleware: " + name))
+		return 1
+	}))
+	L.SetMetatable(ud, meta)
+	return ud
+}
@@ -0,0 +1,616 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	cassetteAuto   = "auto"
+	cassetteRecord = "record"
+	cassetteReplay = "replay"
+
+	maxRecordedBody   = 1 << 20
+	maxLoggedRequests = 1000
+)
+
+type recordedMessage struct {
+	Method     string              `json:"method,omitempty"`
+	URL        string              `json:"url,omitempty"`
+	Status     int                 `json:"status,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	BodyBase64 string              `json:"body_base64,omitempty"`
+}
+
+type interaction struct {
+	Request  recordedMessage `json:"request"`
+	Response recordedMessage `json:"response"`
+}
+
+type cassette struct {
+	Interactions []*interaction `json:"interactions"`
+}
+
+type httpStub struct {
+	id      int
+	method  string
+	pattern *regexp.Regexp
+	status  int
+	headers http.Header
+	body    []byte
+	err     string
+	times   int
+	calls   int
+}
+
+// HTTPMock sits underneath every HTTP client in the VM. With nothing
+// configured it passes requests straight through; otherwise it answers them
+// from stubs or a cassette file, records real exchanges, and keeps a log of
+// the most recent requests so tests can assert on them.
+type HTTPMock struct {
+	mu           sync.Mutex
+	stubs        []*httpStub
+	nextStub     int
+	requests     []recordedMessage
+	cassettePath string
+	mode         string
+	cassette     *cassette
+	// cassetteEnd is where the closing brackets of a cassette being recorded
+	// start, so each interaction is appended in place.
+	cassetteEnd  int64
+	played       map[string]int
+	blockNetwork bool
+	logRequests  bool
+}
+
+func NewHTTPMock() *HTTPMock {
+	return &HTTPMock{played: make(map[string]int)}
+}
+
+func (m *HTTPMock) Wrap(base http.RoundTripper) http.RoundTripper {
+	return &mockTransport{mock: m, base: base}
+}
+
+// UseCassette records to or replays from path. In auto mode the cassette is
+// replayed if the file exists and recorded otherwise.
+func (m *HTTPMock) UseCassette(path, mode string) error {
+	if mode == "" {
+		mode = cassetteAuto
+	}
+	if mode == cassetteAuto {
+		mode = cassetteRecord
+		if _, err := os.Stat(path); err == nil {
+			mode = cassetteReplay
+		}
+	}
+
+	c := &cassette{}
+	switch mode {
+	case cassetteReplay:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read cassette: %w", err)
+		}
+		if err := json.Unmarshal(data, c); err != nil {
+			return fmt.Errorf("failed to parse cassette: %w", err)
+		}
+	case cassetteRecord:
+	default:
+		return fmt.Errorf("invalid cassette mode %q", mode)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cassettePath = path
+	m.mode = mode
+	m.cassette = c
+	m.cassetteEnd = 0
+	m.played = make(map[string]int)
+	return nil
+}
+
+func (m *HTTPMock) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stubs = nil
+	m.requests = nil
+	m.cassettePath = ""
+	m.mode = ""
+	m.cassette = nil
+	m.cassetteEnd = 0
+	m.played = make(map[string]int)
+	m.blockNetwork = false
+	m.logRequests = false
+}
+
+// active reports whether the mock has anything to do. Callers hold m.mu.
+func (m *HTTPMock) active() bool {
+	return len(m.stubs) > 0 || m.cassette != nil || m.blockNetwork || m.logRequests
+}
+
+type mockTransport struct {
+	mock *HTTPMock
+	base http.RoundTripper
+}
+
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := t.mock
+	m.mu.Lock()
+	active := m.active()
+	m.mu.Unlock()
+	if !active {
+		return t.base.RoundTrip(req)
+	}
+
+	logged, err := captureRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if len(m.requests) >= maxLoggedRequests {
+		m.requests = append(m.requests[:0], m.requests[len(m.requests)-maxLoggedRequests+1:]...)
+	}
+	m.requests = append(m.requests, logged)
+	stub := m.matchStub(req)
+	var replayed *interaction
+	if stub == nil && m.mode == cassetteReplay {
+		replayed = m.nextInteraction(req)
+	}
+	mode := m.mode
+	blocked := m.blockNetwork
+	m.mu.Unlock()
+
+	switch {
+	case stub != nil:
+		if stub.err != "" {
+			return nil, fmt.Errorf("%s", stub.err)
+		}
+		return newMockResponse(req, stub.status, stub.headers, stub.body), nil
+	case replayed != nil:
+		body, err := replayed.Response.body()
+		if err != nil {
+			return nil, err
+		}
+		return newMockResponse(req, replayed.Response.Status, http.Header(replayed.Response.Headers), body), nil
+	case mode == cassetteReplay:
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL)
+	case blocked:
+		return nil, fmt.Errorf("network access is disabled: no stub for %s %s", req.Method, req.URL)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || mode != cassetteRecord {
+		return resp, err
+	}
+
+	// Bodies too large to buffer are passed on unrecorded, so replaying
+	// them fails instead of serving a truncated copy.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRecordedBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > maxRecordedBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	recorded := recordedMessage{Status: resp.StatusCode, Headers: resp.Header.Clone()}
+	recorded.setBody(body)
+	if err := m.record(&interaction{Request: logged, Response: recorded}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// captureRequest copies the request for the log. Bodies that cannot be
+// read again, or that are streamed without a known length such as
+// multipart uploads, are left out rather than buffered.
+func captureRequest(req *http.Request) (recordedMessage, error) {
+	logged := recordedMessage{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Headers: req.Header.Clone(),
+	}
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody == nil || req.ContentLength < 0 {
+		return logged, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return logged, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, maxRecordedBody))
+	if err != nil {
+		return logged, err
+	}
+	logged.setBody(data)
+	return logged, nil
+}
+
+func (msg *recordedMessage) setBody(data []byte) {
+	if utf8.Valid(data) {
+		msg.Body = string(data)
+	} else {
+		msg.BodyBase64 = base64.StdEncoding.EncodeToString(data)
+	}
+}
+
+func (msg *recordedMessage) body() ([]byte, error) {
+	if msg.BodyBase64 != "" {
+		return base64.StdEncoding.DecodeString(msg.BodyBase64)
+	}
+	return []byte(msg.Body), nil
+}
+
+func newMockResponse(req *http.Request, status int, headers http.Header, body []byte) *http.Response {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        headers.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func (m *HTTPMock) matchStub(req *http.Request) *httpStub {
+	for i, stub := range m.stubs {
+		if stub.method != "" && stub.method != req.Method {
+			continue
+		}
+		if !stub.pattern.MatchString(req.URL.String()) {
+			continue
+		}
+		stub.calls++
+		if stub.times > 0 && stub.calls >= stub.times {
+			m.stubs = append(m.stubs[:i], m.stubs[i+1:]...)
+		}
+		return stub
+	}
+	return nil
+}
+
+// nextInteraction returns recorded responses for a request in the order they
+// were recorded, repeating the last one once they run out.
+func (m *HTTPMock) nextInteraction(req *http.Request) *interaction {
+	key := req.Method + " " + req.URL.String()
+	redacted := redactURL(req.URL.String())
+
+	var matches []*interaction
+	for _, i := range m.cassette.Interactions {
+		if i.Request.Method == req.Method && i.Request.URL == redacted {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+
+	n := m.played[key]
+	m.played[key] = n + 1
+	if n >= len(matches) {
+		n = len(matches) - 1
+	}
+	return matches[n]
+}
+
+const (
+	cassetteHead = "{\n  \"interactions\": [\n    "
+	cassetteTail = "\n  ]\n}\n"
+)
+
+// record appends an interaction to the cassette file, with credentials
+// redacted. Only the new interaction is encoded: it is written over the
+// closing brackets, which are then written again after it.
+func (m *HTTPMock) record(i *interaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mode != cassetteRecord {
+		return nil
+	}
+	data, err := json.MarshalIndent(redactInteraction(i), "    ", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette: %w", err)
+	}
+
+	flags := os.O_WRONLY
+	var prefix string
+	if m.cassetteEnd == 0 {
+		if err := os.MkdirAll(filepath.Dir(m.cassettePath), 0755); err != nil {
+			return fmt.Errorf("failed to create cassette directory: %w", err)
+		}
+		flags |= os.O_CREATE | os.O_TRUNC
+		prefix = cassetteHead
+	} else {
+		prefix = ",\n    "
+	}
+	f, err := os.OpenFile(m.cassettePath, flags, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	entry := prefix + string(data)
+	if _, err := f.WriteAt([]byte(entry+cassetteTail), m.cassetteEnd); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	m.cassetteEnd += int64(len(entry))
+	return nil
+}
+
+var (
+	redactedRequestHeaders  = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+	redactedResponseHeaders = []string{"Set-Cookie"}
+	redactedQueryParams     = map[string]bool{
+		"access_token": true, "api_key": true, "apikey": true, "auth": true,
+		"client_secret": true, "key": true, "password": true, "secret": true,
+		"sig": true, "signature": true, "token": true,
+	}
+)
+
+// redactInteraction returns a copy of i without credentials. The request
+// log shares i's headers, so they are cloned rather than changed.
+func redactInteraction(i *interaction) *interaction {
+	redacted := *i
+	redacted.Request.URL = redactURL(i.Request.URL)
+	redacted.Request.Headers = redactHeaders(i.Request.Headers, redactedRequestHeaders)
+	redacted.Response.Headers = redactHeaders(i.Response.Headers, redactedResponseHeaders)
+	return &redacted
+}
+
+func redactHeaders(headers map[string][]string, names []string) map[string][]string {
+	headers = http.Header(headers).Clone()
+	for _, name := range names {
+		if _, exists := headers[name]; exists {
+			headers[name] = []string{"REDACTED"}
+		}
+	}
+	return headers
+}
+
+// redactURL hides the password of the URL and query parameters that
+// usually carry credentials. Replays match requests by their redacted URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	changed := false
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		changed = true
+	}
+	query, secret := u.Query(), false
+	for name := range query {
+		if redactedQueryParams[strings.ToLower(name)] {
+			query[name] = []string{"REDACTED"}
+			secret = true
+		}
+	}
+	if secret {
+		u.RawQuery = query.Encode()
+		changed = true
+	}
+	if !changed {
+		return raw
+	}
+	return u.String()
+}
+
+func globPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, "~") {
+		return regexp.Compile(pattern[1:])
+	}
+	quoted := regexp.QuoteMeta(pattern)
+	return regexp.Compile("^" + strings.ReplaceAll(quoted, `\*`, ".*") + "$")
+}
+
+func (hm *HTTPModule) mockFunctions() map[string]lua.LGFunction {
+	m := hm.vm.httpMock
+	return map[string]lua.LGFunction{
+		"cassette": func(L *lua.LState) int {
+			path := L.CheckString(1)
+			mode := L.OptString(2, cassetteAuto)
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(hm.vm.workingDir, path)
+			}
+			if err := m.UseCassette(path, mode); err != nil {
+				L.RaiseError("%v", err)
+			}
+			m.mu.Lock()
+			L.Push(lua.LString(m.mode))
+			m.mu.Unlock()
+			return 1
+		},
+		"stub": func(L *lua.LState) int {
+			opts := L.CheckTable(1)
+			pattern, err := globPattern(lua.LVAsString(opts.RawGetString("url")))
+			if err != nil {
+				L.ArgError(1, fmt.Sprintf("invalid url pattern: %v", err))
+			}
+
+			stub := &httpStub{
+				method:  strings.ToUpper(lua.LVAsString(opts.RawGetString("method"))),
+				pattern: pattern,
+				status:  int(lua.LVAsNumber(opts.RawGetString("status"))),
+				headers: make(http.Header),
+				err:     lua.LVAsString(opts.RawGetString("error")),
+				times:   int(lua.LVAsNumber(opts.RawGetString("times"))),
+			}
+			if v, ok := opts.RawGetString("headers").(*lua.LTable); ok {
+				eachValue(v, func(key, value string) {
+					stub.headers.Add(key, value)
+				})
+			}
+			if v := opts.RawGetString("json"); v != lua.LNil {
+				data, err := json.Marshal(convertToGoValue(v))
+				if err != nil {
+					L.ArgError(1, fmt.Sprintf("failed to encode json: %v", err))
+				}
+				stub.body = data
+				if stub.headers.Get("Content-Type") == "" {
+					stub.headers.Set("Content-Type", "application/json")
+				}
+			} else {
+				stub.body = []byte(lua.LVAsString(opts.RawGetString("body")))
+			}
+
+			m.mu.Lock()
+			m.nextStub++
+			stub.id = m.nextStub
+			m.stubs = append(m.stubs, stub)
+			// Keep logging once the stub is used up or removed, so
+			// assert_called still sees every request.
+			m.logRequests = true
+			m.mu.Unlock()
+
+			L.Push(lua.LNumber(stub.id))
+			return 1
+		},
+		"unstub": func(L *lua.LState) int {
+			id := L.CheckInt(1)
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			for i, stub := range m.stubs {
+				if stub.id == id {
+					m.stubs = append(m.stubs[:i], m.stubs[i+1:]...)
+					L.Push(lua.LTrue)
+					return 1
+				}
+			}
+			L.Push(lua.LFalse)
+			return 1
+		},
+		"network": func(L *lua.LState) int {
+			allowed := L.CheckBool(1)
+			m.mu.Lock()
+			m.blockNetwork = !allowed
+			m.mu.Unlock()
+			return 0
+		},
+		// record turns the request log on or off when no stub, cassette or
+		// network block already keeps it.
+		"record": func(L *lua.LState) int {
+			enabled := L.OptBool(1, true)
+			m.mu.Lock()
+			m.logRequests = enabled
+			m.mu.Unlock()
+			return 0
+		},
+		"requests": func(L *lua.LState) int {
+			L.Push(requestsTable(L, m.filterRequests(L, 1)))
+			return 1
+		},
+		"assert_called": func(L *lua.LState) int {
+			matched := m.filterRequests(L, 1)
+			opts := L.OptTable(1, L.NewTable())
+			desc := strings.TrimSpace(lua.LVAsString(opts.RawGetString("method")) + " " + lua.LVAsString(opts.RawGetString("url")))
+
+			if times, ok := opts.RawGetString("times").(lua.LNumber); ok {
+				if len(matched) != int(times) {
+					L.RaiseError("expected %d request(s) matching %s, got %d", int(times), desc, len(matched))
+				}
+			} else if len(matched) == 0 {
+				L.RaiseError("expected a request matching %s, got none", desc)
+			}
+			return 0
+		},
+		"reset": func(L *lua.LState) int {
+			m.Reset()
+			return 0
+		},
+	}
+}
+
+func (m *HTTPMock) filterRequests(L *lua.LState, idx int) []recordedMessage {
+	opts := L.OptTable(idx, L.NewTable())
+	method := strings.ToUpper(lua.LVAsString(opts.RawGetString("method")))
+
+	var pattern *regexp.Regexp
+	if url := lua.LVAsString(opts.RawGetString("url")); url != "" {
+		var err error
+		if pattern, err = globPattern(url); err != nil {
+			L.ArgError(idx, fmt.Sprintf("invalid url pattern: %v", err))
+		}
+	}
+	body, hasBody := opts.RawGetString("body").(lua.LString)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matched []recordedMessage
+	for _, req := range m.requests {
+		if method != "" && req.Method != method {
+			continue
+		}
+		if pattern != nil && !pattern.MatchString(req.URL) {
+			continue
+		}
+		if hasBody && req.Body != string(body) {
+			continue
+		}
+		matched = append(matched, req)
+	}
+	return matched
+}
+
+func requestsTable(L *lua.LState, requests []recordedMessage) *lua.LTable {
+	result := L.NewTable()
+	for _, req := range requests {
+		tbl := L.NewTable()
+		tbl.RawSetString("method", lua.LString(req.Method))
+		tbl.RawSetString("url", lua.LString(req.URL))
+		tbl.RawSetString("body", lua.LString(req.Body))
+		headers := L.NewTable()
+		for key, values := range req.Headers {
+			list := L.NewTable()
+			for _, value := range values {
+				list.Append(lua.LString(value))
+			}
+			headers.RawSetString(key, list)
+		}
+		tbl.RawSetString("headers", headers)
+		result.Append(tbl)
+	}
+	return result
+}
+
+func (vm *SolVM) HTTPMock() *HTTPMock {
+	return vm.httpMock
+}
@@ -0,0 +1,198 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPMockStubs(t *testing.T) {
+	v := newTestVM(t, Config{})
+	runLua(t, v, `
+		http.mock.network(false)
+		local id = http.mock.stub{ method = "GET", url = "https://api.example.com/users/*", json = { name = "Ada" } }
+		http.mock.stub{ url = "https://api.example.com/once", status = 204, times = 1 }
+
+		local resp = http.request{ url = "https://api.example.com/users/1" }
+		assert(resp.status == 200, "status " .. tostring(resp.status))
+		assert(json_decode(resp.body).name == "Ada")
+		assert(resp.headers["Content-Type"][1] == "application/json")
+
+		assert(http.request{ url = "https://api.example.com/once" }.status == 204)
+		local _, err = http.request{ url = "https://api.example.com/once" }
+		assert(err and err:find("network access is disabled"), tostring(err))
+
+		http.mock.assert_called{ method = "GET", url = "*/users/*", times = 1 }
+		assert(http.mock.unstub(id))
+		local _, err = http.request{ url = "https://api.example.com/users/1" }
+		assert(err, "request after unstub should fail")
+		assert(#http.mock.requests() == 4)
+	`)
+}
+
+func TestHTTPMockPassThroughIsNotLogged(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	v := newTestVM(t, Config{})
+	runLua(t, v, fmt.Sprintf(`
+		local url = %q
+		for i = 1, 5 do
+			assert(http.request{ url = url, method = "POST", body = "secret" }.body == "ok")
+		end
+		assert(#http.mock.requests() == 0, "unmocked requests were logged")
+
+		http.mock.record()
+		http.request{ url = url, method = "POST", body = "logged" }
+		local logged = http.mock.requests()
+		assert(#logged == 1 and logged[1].body == "logged")
+	`, srv.URL))
+}
+
+func TestHTTPMockLogsAfterStubIsUsedUp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	v := newTestVM(t, Config{})
+	runLua(t, v, fmt.Sprintf(`
+		local url = %q
+		http.mock.stub{ url = url .. "/once", status = 201, times = 1 }
+		assert(http.request(url .. "/once").status == 201)
+		assert(http.request(url .. "/once").status == 200)
+		http.mock.assert_called{ url = "*/once", times = 2 }
+
+		http.mock.reset()
+		http.request(url .. "/once")
+		assert(#http.mock.requests() == 0, "requests logged after reset")
+	`, srv.URL))
+}
+
+func TestHTTPMockLogIsCapped(t *testing.T) {
+	m := NewHTTPMock()
+	m.logRequests = true
+	transport := m.Wrap(http.DefaultTransport)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	for i := 0; i < maxLoggedRequests+10; i++ {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%d", srv.URL, i), nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(m.requests) != maxLoggedRequests {
+		t.Fatalf("log holds %d requests, want %d", len(m.requests), maxLoggedRequests)
+	}
+	if last := m.requests[len(m.requests)-1].URL; !strings.HasSuffix(last, fmt.Sprintf("/%d", maxLoggedRequests+9)) {
+		t.Fatalf("newest request missing, last is %s", last)
+	}
+}
+
+func TestHTTPMockKeepsStreamedBodies(t *testing.T) {
+	m := NewHTTPMock()
+	m.logRequests = true
+	var received string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received = string(data)
+	}))
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("streamed"))
+		pw.Close()
+	}()
+	req, _ := http.NewRequest("POST", srv.URL, pr)
+	resp, err := m.Wrap(http.DefaultTransport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if received != "streamed" {
+		t.Fatalf("server received %q", received)
+	}
+	if m.requests[0].Body != "" {
+		t.Fatalf("streamed body was buffered into the log")
+	}
+}
+
+func TestHTTPMockCassetteRedactsCredentials(t *testing.T) {
+	large := strings.Repeat("x", maxRecordedBody+10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			io.WriteString(w, large)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "cookie-secret"})
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	m := NewHTTPMock()
+	if err := m.UseCassette(path, cassetteRecord); err != nil {
+		t.Fatal(err)
+	}
+	get := func(m *HTTPMock, path string) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer header-secret")
+		resp, err := m.Wrap(http.DefaultTransport).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	for _, p := range []string{"/a?token=query-secret&page=2", "/b", "/large"} {
+		get(m, p)
+	}
+	if body := get(m, "/large"); body != large {
+		t.Fatalf("large body passed on with %d bytes", len(body))
+	}
+
+	if got := m.requests[0].Headers["Authorization"][0]; got != "Bearer header-secret" {
+		t.Fatalf("redaction changed the request log: %q", got)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("cassette mode %v, want 0600", mode)
+	}
+	data, _ := os.ReadFile(path)
+	for _, secret := range []string{"header-secret", "cookie-secret", "query-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("cassette contains %q:\n%s", secret, data)
+		}
+	}
+	var c cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatalf("cassette is not valid JSON: %v\n%s", err, data)
+	}
+	if len(c.Interactions) != 2 {
+		t.Fatalf("cassette has %d interactions, want 2 without the large one", len(c.Interactions))
+	}
+
+	replay := NewHTTPMock()
+	if err := replay.UseCassette(path, cassetteReplay); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(replay, "/a?token=query-secret&page=2"); body != "hello /a" {
+		t.Fatalf("replayed %q", body)
+	}
+}
@@ -6,12 +6,18 @@ import (
 	lua "github.com/yuin/gopher-lua"
 )
 
-func RegisterDatetimeModule(L *lua.LState) {
+type Clock interface {
+	Now() time.Time
+}
+
+// RegisterDatetimeModule registers the datetime table. sleep blocks the
+// calling state, so the VM can keep serving callbacks while it waits.
+func RegisterDatetimeModule(L *lua.LState, clock Clock, sleep func(L *lua.LState, d time.Duration)) {
 	datetimeModule := L.NewTable()
 	L.SetGlobal("datetime", datetimeModule)
 
 	L.SetField(datetimeModule, "now", L.NewFunction(func(L *lua.LState) int {
-		now := time.Now()
+		now := clock.Now()
 		L.Push(lua.LNumber(now.Unix()))
 		return 1
 	}))
@@ -66,7 +72,7 @@ func RegisterDatetimeModule(L *lua.LState) {
 			L.RaiseError("invalid duration: " + err.Error())
 			return 0
 		}
-		time.Sleep(d)
+		sleep(L, d)
 		return 0
 	}))
 }
@@ -1,59 +1,139 @@
 package modules
 
 import (
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
-func RegisterFTModule(L *lua.LState) {
+type DownloadResult struct {
+	Path    string
+	Bytes   int64
+	Total   int64
+	Status  int
+	Resumed bool
+}
+
+// DownloadToFile streams the response to req into path. With resume set and
+// a partial file already on disk, it asks the server for the remaining bytes
+// with a Range header and appends them. progress, when given, is called after
+// every chunk with the bytes written so far and the expected total (-1 when
+// the server does not say).
+func DownloadToFile(client *http.Client, req *http.Request, path string, resume bool, progress func(written, total int64)) (*DownloadResult, error) {
+	var offset int64
+	if resume {
+		if info, err := os.Stat(path); err == nil {
+			offset = info.Size()
+		}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &DownloadResult{Path: path, Status: resp.StatusCode, Total: -1}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		result.Bytes = offset
+		result.Total = offset
+		result.Resumed = true
+		return result, nil
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		result.Resumed = true
+		result.Bytes = offset
+	case resp.StatusCode != http.StatusOK:
+		return result, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if resp.ContentLength >= 0 {
+		result.Total = result.Bytes + resp.ContentLength
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return result, fmt.Errorf("failed to create directory: %v", err)
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return result, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := file.Write(buf[:n]); err != nil {
+				return result, fmt.Errorf("failed to save file: %v", err)
+			}
+			result.Bytes += int64(n)
+			if progress != nil {
+				progress(result.Bytes, result.Total)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return result, fmt.Errorf("failed to save file: %v", readErr)
+		}
+	}
+
+	return result, nil
+}
+
+func RegisterFTModule(L *lua.LState, client *http.Client) {
 	ftModule := L.NewTable()
 	L.SetGlobal("ft", ftModule)
 
 	L.SetField(ftModule, "download", L.NewFunction(func(L *lua.LState) int {
 		url := L.CheckString(1)
 		path := L.CheckString(2)
+		opts := L.OptTable(3, L.NewTable())
 
-		resp, err := http.Get(url)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
 		if err != nil {
 			L.RaiseError("failed to download file: " + err.Error())
 			return 0
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			L.RaiseError("failed to download file: " + resp.Status)
-			return 0
-		}
-
-		dir := filepath.Dir(path)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			L.RaiseError("failed to create directory: " + err.Error())
-			return 0
-		}
 
-		file, err := os.Create(path)
-		if err != nil {
-			L.RaiseError("failed to create file: " + err.Error())
-			return 0
+		resume := lua.LVAsBool(opts.RawGetString("resume"))
+		var progress func(written, total int64)
+		if fn, ok := opts.RawGetString("progress").(*lua.LFunction); ok {
+			progress = func(written, total int64) {
+				totalValue := lua.LValue(lua.LNil)
+				if total >= 0 {
+					totalValue = lua.LNumber(total)
+				}
+				L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: false}, lua.LNumber(written), totalValue)
+			}
 		}
-		defer file.Close()
 
-		_, err = io.Copy(file, resp.Body)
+		result, err := DownloadToFile(client, req, path, resume, progress)
 		if err != nil {
-			L.RaiseError("failed to save file: " + err.Error())
+			L.RaiseError("failed to download file: " + err.Error())
 			return 0
 		}
 
-		return 0
+		L.Push(lua.LNumber(result.Bytes))
+		return 1
 	}))
 
 	L.SetField(ftModule, "upload", L.NewFunction(func(L *lua.LState) int {
 		path := L.CheckString(1)
 		url := L.CheckString(2)
+		opts := L.OptTable(3, L.NewTable())
 
 		file, err := os.Open(path)
 		if err != nil {
@@ -62,19 +142,69 @@ func RegisterFTModule(L *lua.LState) {
 		}
 		defer file.Close()
 
-		resp, err := http.Post(url, "application/octet-stream", file)
+		method := strings.ToUpper(lua.LVAsString(opts.RawGetString("method")))
+		if method == "" {
+			method = http.MethodPost
+		}
+
+		var body io.Reader = file
+		contentType := "application/octet-stream"
+		if field := lua.LVAsString(opts.RawGetString("field")); field != "" {
+			var parts []MultipartPart
+			if fields, ok := opts.RawGetString("fields").(*lua.LTable); ok {
+				if parts, err = ParseMultipartParts(fields); err != nil {
+					L.RaiseError("failed to upload file: " + err.Error())
+					return 0
+				}
+			}
+			parts = append(parts, MultipartPart{
+				Name:        field,
+				Path:        path,
+				Filename:    lua.LVAsString(opts.RawGetString("filename")),
+				ContentType: lua.LVAsString(opts.RawGetString("content_type")),
+				IsFile:      true,
+			})
+			form := NewMultipartForm(parts)
+			if body, err = form.Open(); err != nil {
+				L.RaiseError("failed to upload file: " + err.Error())
+				return 0
+			}
+			contentType = form.ContentType()
+		} else if ct := lua.LVAsString(opts.RawGetString("content_type")); ct != "" {
+			contentType = ct
+		}
+
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			L.RaiseError("failed to upload file: " + err.Error())
+			return 0
+		}
+		if body == io.Reader(file) {
+			if info, err := file.Stat(); err == nil {
+				req.ContentLength = info.Size()
+			}
+		}
+		req.Header.Set("Content-Type", contentType)
+		if headers, ok := opts.RawGetString("headers").(*lua.LTable); ok {
+			headers.ForEach(func(key, value lua.LValue) {
+				req.Header.Set(key.String(), value.String())
+			})
+		}
+
+		resp, err := client.Do(req)
 		if err != nil {
 			L.RaiseError("failed to upload file: " + err.Error())
 			return 0
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
 			L.RaiseError("failed to upload file: " + resp.Status)
 			return 0
 		}
 
-		return 0
+		L.Push(lua.LNumber(resp.StatusCode))
+		return 1
 	}))
 
 	L.SetField(ftModule, "copy", L.NewFunction(func(L *lua.LState) int {
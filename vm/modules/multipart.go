@@ -0,0 +1,199 @@
+package modules
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type MultipartPart struct {
+	Name        string
+	Value       string
+	Path        string
+	Filename    string
+	ContentType string
+	Content     []byte
+	IsFile      bool
+}
+
+// MultipartForm builds multipart/form-data bodies. Files are streamed from
+// disk while the body is read, so large uploads are never held in memory.
+type MultipartForm struct {
+	Parts    []MultipartPart
+	boundary string
+}
+
+func NewMultipartForm(parts []MultipartPart) *MultipartForm {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return &MultipartForm{Parts: parts, boundary: fmt.Sprintf("solvm%x", buf)}
+}
+
+func (mf *MultipartForm) ContentType() string {
+	return "multipart/form-data; boundary=" + mf.boundary
+}
+
+// Open returns a fresh reader over the encoded form. It can be called more
+// than once, e.g. when a request is retried.
+func (mf *MultipartForm) Open() (io.ReadCloser, error) {
+	for _, part := range mf.Parts {
+		if part.Path != "" {
+			if _, err := os.Stat(part.Path); err != nil {
+				return nil, fmt.Errorf("failed to open %s: %v", part.Path, err)
+			}
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(mf.write(pw))
+	}()
+	return pr, nil
+}
+
+func (mf *MultipartForm) write(w io.Writer) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(mf.boundary); err != nil {
+		return err
+	}
+
+	for _, part := range mf.Parts {
+		if !part.IsFile {
+			if err := mw.WriteField(part.Name, part.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeFilePart(mw, part); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func writeFilePart(mw *multipart.Writer, part MultipartPart) error {
+	var src io.Reader
+	if part.Path != "" {
+		file, err := os.Open(part.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", part.Path, err)
+		}
+		defer file.Close()
+		src = file
+	} else {
+		src = strings.NewReader(string(part.Content))
+	}
+
+	filename := part.Filename
+	if filename == "" && part.Path != "" {
+		filename = filepath.Base(part.Path)
+	}
+
+	reader := bufio.NewReader(src)
+	contentType := part.ContentType
+	if contentType == "" {
+		contentType = DetectContentType(filename, reader)
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(part.Name), escapeQuotes(filename)))
+	header.Set("Content-Type", contentType)
+
+	dst, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, reader)
+	return err
+}
+
+// DetectContentType guesses a MIME type from the file extension, falling back
+// to sniffing the first bytes of the content.
+func DetectContentType(filename string, r *bufio.Reader) string {
+	if ext := filepath.Ext(filename); ext != "" {
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType
+		}
+	}
+	head, _ := r.Peek(512)
+	if len(head) == 0 {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(head)
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// ParseMultipartParts reads form parts from a Lua table. Entries may be given
+// as a map (name = "value" or name = { path = ... }) or as an array of tables
+// with a name field, which keeps their order and allows repeated names.
+func ParseMultipartParts(tbl *lua.LTable) ([]MultipartPart, error) {
+	var parts []MultipartPart
+	var err error
+
+	add := func(name string, value lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch v := value.(type) {
+		case *lua.LTable:
+			part := MultipartPart{
+				Name:        name,
+				Path:        lua.LVAsString(v.RawGetString("path")),
+				Filename:    lua.LVAsString(v.RawGetString("filename")),
+				ContentType: lua.LVAsString(v.RawGetString("content_type")),
+			}
+			if content, ok := v.RawGetString("content").(lua.LString); ok {
+				part.Content = []byte(content)
+				part.IsFile = true
+			}
+			if part.Path != "" {
+				part.IsFile = true
+			}
+			if !part.IsFile {
+				if value, ok := v.RawGetString("value").(lua.LString); ok {
+					part.Value = string(value)
+				} else {
+					err = fmt.Errorf("multipart field %q needs a value, path or content", name)
+					return
+				}
+			}
+			parts = append(parts, part)
+		default:
+			parts = append(parts, MultipartPart{Name: name, Value: lua.LVAsString(value)})
+		}
+	}
+
+	for i := 1; i <= tbl.Len(); i++ {
+		entry, ok := tbl.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("multipart entry %d must be a table", i)
+		}
+		name := lua.LVAsString(entry.RawGetString("name"))
+		if name == "" {
+			return nil, fmt.Errorf("multipart entry %d has no name", i)
+		}
+		add(name, entry)
+	}
+	tbl.ForEach(func(key, value lua.LValue) {
+		if name, ok := key.(lua.LString); ok {
+			add(string(name), value)
+		}
+	})
+
+	return parts, err
+}
@@ -15,6 +15,13 @@ type MonitorModule struct {
 	goroutineMap  map[int]string
 	goroutineMu   sync.RWMutex
 	errorHandlers []func(error)
+	eventHandlers []eventHandler
+	eventMu       sync.RWMutex
+}
+
+type eventHandler struct {
+	name     string
+	callback *Callback
 }
 
 func NewMonitorModule(vm *SolVM) *MonitorModule {
@@ -29,6 +36,7 @@ func NewMonitorModule(vm *SolVM) *MonitorModule {
 
 func (mm *MonitorModule) Register() {
 	mm.vm.RegisterFunction("on_error", mm.registerErrorHandler)
+	mm.vm.RegisterFunction("on_event", mm.registerEventHandler)
 	mm.vm.RegisterFunction("check_memory", mm.checkMemory)
 	mm.vm.RegisterFunction("get_goroutines", mm.getGoroutines)
 }
@@ -50,6 +58,48 @@ func (mm *MonitorModule) registerErrorHandler(L *lua.LState) int {
 	return 0
 }
 
+func (mm *MonitorModule) registerEventHandler(L *lua.LState) int {
+	name := ""
+	fnIdx := 1
+	if s, ok := L.Get(1).(lua.LString); ok {
+		name = string(s)
+		fnIdx = 2
+	}
+	fn := L.CheckFunction(fnIdx)
+
+	mm.eventMu.Lock()
+	mm.eventHandlers = append(mm.eventHandlers, eventHandler{
+		name:     name,
+		callback: mm.vm.NewCallback(L, fn, nil, ""),
+	})
+	mm.eventMu.Unlock()
+	return 0
+}
+
+// emit delivers an event to on_event handlers. Handlers run asynchronously
+// so that emitting from inside a Lua call never waits on Lua code.
+func (mm *MonitorModule) emit(name string, data map[string]interface{}) {
+	mm.eventMu.RLock()
+	var callbacks []*Callback
+	for _, handler := range mm.eventHandlers {
+		if handler.name == "" || handler.name == name {
+			callbacks = append(callbacks, handler.callback)
+		}
+	}
+	mm.eventMu.RUnlock()
+
+	for _, callback := range callbacks {
+		go func(callback *Callback) {
+			err := callback.Call(nil, func(L *lua.LState) []lua.LValue {
+				return []lua.LValue{lua.LString(name), convertToLuaValue(L, data)}
+			})
+			if err != nil {
+				mm.handleError(fmt.Errorf("Event handler error: %v", err))
+			}
+		}(callback)
+	}
+}
+
 func (mm *MonitorModule) checkMemory(L *lua.LState) int {
 	var currentMem runtime.MemStats
 	runtime.ReadMemStats(&currentMem)
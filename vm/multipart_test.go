@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// multipartPart is one part of a received multipart body, in order.
+type multipartPart struct {
+	name, filename, contentType, content string
+}
+
+func TestHTTPMultipartUpload(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		parts []multipartPart
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" {
+			http.Error(w, "not multipart", http.StatusBadRequest)
+			return
+		}
+		var got []multipartPart
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			content, _ := io.ReadAll(part)
+			got = append(got, multipartPart{part.FormName(), part.FileName(), part.Header.Get("Content-Type"), string(content)})
+		}
+		mu.Lock()
+		parts = got
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	report := filepath.Join(t.TempDir(), "report.csv")
+	if err := os.WriteFile(report, []byte("a,b\n1,2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := newTestVM(t, Config{})
+	send := func(multipart string) []multipartPart {
+		t.Helper()
+		runLua(t, v, fmt.Sprintf(`
+			local resp = assert(http.request{ method = "POST", url = %q, multipart = %s })
+			assert(resp.status == 200, resp.body)
+		`, srv.URL, multipart))
+		mu.Lock()
+		defer mu.Unlock()
+		return parts
+	}
+
+	got := send(fmt.Sprintf(`{
+		{ name = "tag", value = "a" },
+		{ name = "tag", value = "b" },
+		{ name = "file", path = %q },
+		{ name = "notes", content = "hello", filename = "notes.txt" },
+		{ name = "blob", content = "raw", filename = "data", content_type = "application/x-custom" },
+		{ name = "page", content = "<html><body>hi</body></html>", filename = "page" },
+	}`, report))
+	want := []multipartPart{
+		{"tag", "", "", "a"},
+		{"tag", "", "", "b"},
+		{"file", "report.csv", "text/csv; charset=utf-8", "a,b\n1,2\n"},
+		{"notes", "notes.txt", "text/plain; charset=utf-8", "hello"},
+		{"blob", "data", "application/x-custom", "raw"},
+		{"page", "page", "text/html; charset=utf-8", "<html><body>hi</body></html>"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("ordered parts:\n got %q\nwant %q", got, want)
+	}
+
+	got = send(fmt.Sprintf(`{ title = "Report", upload = { path = %q, filename = "renamed.csv" } }`, report))
+	if len(got) != 2 {
+		t.Fatalf("map parts: %q", got)
+	}
+	for _, part := range got {
+		switch part.name {
+		case "title":
+			if part.content != "Report" || part.filename != "" {
+				t.Errorf("title part %q", part)
+			}
+		case "upload":
+			if part.filename != "renamed.csv" || part.content != "a,b\n1,2\n" {
+				t.Errorf("upload part %q", part)
+			}
+		default:
+			t.Errorf("unexpected part %q", part)
+		}
+	}
+
+	// A missing file fails the request instead of sending a truncated body.
+	runLua(t, v, fmt.Sprintf(`
+		local resp, err = http.request{ method = "POST", url = %q, multipart = { f = { path = "/nonexistent/file" } } }
+		assert(resp == nil and err, "request with a missing file succeeded")
+	`, srv.URL))
+}
+
+func TestHTTPFormEncoding(t *testing.T) {
+	v := newTestVM(t, Config{})
+	runLua(t, v, `
+		local encoded = http.form_encode{ q = "a b&c", tag = { "x", "y" } }
+		assert(encoded == "q=a+b%26c&tag=x&tag=y", encoded)
+
+		local decoded = http.form_decode("q=a+b%26c&tag=x&tag=y&one=1")
+		assert(decoded.q == "a b&c" and decoded.one == "1")
+		assert(type(decoded.tag) == "table" and decoded.tag[1] == "x" and decoded.tag[2] == "y")
+	`)
+}
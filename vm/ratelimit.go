@@ -0,0 +1,319 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// rateLimiter allows rate events per period for each key, either as a
+// token bucket holding up to burst tokens or as a sliding window that
+// weighs the previous window's count by how much of it still overlaps.
+type rateLimiter struct {
+	clock     Clock
+	rate      float64
+	per       time.Duration
+	burst     float64
+	window    bool
+	mu        sync.Mutex
+	keys      map[string]*rateState
+	lastSweep time.Time
+}
+
+// rateEpsilon absorbs floating point error, so an event that becomes
+// allowed after exactly the reported wait is not refused by a rounding.
+const rateEpsilon = 1e-9
+
+type rateState struct {
+	tokens   float64
+	last     time.Time
+	start    time.Time
+	current  float64
+	previous float64
+}
+
+func newRateLimiter(clock Clock, opts *lua.LTable) (*rateLimiter, error) {
+	rate, ok := opts.RawGetString("rate").(lua.LNumber)
+	if !ok || rate <= 0 {
+		return nil, fmt.Errorf("rate must be a positive number")
+	}
+	l := &rateLimiter{
+		clock: clock,
+		rate:  float64(rate),
+		per:   time.Second,
+		burst: float64(rate),
+		keys:  make(map[string]*rateState),
+	}
+	if v, ok := opts.RawGetString("per").(lua.LNumber); ok {
+		if v <= 0 {
+			return nil, fmt.Errorf("per must be positive")
+		}
+		l.per = secondsToDuration(v)
+	}
+	if v, ok := opts.RawGetString("burst").(lua.LNumber); ok {
+		if v < 1 {
+			return nil, fmt.Errorf("burst must be at least 1")
+		}
+		l.burst = float64(v)
+	}
+	switch algorithm := lua.LVAsString(opts.RawGetString("algorithm")); algorithm {
+	case "", "token_bucket":
+	case "sliding_window":
+		l.window = true
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", algorithm)
+	}
+	return l, nil
+}
+
+// allow takes n events for key if the limit permits. Otherwise it reports
+// how long to wait before they would be allowed. remaining is how many more
+// events would be allowed right now.
+func (l *rateLimiter) allow(key string, n float64) (ok bool, retryAfter time.Duration, remaining int) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	state, exists := l.keys[key]
+	if !exists {
+		state = &rateState{tokens: l.burst, last: now, start: now}
+		l.keys[key] = state
+	}
+	if l.window {
+		return l.allowWindow(state, now, n)
+	}
+
+	perSecond := l.rate / l.per.Seconds()
+	state.tokens = math.Min(l.burst, state.tokens+now.Sub(state.last).Seconds()*perSecond)
+	state.last = now
+	if state.tokens+rateEpsilon >= n {
+		state.tokens = math.Max(0, state.tokens-n)
+		return true, 0, int(state.tokens + rateEpsilon)
+	}
+	if n > l.burst {
+		return false, -1, int(state.tokens)
+	}
+	wait := (n - state.tokens) / perSecond
+	return false, waitDuration(wait), int(state.tokens)
+}
+
+func (l *rateLimiter) allowWindow(state *rateState, now time.Time, n float64) (bool, time.Duration, int) {
+	state.last = now
+	if elapsed := now.Sub(state.start); elapsed >= l.per {
+		windows := int64(elapsed / l.per)
+		if windows == 1 {
+			state.previous = state.current
+		} else {
+			state.previous = 0
+		}
+		state.current = 0
+		state.start = state.start.Add(time.Duration(windows) * l.per)
+	}
+
+	elapsed := now.Sub(state.start).Seconds()
+	per := l.per.Seconds()
+	estimate := state.previous*(1-elapsed/per) + state.current
+	if estimate+n <= l.rate+rateEpsilon {
+		state.current += n
+		return true, 0, int(math.Max(0, l.rate-estimate-n+rateEpsilon))
+	}
+	if n > l.rate {
+		return false, -1, int(math.Max(0, l.rate-estimate))
+	}
+
+	// The estimate falls as the previous window slides out; if the current
+	// window alone is over the limit, its own count has to slide out too.
+	var wait float64
+	if state.current+n <= l.rate {
+		wait = per*(1-(l.rate-state.current-n)/state.previous) - elapsed
+	} else {
+		wait = per - elapsed + per*(1-(l.rate-n)/state.current)
+	}
+	return false, waitDuration(math.Max(wait, 0)), int(math.Max(0, l.rate-estimate))
+}
+
+// waitDuration converts a wait in seconds, rounding up so that waiting it
+// out is always enough.
+func waitDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+// sweep drops keys that have been idle long enough to be back at their
+// full allowance, at most once per that period.
+func (l *rateLimiter) sweep(now time.Time) {
+	idle := 2 * l.per
+	if !l.window {
+		idle = time.Duration(l.burst / l.rate * float64(l.per))
+	}
+	if now.Sub(l.lastSweep) < idle {
+		return
+	}
+	l.lastSweep = now
+	for key, state := range l.keys {
+		if now.Sub(state.last) >= idle {
+			delete(l.keys, key)
+		}
+	}
+}
+
+func (l *rateLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+}
+
+func (vm *SolVM) registerRateLimit() {
+	vm.RegisterTable("ratelimit", map[string]lua.LGFunction{
+		"new": func(L *lua.LState) int {
+			limiter, err := newRateLimiter(vm.clock, L.CheckTable(1))
+			if err != nil {
+				L.ArgError(1, err.Error())
+			}
+			L.Push(vm.rateLimiterTable(L, limiter))
+			return 1
+		},
+	})
+}
+
+// rateLimiterTable builds the Lua limiter object. Keys default to the
+// empty string, for a single limit shared by every caller.
+func (vm *SolVM) rateLimiterTable(L *lua.LState, limiter *rateLimiter) *lua.LTable {
+	tbl := L.NewTable()
+
+	tbl.RawSetString("allow", L.NewFunction(func(L *lua.LState) int {
+		ok, retryAfter, remaining := limiter.allow(L.OptString(2, ""), float64(L.OptNumber(3, 1)))
+		L.Push(lua.LBool(ok))
+		if retryAfter < 0 {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LNumber(retryAfter.Seconds()))
+		}
+		L.Push(lua.LNumber(remaining))
+		return 3
+	}))
+
+	// wait blocks until the events are allowed, or returns false without
+	// taking them if that would take longer than the timeout.
+	tbl.RawSetString("wait", L.NewFunction(func(L *lua.LState) int {
+		key := L.OptString(2, "")
+		n := float64(L.OptNumber(3, 1))
+		timeout := time.Duration(-1)
+		if v, ok := L.Get(4).(lua.LNumber); ok {
+			timeout = secondsToDuration(v)
+		}
+		deadline := vm.clock.Now().Add(timeout)
+		for {
+			ok, retryAfter, _ := limiter.allow(key, n)
+			if ok {
+				L.Push(lua.LTrue)
+				return 1
+			}
+			if retryAfter < 0 {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("request exceeds the burst size"))
+				return 2
+			}
+			if timeout >= 0 && vm.clock.Now().Add(retryAfter).After(deadline) {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("timeout"))
+				return 2
+			}
+			vm.sleepFor(L, retryAfter)
+		}
+	}))
+
+	tbl.RawSetString("reset", L.NewFunction(func(L *lua.LState) int {
+		limiter.reset(L.OptString(2, ""))
+		return 0
+	}))
+
+	return tbl
+}
+
+// rateLimitMiddleware limits requests per client, keyed by IP address by
+// default, by a request header with key = "header:Name", or by whatever a
+// Lua function returns for the request (nil exempts it).
+func (sm *ServerModule) rateLimitMiddleware(L *lua.LState) int {
+	opts := L.CheckTable(1)
+	limiter, err := newRateLimiter(sm.vm.clock, opts)
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	headers := true
+	if v, ok := opts.RawGetString("headers").(lua.LBool); ok {
+		headers = bool(v)
+	}
+
+	var keyFn *Callback
+	header := ""
+	switch v := opts.RawGetString("key").(type) {
+	case *lua.LFunction:
+		keyFn = sm.vm.NewCallback(L, v, nil, "")
+	case lua.LString:
+		if name, ok := strings.CutPrefix(string(v), "header:"); ok && name != "" {
+			header = name
+		} else if v != "ip" {
+			L.ArgError(1, `key must be "ip", "header:<name>" or a function`)
+		}
+	case *lua.LNilType:
+	default:
+		L.ArgError(1, `key must be "ip", "header:<name>" or a function`)
+	}
+
+	limit := limiter.burst
+	if limiter.window {
+		limit = limiter.rate
+	}
+	// limitRequest answers 429 and reports false when the key is over the
+	// limit.
+	limitRequest := func(w http.ResponseWriter, r *http.Request, key string) bool {
+		ok, retryAfter, remaining := limiter.allow(key, 1)
+		if headers {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(limit)))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		}
+		if ok {
+			return true
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+		writeError(w, r, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+
+	L.Push(middlewareValue(L, "rate_limit", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if keyFn == nil {
+				key := remoteHost(r)
+				if header != "" {
+					if value := r.Header.Get(header); value != "" {
+						key = value
+					}
+				}
+				if limitRequest(w, r, key) {
+					next.ServeHTTP(w, r)
+				}
+				return
+			}
+
+			sm.withLua(w, r, keyFn.Mode(), false, func(lr *luaRequest) error {
+				results, err := keyFn.CallOn(lr.L, 1, lr.req)
+				if err != nil {
+					return fmt.Errorf("Rate limit key error: %v", err)
+				}
+				if results[0] != lua.LNil && !limitRequest(lr.rw, lr.r, results[0].String()) {
+					return nil
+				}
+				next.ServeHTTP(lr.rw, lr.r)
+				return lr.takeError()
+			})
+		})
+	}))
+	return 1
+}
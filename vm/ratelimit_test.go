@@ -0,0 +1,189 @@
+package vm
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func newTestLimiter(t *testing.T, clock Clock, opts string) *rateLimiter {
+	t.Helper()
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString("return " + opts); err != nil {
+		t.Fatal(err)
+	}
+	l, err := newRateLimiter(clock, L.Get(-1).(*lua.LTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestRateLimitTokenBucket(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	l := newTestLimiter(t, clock, `{ rate = 2, per = 1, burst = 4 }`)
+
+	for i := 3; i >= 0; i-- {
+		if ok, _, remaining := l.allow("a", 1); !ok || remaining != i {
+			t.Fatalf("burst: ok=%v remaining=%d, want remaining %d", ok, remaining, i)
+		}
+	}
+	ok, retryAfter, _ := l.allow("a", 1)
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Fatalf("over the burst: ok=%v retryAfter=%v, want 500ms", ok, retryAfter)
+	}
+	if ok, _, _ := l.allow("b", 1); !ok {
+		t.Fatal("keys share a bucket")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if ok, _, _ := l.allow("a", 1); !ok {
+		t.Fatal("token not refilled after retryAfter")
+	}
+	if _, retryAfter, _ := l.allow("a", 5); retryAfter >= 0 {
+		t.Fatalf("more than the burst: retryAfter=%v, want -1", retryAfter)
+	}
+
+	// Refills never exceed the burst.
+	clock.Advance(time.Hour)
+	if ok, _, remaining := l.allow("a", 4); !ok || remaining != 0 {
+		t.Fatalf("after idling: ok=%v remaining=%d", ok, remaining)
+	}
+
+	l.reset("a")
+	if ok, _, remaining := l.allow("a", 1); !ok || remaining != 3 {
+		t.Fatalf("after reset: ok=%v remaining=%d", ok, remaining)
+	}
+}
+
+func TestRateLimitSlidingWindow(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	l := newTestLimiter(t, clock, `{ rate = 10, per = 10, algorithm = "sliding_window" }`)
+
+	if ok, _, remaining := l.allow("", 10); !ok || remaining != 0 {
+		t.Fatalf("full window: ok=%v remaining=%d", ok, remaining)
+	}
+	// At the start of the next window the previous one still counts fully,
+	// and a tenth of it slides out every second, so the next event fits
+	// one second into it.
+	ok, retryAfter, _ := l.allow("", 1)
+	if ok || retryAfter != 11*time.Second {
+		t.Fatalf("within the window: ok=%v retryAfter=%v, want 11s", ok, retryAfter)
+	}
+
+	clock.Advance(10 * time.Second)
+	ok, retryAfter, _ = l.allow("", 1)
+	if ok || retryAfter != time.Second {
+		t.Fatalf("next window: ok=%v retryAfter=%v, want 1s", ok, retryAfter)
+	}
+	clock.Advance(time.Second)
+	if ok, _, _ := l.allow("", 1); !ok {
+		t.Fatal("not allowed after retryAfter")
+	}
+	if ok, _, _ := l.allow("", 1); ok {
+		t.Fatal("allowed beyond the sliding estimate")
+	}
+
+	clock.Advance(25 * time.Second)
+	if ok, _, _ := l.allow("", 10); !ok {
+		t.Fatal("full allowance not restored after two idle windows")
+	}
+	if _, retryAfter, _ := l.allow("", 11); retryAfter >= 0 {
+		t.Fatalf("more than the rate: retryAfter=%v, want -1", retryAfter)
+	}
+}
+
+// Waiting as long as a denial says must always be enough, and never much
+// more than needed.
+func TestRateLimitRetryAfterIsAccurate(t *testing.T) {
+	for _, opts := range []string{
+		`{ rate = 3, per = 2, burst = 5 }`,
+		`{ rate = 5, per = 2, algorithm = "sliding_window" }`,
+	} {
+		clock := NewFakeClock(time.Now())
+		l := newTestLimiter(t, clock, opts)
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 5000; i++ {
+			clock.Advance(time.Duration(rng.Intn(400)) * time.Millisecond)
+			ok, retryAfter, _ := l.allow("", 1)
+			if ok {
+				continue
+			}
+			if retryAfter > time.Millisecond {
+				clock.Advance(retryAfter - time.Millisecond)
+				if ok, _, _ := l.allow("", 1); ok {
+					t.Fatalf("%s: allowed before retryAfter %v", opts, retryAfter)
+				}
+				retryAfter = time.Millisecond
+			}
+			clock.Advance(retryAfter)
+			if ok, _, _ := l.allow("", 1); !ok {
+				t.Fatalf("%s: still denied after retryAfter", opts)
+			}
+		}
+	}
+}
+
+func TestRateLimitSweepsIdleKeys(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	l := newTestLimiter(t, clock, `{ rate = 1, per = 1, burst = 2 }`)
+	for i := 0; i < 100; i++ {
+		l.allow(fmt.Sprint(i), 1)
+	}
+	clock.Advance(3 * time.Second)
+	l.allow("new", 1)
+	if n := len(l.keys); n != 1 {
+		t.Fatalf("%d keys kept after idling, want 1", n)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	v := newTestVM(t, Config{FakeClock: true})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server("limited", %d)
+		app:use(middleware.rate_limit{ rate = 2, per = 60, key = "header:X-Client" })
+		app:get("/", function(req) return { body = "ok" } end)
+		app:start()
+	`, port))
+	t.Cleanup(func() { runLua(t, v, `stop_server("limited")`) })
+	base := "http://" + waitForServer(t, port) + "/"
+
+	get := func(client string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", base, nil)
+		req.Header.Set("X-Client", client)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := get("a"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := get("a")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "30" {
+		t.Fatalf("over the limit: %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp.Header.Get("X-RateLimit-Limit") != "2" || resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("limit headers: %v", resp.Header)
+	}
+	if resp := get("b"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("another client: status %d", resp.StatusCode)
+	}
+
+	v.Clock().(*FakeClock).Advance(30 * time.Second)
+	if resp := get("a"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("after Retry-After: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,330 @@
+package vm
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultMaxBodySize = 10 << 20
+	multipartMemory    = 1 << 20
+)
+
+// httpError is an error that should be answered with a specific status
+// instead of a 500, such as a request body over the size limit.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func readRequestBody(w http.ResponseWriter, r *http.Request, limit int64) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return "", &httpError{http.StatusRequestEntityTooLarge, "Request Entity Too Large"}
+		}
+		return "", &httpError{http.StatusBadRequest, fmt.Sprintf("failed to read request body: %v", err)}
+	}
+	return string(body), nil
+}
+
+// requestTable converts an incoming request into the table passed to Lua
+// handlers. The body is read up front, limited to the server's maximum body
+// size; multipart bodies are parsed into form fields and files instead, with
+// large files spilled to temporary files that are removed after the request.
+func (sm *ServerModule) requestTable(L *lua.LState, w http.ResponseWriter, r *http.Request, state *requestState) (*lua.LTable, error) {
+	req := L.NewTable()
+	req.RawSetString("method", lua.LString(r.Method))
+	req.RawSetString("path", lua.LString(r.URL.Path))
+	req.RawSetString("raw_query", lua.LString(r.URL.RawQuery))
+	req.RawSetString("host", lua.LString(r.Host))
+	req.RawSetString("remote_addr", lua.LString(r.RemoteAddr))
+	req.RawSetString("proto", lua.LString(r.Proto))
+
+	query := r.URL.Query()
+	req.RawSetString("query", firstValues(L, query))
+	req.RawSetString("query_values", allValues(L, query))
+
+	headers := L.NewTable()
+	for key, values := range r.Header {
+		if len(values) > 0 {
+			headers.RawSetString(key, lua.LString(values[0]))
+		}
+	}
+	req.RawSetString("headers", headers)
+	req.RawSetString("header", L.NewFunction(func(L *lua.LState) int {
+		values := r.Header.Values(L.CheckString(2))
+		if len(values) == 0 {
+			L.Push(lua.LNil)
+			return 1
+		}
+		L.Push(lua.LString(values[0]))
+		return 1
+	}))
+
+	cookies := L.NewTable()
+	for _, cookie := range r.Cookies() {
+		if cookies.RawGetString(cookie.Name) == lua.LNil {
+			cookies.RawSetString(cookie.Name, lua.LString(cookie.Value))
+		}
+	}
+	req.RawSetString("cookies", cookies)
+
+	req.RawSetString("params", L.NewTable())
+	req.RawSetString("context", L.NewTable())
+
+	if r.TLS != nil {
+		req.RawSetString("tls", tlsTable(L, r.TLS))
+	}
+
+	limit := int64(defaultMaxBodySize)
+	if state.srv != nil {
+		limit = state.srv.maxBodySize
+	}
+	form := url.Values{}
+	files := L.NewTable()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		if err := r.ParseMultipartForm(multipartMemory); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, &httpError{http.StatusRequestEntityTooLarge, "Request Entity Too Large"}
+			}
+			return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("invalid multipart body: %v", err)}
+		}
+		for key, values := range r.MultipartForm.Value {
+			form[key] = values
+		}
+		for field, headers := range r.MultipartForm.File {
+			list := L.NewTable()
+			for _, fh := range headers {
+				list.Append(uploadedFileTable(L, state, field, fh))
+			}
+			files.RawSetString(field, list)
+		}
+		req.RawSetString("body", lua.LString(""))
+	} else {
+		body, err := readRequestBody(w, r, limit)
+		if err != nil {
+			return nil, err
+		}
+		req.RawSetString("body", lua.LString(body))
+		if mediaType == "application/x-www-form-urlencoded" {
+			if form, err = url.ParseQuery(body); err != nil {
+				return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("invalid form body: %v", err)}
+			}
+		}
+	}
+
+	req.RawSetString("form", firstValues(L, form))
+	req.RawSetString("form_values", allValues(L, form))
+	req.RawSetString("files", files)
+	req.RawSetString("file", L.NewFunction(func(L *lua.LState) int {
+		if list, ok := files.RawGetString(L.CheckString(2)).(*lua.LTable); ok {
+			L.Push(list.RawGetInt(1))
+			return 1
+		}
+		L.Push(lua.LNil)
+		return 1
+	}))
+
+	req.RawSetString("json", L.NewFunction(func(L *lua.LState) int {
+		self := L.CheckTable(1)
+		var result interface{}
+		if err := json.Unmarshal([]byte(lua.LVAsString(self.RawGetString("body"))), &result); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(fmt.Sprintf("failed to decode json body: %v", err)))
+			return 2
+		}
+		L.Push(convertToLuaValue(L, result))
+		return 1
+	}))
+
+	return req, nil
+}
+
+func paramsTable(L *lua.LState, params []routeParam) *lua.LTable {
+	tbl := L.NewTable()
+	for i, param := range params {
+		tbl.RawSetString(param.name, lua.LString(param.value))
+		tbl.RawSetInt(i+1, lua.LString(param.value))
+	}
+	return tbl
+}
+
+func firstValues(L *lua.LState, values url.Values) *lua.LTable {
+	tbl := L.NewTable()
+	for key, list := range values {
+		if len(list) > 0 {
+			tbl.RawSetString(key, lua.LString(list[0]))
+		}
+	}
+	return tbl
+}
+
+func allValues(L *lua.LState, values url.Values) *lua.LTable {
+	tbl := L.NewTable()
+	for key, list := range values {
+		arr := L.NewTable()
+		for _, value := range list {
+			arr.Append(lua.LString(value))
+		}
+		tbl.RawSetString(key, arr)
+	}
+	return tbl
+}
+
+func tlsTable(L *lua.LState, state *tls.ConnectionState) *lua.LTable {
+	info := L.NewTable()
+	info.RawSetString("version", lua.LString(tls.VersionName(state.Version)))
+	info.RawSetString("cipher_suite", lua.LString(tls.CipherSuiteName(state.CipherSuite)))
+	info.RawSetString("server_name", lua.LString(state.ServerName))
+	info.RawSetString("negotiated_protocol", lua.LString(state.NegotiatedProtocol))
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		client := L.NewTable()
+		client.RawSetString("subject", lua.LString(cert.Subject.String()))
+		client.RawSetString("common_name", lua.LString(cert.Subject.CommonName))
+		client.RawSetString("issuer", lua.LString(cert.Issuer.String()))
+		client.RawSetString("serial", lua.LString(cert.SerialNumber.String()))
+		client.RawSetString("not_after", timeToLua(cert.NotAfter))
+		info.RawSetString("client_certificate", client)
+	}
+	return info
+}
+
+// uploadedFileTable exposes a multipart file to Lua. The content is only
+// opened when read or saved, and read streams it in chunks.
+func uploadedFileTable(L *lua.LState, state *requestState, field string, fh *multipart.FileHeader) *lua.LTable {
+	file := L.NewTable()
+	file.RawSetString("field", lua.LString(field))
+	file.RawSetString("filename", lua.LString(fh.Filename))
+	file.RawSetString("size", lua.LNumber(fh.Size))
+	file.RawSetString("content_type", lua.LString(fh.Header.Get("Content-Type")))
+
+	var reader multipart.File
+	var exhausted bool
+	file.RawSetString("read", L.NewFunction(func(L *lua.LState) int {
+		if exhausted {
+			L.Push(lua.LNil)
+			return 1
+		}
+		if reader == nil {
+			var err error
+			if reader, err = fh.Open(); err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			state.trackUpload(reader)
+		}
+
+		if L.GetTop() < 2 {
+			data, err := io.ReadAll(reader)
+			reader.Close()
+			exhausted = true
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LString(data))
+			return 1
+		}
+
+		buf := make([]byte, L.CheckInt(2))
+		n, err := reader.Read(buf)
+		if n == 0 && err != nil {
+			reader.Close()
+			exhausted = true
+			L.Push(lua.LNil)
+			if err != io.EOF {
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			return 1
+		}
+		L.Push(lua.LString(buf[:n]))
+		return 1
+	}))
+
+	file.RawSetString("save", L.NewFunction(func(L *lua.LState) int {
+		path := L.CheckString(2)
+		if err := saveUploadedFile(fh, path); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	return file
+}
+
+func saveUploadedFile(fh *multipart.FileHeader, path string) error {
+	src, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %v", err)
+		}
+	}
+	dst, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	return dst.Close()
+}
+
+func cleanupRequest(r *http.Request) {
+	if state := requestStateOf(r); state != nil {
+		state.mu.Lock()
+		uploads := state.uploads
+		state.uploads = nil
+		state.mu.Unlock()
+		for _, c := range uploads {
+			c.Close()
+		}
+	}
+	if r.MultipartForm != nil {
+		r.MultipartForm.RemoveAll()
+	}
+}
+
+func isHTTPError(err error) (*httpError, bool) {
+	var herr *httpError
+	if errors.As(err, &herr) {
+		return herr, true
+	}
+	return nil, false
+}
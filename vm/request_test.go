@@ -0,0 +1,171 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// startRequestServer starts a server whose handlers describe the request
+// they received, with request bodies limited to maxBody bytes.
+func startRequestServer(t *testing.T, maxBody int, saveTo string) string {
+	t.Helper()
+	v := newTestVM(t, Config{})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server("requests", %d, { max_body_size = %d })
+		app:post("/raw", function(req)
+			return { body = table.concat({
+				req.body, req.query.a, #req.query_values.a, req:header("x-test"), req.cookies.c,
+			}, "|") }
+		end)
+		app:post("/json", function(req)
+			local data, err = req:json()
+			if not data then return { status = 400, body = err } end
+			return { body = data.name }
+		end)
+		app:post("/form", function(req)
+			return { body = req.form.name .. "|" .. table.concat(req.form_values.tag, ",") }
+		end)
+		app:post("/upload", function(req)
+			local big, small = req:file("big"), req:file("small")
+			local total = 0
+			while true do
+				local chunk = big:read(64 * 1024)
+				if not chunk then break end
+				total = total + #chunk
+			end
+			assert(big:read(10) == nil, "read after the end")
+			assert(small:save(%q))
+			return { body = string.format("%%s %%d %%d|%%s %%s %%s|%%d|%%s",
+				big.filename, big.size, total,
+				small.filename, small.content_type, small:read(),
+				#req.files.big, req.form.note) }
+		end)
+		app:start()
+	`, port, maxBody, saveTo))
+	t.Cleanup(func() { runLua(t, v, `stop_server("requests")`) })
+	return "http://" + waitForServer(t, port)
+}
+
+func doRequest(t *testing.T, req *http.Request) (int, string) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func postBody(t *testing.T, url, contentType string, body io.Reader) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url, body)
+	req.Header.Set("Content-Type", contentType)
+	return doRequest(t, req)
+}
+
+func TestServerRequestBody(t *testing.T) {
+	base := startRequestServer(t, 1024, filepath.Join(t.TempDir(), "unused"))
+
+	req, _ := http.NewRequest("POST", base+"/raw?a=1&a=2", strings.NewReader("payload"))
+	req.Header.Set("X-Test", "yes")
+	req.AddCookie(&http.Cookie{Name: "c", Value: "cookie"})
+	if status, body := doRequest(t, req); status != 200 || body != "payload|1|2|yes|cookie" {
+		t.Fatalf("raw: %d %q", status, body)
+	}
+
+	if status, body := postBody(t, base+"/json", "application/json", strings.NewReader(`{"name":"ada"}`)); status != 200 || body != "ada" {
+		t.Fatalf("json: %d %q", status, body)
+	}
+	if status, _ := postBody(t, base+"/json", "application/json", strings.NewReader(`{"name":`)); status != 400 {
+		t.Fatalf("invalid json: status %d", status)
+	}
+
+	form := "name=a+b%26c&tag=x&tag=y"
+	if status, body := postBody(t, base+"/form", "application/x-www-form-urlencoded", strings.NewReader(form)); status != 200 || body != "a b&c|x,y" {
+		t.Fatalf("form: %d %q", status, body)
+	}
+
+	if status, _ := postBody(t, base+"/raw", "text/plain", strings.NewReader(strings.Repeat("x", 1025))); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("body over the limit: status %d, want 413", status)
+	}
+	if status, _ := postBody(t, base+"/raw?a=1", "text/plain", strings.NewReader(strings.Repeat("x", 1024))); status != 200 {
+		t.Fatalf("body at the limit: status %d", status)
+	}
+}
+
+func TestServerUploadedFiles(t *testing.T) {
+	saved := filepath.Join(t.TempDir(), "uploads", "small.txt")
+	base := startRequestServer(t, 3<<20, saved)
+
+	// The big file is over the in-memory limit, so it is spilled to disk.
+	big := bytes.Repeat([]byte("0123456789abcdef"), 128*1024)
+	upload := func(copies int) (int, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("note", "hi")
+		fw, _ := mw.CreateFormFile("big", "big.bin")
+		for i := 0; i < copies; i++ {
+			fw.Write(big)
+		}
+		fw, _ = mw.CreateFormFile("small", "small.txt")
+		fw.Write([]byte("small file"))
+		mw.Close()
+		return postBody(t, base+"/upload", mw.FormDataContentType(), &buf)
+	}
+
+	status, body := upload(1)
+	want := fmt.Sprintf("big.bin %d %d|small.txt application/octet-stream small file|1|hi", len(big), len(big))
+	if status != 200 || body != want {
+		t.Fatalf("upload: %d %q, want %q", status, body, want)
+	}
+	if data, err := os.ReadFile(saved); err != nil || string(data) != "small file" {
+		t.Fatalf("saved file: %q %v", data, err)
+	}
+
+	if status, _ := upload(2); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("multipart body over the limit: status %d, want 413", status)
+	}
+}
+
+// An upload the handler stops reading part way is closed with the request,
+// so its temporary file does not stay open.
+func TestCleanupRequestClosesUploads(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("big", "big.bin")
+	fw.Write(bytes.Repeat([]byte("x"), 4096))
+	mw.Close()
+	r, _ := http.NewRequest("POST", "/upload", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if err := r.ParseMultipartForm(1); err != nil {
+		t.Fatal(err)
+	}
+	r, state := ensureRequestState(r, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	file := uploadedFileTable(L, state, "big", r.MultipartForm.File["big"][0])
+	L.SetGlobal("file", file)
+	if err := L.DoString(`assert(#file:read(16) == 16)`); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanupRequest(r)
+	if err := L.DoString(`
+		local data, err = file:read(16)
+		assert(data == nil and err:find("closed"), tostring(err))
+	`); err != nil {
+		t.Fatalf("read after cleanup: %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// responseWriter records whether the response has been started so the
+// server knows not to send a returned table or an error page after a
+// handler has already written to the client. Until then, status holds the
+// code set with res:status, and a complete body set by a returned table,
+// res:json or res:send is held back so middleware can still change the
+// response after next() returns.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        []byte
+	hasBody     bool
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	if err := rw.commit(); err != nil {
+		return 0, err
+	}
+	return rw.ResponseWriter.Write(data)
+}
+
+func (rw *responseWriter) Flush() {
+	rw.commit()
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// commit sends the status, headers and pending body if they have not been
+// sent yet.
+func (rw *responseWriter) commit() error {
+	if !rw.wroteHeader {
+		rw.WriteHeader(rw.status)
+	}
+	if !rw.hasBody {
+		return nil
+	}
+	body := rw.body
+	rw.discard()
+	_, err := rw.ResponseWriter.Write(body)
+	return err
+}
+
+func (rw *responseWriter) setBody(body []byte) {
+	rw.body = body
+	rw.hasBody = true
+}
+
+// setError is writeError for a pending response.
+func (rw *responseWriter) setError(r *http.Request, message string, status int) {
+	page := errorResponse(r, message, status)
+	h := rw.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", page.contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	rw.status = status
+	rw.setBody(page.body)
+}
+
+func (rw *responseWriter) discard() {
+	rw.body = nil
+	rw.hasBody = false
+}
+
+// Hijack lets WebSocket upgrades take over the connection, which counts as
+// starting the response.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	rw.wroteHeader = true
+	return hijacker.Hijack()
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *responseWriter) started() bool {
+	return rw.wroteHeader
+}
+
+// responded reports whether a response has been sent or is pending.
+func (rw *responseWriter) responded() bool {
+	return rw.wroteHeader || rw.hasBody
+}
+
+// checkStatus reads the status code at n, which must be a valid one.
+func checkStatus(L *lua.LState, n int) int {
+	status := L.CheckInt(n)
+	if status < 100 || status > 599 {
+		L.ArgError(n, "invalid status code")
+	}
+	return status
+}
+
+// optStatus is checkStatus for an optional status, returning 0 when it is
+// missing.
+func optStatus(L *lua.LState, n int) int {
+	if L.Get(n) == lua.LNil {
+		return 0
+	}
+	return checkStatus(L, n)
+}
+
+// responseTable builds the res object passed to handlers. Methods that only
+// change headers or the status return the object so they can be chained;
+// send, json, redirect and send_file complete the response. Every method
+// goes through lr because native middleware can swap the writer between
+// stages.
+func (sm *ServerModule) responseTable(L *lua.LState, lr *luaRequest) *lua.LTable {
+	res := L.NewTable()
+
+	res.RawSetString("status", L.NewFunction(func(L *lua.LState) int {
+		if L.GetTop() < 2 {
+			L.Push(lua.LNumber(lr.rw.status))
+			return 1
+		}
+		status := checkStatus(L, 2)
+		if !lr.rw.started() {
+			lr.rw.status = status
+		}
+		L.Push(L.Get(1))
+		return 1
+	}))
+
+	res.RawSetString("header", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		switch value := L.Get(3).(type) {
+		case *lua.LNilType:
+			if L.GetTop() < 3 {
+				L.Push(lua.LString(lr.rw.Header().Get(name)))
+				return 1
+			}
+			lr.rw.Header().Del(name)
+		case *lua.LTable:
+			lr.rw.Header().Del(name)
+			value.ForEach(func(_, v lua.LValue) {
+				lr.rw.Header().Add(name, v.String())
+			})
+		default:
+			lr.rw.Header().Set(name, value.String())
+		}
+		L.Push(L.Get(1))
+		return 1
+	}))
+
+	res.RawSetString("set_cookie", L.NewFunction(func(L *lua.LState) int {
+		cookie, err := parseCookieTable(L.CheckTable(2))
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+		http.SetCookie(lr.rw, cookie)
+		L.Push(L.Get(1))
+		return 1
+	}))
+
+	res.RawSetString("json", L.NewFunction(func(L *lua.LState) int {
+		data, err := json.Marshal(convertToGoValue(L.Get(2)))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(fmt.Sprintf("failed to encode json: %v", err)))
+			return 2
+		}
+		if status := optStatus(L, 3); status != 0 && !lr.rw.started() {
+			lr.rw.status = status
+		}
+		lr.rw.Header().Set("Content-Type", "application/json")
+		lr.rw.setBody(data)
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	res.RawSetString("send", L.NewFunction(func(L *lua.LState) int {
+		body := L.CheckString(2)
+		if status := optStatus(L, 3); status != 0 && !lr.rw.started() {
+			lr.rw.status = status
+		}
+		lr.rw.setBody([]byte(body))
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	res.RawSetString("body", L.NewFunction(func(L *lua.LState) int {
+		if L.GetTop() < 2 {
+			if lr.rw.hasBody {
+				L.Push(lua.LString(lr.rw.body))
+			} else {
+				L.Push(lua.LNil)
+			}
+			return 1
+		}
+		if lr.rw.started() {
+			L.Push(lua.LNil)
+			L.Push(lua.LString("response already sent"))
+			return 2
+		}
+		lr.rw.setBody([]byte(L.CheckString(2)))
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	res.RawSetString("redirect", L.NewFunction(func(L *lua.LState) int {
+		target := L.CheckString(2)
+		status := L.OptInt(3, http.StatusFound)
+		if status < 300 || status > 399 {
+			L.ArgError(3, "redirect status must be 3xx")
+		}
+		http.Redirect(lr.rw, lr.r, target, status)
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	res.RawSetString("send_file", L.NewFunction(func(L *lua.LState) int {
+		path := L.CheckString(2)
+		opts := L.OptTable(3, L.NewTable())
+
+		file, err := os.Open(path)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(fmt.Sprintf("%s is not a file", path)))
+			return 2
+		}
+
+		if ct, ok := opts.RawGetString("content_type").(lua.LString); ok {
+			lr.rw.Header().Set("Content-Type", string(ct))
+		}
+		switch download := opts.RawGetString("download").(type) {
+		case lua.LString:
+			lr.rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": string(download)}))
+		case lua.LBool:
+			if download {
+				lr.rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+			}
+		}
+
+		http.ServeContent(lr.rw, lr.r, info.Name(), info.ModTime(), file)
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	res.RawSetString("write", L.NewFunction(func(L *lua.LState) int {
+		return pushWriteResult(L, lr.rw, []byte(L.CheckString(2)))
+	}))
+
+	res.RawSetString("flush", L.NewFunction(func(L *lua.LState) int {
+		lr.rw.Flush()
+		L.Push(L.Get(1))
+		return 1
+	}))
+
+	res.RawSetString("sent", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(lr.rw.responded()))
+		return 1
+	}))
+
+	return res
+}
+
+func pushWriteResult(L *lua.LState, rw *responseWriter, data []byte) int {
+	if _, err := rw.Write(data); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// parseCookieTable reads a cookie from a Lua table. expires is a Unix
+// timestamp and max_age a number of seconds.
+func parseCookieTable(tbl *lua.LTable) (*http.Cookie, error) {
+	name, ok := tbl.RawGetString("name").(lua.LString)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("cookie name is required")
+	}
+	cookie := &http.Cookie{
+		Name:     string(name),
+		Value:    lua.LVAsString(tbl.RawGetString("value")),
+		Path:     lua.LVAsString(tbl.RawGetString("path")),
+		Domain:   lua.LVAsString(tbl.RawGetString("domain")),
+		Secure:   lua.LVAsBool(tbl.RawGetString("secure")),
+		HttpOnly: lua.LVAsBool(tbl.RawGetString("http_only")),
+	}
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	if v, ok := tbl.RawGetString("expires").(lua.LNumber); ok {
+		cookie.Expires = time.Unix(0, int64(float64(v)*float64(time.Second)))
+	}
+	if v, ok := tbl.RawGetString("max_age").(lua.LNumber); ok {
+		cookie.MaxAge = int(v)
+		if cookie.MaxAge == 0 {
+			cookie.MaxAge = -1
+		}
+	}
+	if v, ok := tbl.RawGetString("same_site").(lua.LString); ok {
+		mode, known := sameSiteModes[strings.ToLower(string(v))]
+		if !known {
+			return nil, fmt.Errorf("unknown same_site mode %q", string(v))
+		}
+		cookie.SameSite = mode
+	}
+	if err := cookie.Valid(); err != nil {
+		return nil, err
+	}
+	return cookie, nil
+}
@@ -0,0 +1,359 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+type RetryPolicy struct {
+	Attempts          int
+	Backoff           time.Duration
+	MaxBackoff        time.Duration
+	Jitter            bool
+	Statuses          map[int]bool
+	NetworkErrors     bool
+	AllMethods        bool
+	RespectRetryAfter bool
+}
+
+type BreakerPolicy struct {
+	FailureThreshold int
+	ResetTimeout     time.Duration
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	host     string
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+	policy   BreakerPolicy
+}
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+func defaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		Attempts:   3,
+		Backoff:    500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		Jitter:     true,
+		Statuses: map[int]bool{
+			http.StatusRequestTimeout:      true,
+			http.StatusTooManyRequests:     true,
+			http.StatusInternalServerError: true,
+			http.StatusBadGateway:          true,
+			http.StatusServiceUnavailable:  true,
+			http.StatusGatewayTimeout:      true,
+		},
+		NetworkErrors:     true,
+		RespectRetryAfter: true,
+	}
+}
+
+func parseRetryPolicy(value lua.LValue) (*RetryPolicy, error) {
+	switch v := value.(type) {
+	case lua.LBool:
+		if !v {
+			return nil, nil
+		}
+		return defaultRetryPolicy(), nil
+	case lua.LNumber:
+		policy := defaultRetryPolicy()
+		policy.Attempts = int(v)
+		return policy, nil
+	case *lua.LTable:
+		policy := defaultRetryPolicy()
+		if n, ok := v.RawGetString("attempts").(lua.LNumber); ok {
+			policy.Attempts = int(n)
+		}
+		if n, ok := v.RawGetString("backoff").(lua.LNumber); ok {
+			policy.Backoff = secondsToDuration(n)
+		}
+		if n, ok := v.RawGetString("max_backoff").(lua.LNumber); ok {
+			policy.MaxBackoff = secondsToDuration(n)
+		}
+		if b, ok := v.RawGetString("jitter").(lua.LBool); ok {
+			policy.Jitter = bool(b)
+		}
+		if statuses, ok := v.RawGetString("statuses").(*lua.LTable); ok {
+			policy.Statuses = make(map[int]bool)
+			for i := 1; i <= statuses.Len(); i++ {
+				if n, ok := statuses.RawGetInt(i).(lua.LNumber); ok {
+					policy.Statuses[int(n)] = true
+				}
+			}
+		}
+		if b, ok := v.RawGetString("network_errors").(lua.LBool); ok {
+			policy.NetworkErrors = bool(b)
+		}
+		if b, ok := v.RawGetString("all_methods").(lua.LBool); ok {
+			policy.AllMethods = bool(b)
+		}
+		if b, ok := v.RawGetString("respect_retry_after").(lua.LBool); ok {
+			policy.RespectRetryAfter = bool(b)
+		}
+		return policy, nil
+	case *lua.LNilType:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("retry must be a boolean, number or table")
+	}
+}
+
+func parseBreakerPolicy(value lua.LValue) (*BreakerPolicy, error) {
+	policy := &BreakerPolicy{
+		FailureThreshold: 5,
+		ResetTimeout:     30 * time.Second,
+	}
+	switch v := value.(type) {
+	case lua.LBool:
+		if !v {
+			return nil, nil
+		}
+		return policy, nil
+	case *lua.LTable:
+		if n, ok := v.RawGetString("failure_threshold").(lua.LNumber); ok {
+			policy.FailureThreshold = int(n)
+		}
+		if n, ok := v.RawGetString("reset_timeout").(lua.LNumber); ok {
+			policy.ResetTimeout = secondsToDuration(n)
+		}
+		return policy, nil
+	case *lua.LNilType:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("circuit_breaker must be a boolean or table")
+	}
+}
+
+func (p *RetryPolicy) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if !p.AllMethods && !idempotentMethods[req.Method] {
+		return false
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return p.NetworkErrors && req.Context().Err() == nil
+	}
+	return p.Statuses[resp.StatusCode]
+}
+
+func (p *RetryPolicy) delay(attempt int, resp *http.Response, now time.Time) time.Duration {
+	if p.RespectRetryAfter && resp != nil {
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			if p.MaxBackoff > 0 && after > p.MaxBackoff {
+				after = p.MaxBackoff
+			}
+			return after
+		}
+	}
+
+	delay := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter && delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	return delay
+}
+
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := at.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (hm *HTTPModule) breaker(host string, policy BreakerPolicy) *circuitBreaker {
+	hm.breakerMu.Lock()
+	defer hm.breakerMu.Unlock()
+
+	cb, exists := hm.breakers[host]
+	if !exists {
+		cb = &circuitBreaker{host: host, state: circuitClosed}
+		hm.breakers[host] = cb
+	}
+	cb.mu.Lock()
+	cb.policy = policy
+	cb.mu.Unlock()
+	return cb
+}
+
+func (hm *HTTPModule) breakerAllow(cb *circuitBreaker) bool {
+	cb.mu.Lock()
+	from := cb.state
+	allowed := true
+	switch cb.state {
+	case circuitOpen:
+		if hm.vm.clock.Now().Sub(cb.openedAt) < cb.policy.ResetTimeout {
+			allowed = false
+			break
+		}
+		cb.state = circuitHalfOpen
+		cb.trial = true
+	case circuitHalfOpen:
+		if cb.trial {
+			allowed = false
+		} else {
+			cb.trial = true
+		}
+	}
+	to := cb.state
+	cb.mu.Unlock()
+
+	hm.circuitChanged(cb.host, from, to)
+	return allowed
+}
+
+func (hm *HTTPModule) breakerRecord(cb *circuitBreaker, success bool) {
+	cb.mu.Lock()
+	from := cb.state
+	cb.trial = false
+	if success {
+		cb.failures = 0
+		cb.state = circuitClosed
+	} else {
+		cb.failures++
+		if cb.state == circuitHalfOpen || cb.failures >= cb.policy.FailureThreshold {
+			cb.state = circuitOpen
+			cb.openedAt = hm.vm.clock.Now()
+		}
+	}
+	to := cb.state
+	failures := cb.failures
+	cb.mu.Unlock()
+
+	if from != to {
+		hm.vm.monitor.emit("http.circuit", map[string]interface{}{
+			"host":     cb.host,
+			"from":     from,
+			"to":       to,
+			"failures": failures,
+		})
+	}
+}
+
+func (hm *HTTPModule) circuitChanged(host, from, to string) {
+	if from == to {
+		return
+	}
+	hm.vm.monitor.emit("http.circuit", map[string]interface{}{
+		"host": host,
+		"from": from,
+		"to":   to,
+	})
+}
+
+// policyTransport applies a request's retry policy and the per-host circuit
+// breaker around the underlying transport.
+type policyTransport struct {
+	hm      *HTTPModule
+	base    http.RoundTripper
+	retry   *RetryPolicy
+	breaker *BreakerPolicy
+	// timeout is the client's, measured here on the VM clock like the
+	// retry delays, so that the fake clock can advance both.
+	timeout time.Duration
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var cb *circuitBreaker
+	if t.breaker != nil {
+		cb = t.hm.breaker(req.URL.Host, *t.breaker)
+	}
+
+	var deadline time.Time
+	if t.timeout > 0 {
+		deadline = t.hm.vm.clock.Now().Add(t.timeout)
+	}
+
+	current := req
+	for attempt := 1; ; attempt++ {
+		if cb != nil && !t.hm.breakerAllow(cb) {
+			return nil, fmt.Errorf("circuit breaker open for %s", req.URL.Host)
+		}
+
+		resp, err := t.base.RoundTrip(current)
+		if cb != nil {
+			t.hm.breakerRecord(cb, err == nil && resp.StatusCode < 500)
+		}
+
+		if t.retry == nil || attempt > t.retry.Attempts || !t.retry.retryable(current, resp, err) {
+			return resp, err
+		}
+
+		now := t.hm.vm.clock.Now()
+		delay := t.retry.delay(attempt, resp, now)
+		if !deadline.IsZero() && deadline.Sub(now) <= delay {
+			// The timeout would expire while waiting, so the last
+			// response is more useful than a deadline error.
+			return resp, err
+		}
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		t.hm.vm.monitor.emit("http.retry", map[string]interface{}{
+			"method":  req.Method,
+			"url":     req.URL.String(),
+			"attempt": attempt,
+			"reason":  reason,
+			"delay":   delay.Seconds(),
+		})
+
+		select {
+		case <-t.hm.vm.clock.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		current = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			current.Body = body
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package vm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryGivesUpBeforeTimeout(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+		} else {
+			w.Header().Set("Retry-After", "20")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	v := newTestVM(t, Config{})
+	start := time.Now()
+	runLuaWithin(t, v, 10*time.Second, fmt.Sprintf(`
+		local resp, err = http.request{ url = %q, retry = 5, timeout = 3 }
+		assert(resp, "request failed: " .. tostring(err))
+		assert(resp.status == 503, "status " .. tostring(resp.status))
+	`, srv.URL))
+	if elapsed := time.Since(start); elapsed > 2500*time.Millisecond {
+		t.Fatalf("request took %v, want the retry after 20s to be skipped", elapsed)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Fatalf("server saw %d requests, want 2", n)
+	}
+}
+
+// With the fake clock the retry delays pass on the VM clock, so the request
+// timeout must be measured on it too.
+func TestRetryTimeoutUsesVMClock(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	v := newTestVM(t, Config{FakeClock: true})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				v.Clock().(*FakeClock).Advance(2 * time.Second)
+			}
+		}
+	}()
+	runLuaWithin(t, v, 5*time.Second, fmt.Sprintf(`
+		local resp, err = http.request{ url = %q, retry = 5, timeout = 3 }
+		assert(resp and resp.status == 503, "request failed: " .. tostring(err))
+	`, srv.URL))
+	if n := atomic.LoadInt32(&hits); n > 2 {
+		t.Fatalf("server saw %d requests, want the retries to stop at the 3s timeout", n)
+	}
+}
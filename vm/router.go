@@ -0,0 +1,227 @@
+package vm
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentStatic = iota
+	segmentParam
+	segmentWildcard
+)
+
+type routeSegment struct {
+	kind  int
+	value string
+}
+
+type routeParam struct {
+	name  string
+	value string
+}
+
+// routeHandler serves a matched request. Lua handlers, static files and
+// WebSocket endpoints are all plain routeHandlers as far as the router is
+// concerned.
+type routeHandler func(w http.ResponseWriter, r *http.Request, params []routeParam)
+
+type Route struct {
+	method   string
+	pattern  string
+	segments []routeSegment
+	handler  routeHandler
+}
+
+// Router matches requests by method and path. Patterns are made of static
+// segments, named parameters (":id") and a trailing wildcard ("*rest") that
+// captures the remainder of the path. When several routes match, the one
+// with the most specific segment at the first difference wins.
+type Router struct {
+	mu               sync.RWMutex
+	routes           []*Route
+	notFound         routeHandler
+	methodNotAllowed routeHandler
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+func parsePattern(pattern string) []routeSegment {
+	var segments []routeSegment
+	for _, part := range splitPath(pattern) {
+		switch {
+		case strings.HasPrefix(part, ":"):
+			segments = append(segments, routeSegment{kind: segmentParam, value: part[1:]})
+		case strings.HasPrefix(part, "*"):
+			name := part[1:]
+			if name == "" {
+				name = "wildcard"
+			}
+			segments = append(segments, routeSegment{kind: segmentWildcard, value: name})
+			return segments
+		default:
+			segments = append(segments, routeSegment{kind: segmentStatic, value: part})
+		}
+	}
+	return segments
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func joinPaths(prefix, path string) string {
+	joined := strings.TrimRight(prefix, "/") + "/" + strings.TrimLeft(path, "/")
+	if path == "" || path == "/" {
+		if trimmed := strings.TrimRight(joined, "/"); trimmed != "" {
+			return trimmed
+		}
+	}
+	return joined
+}
+
+// Handle registers handler for method ("" or "*" for any method) and pattern,
+// replacing an existing route with the same method and pattern.
+func (rt *Router) Handle(method, pattern string, handler routeHandler) {
+	if method == "*" {
+		method = ""
+	}
+	route := &Route{
+		method:   strings.ToUpper(method),
+		pattern:  pattern,
+		segments: parsePattern(pattern),
+		handler:  handler,
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for i, existing := range rt.routes {
+		if existing.method == route.method && existing.pattern == route.pattern {
+			rt.routes[i] = route
+			return
+		}
+	}
+	rt.routes = append(rt.routes, route)
+}
+
+func (rt *Router) NotFound(handler routeHandler) {
+	rt.mu.Lock()
+	rt.notFound = handler
+	rt.mu.Unlock()
+}
+
+func (rt *Router) MethodNotAllowed(handler routeHandler) {
+	rt.mu.Lock()
+	rt.methodNotAllowed = handler
+	rt.mu.Unlock()
+}
+
+func (route *Route) match(parts []string) ([]routeParam, bool) {
+	var params []routeParam
+	for i, segment := range route.segments {
+		if segment.kind == segmentWildcard {
+			return append(params, routeParam{segment.value, strings.Join(parts[i:], "/")}), true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch segment.kind {
+		case segmentStatic:
+			if parts[i] != segment.value {
+				return nil, false
+			}
+		case segmentParam:
+			params = append(params, routeParam{segment.value, parts[i]})
+		}
+	}
+	return params, len(parts) == len(route.segments)
+}
+
+// moreSpecific reports whether route should be preferred over other.
+func (route *Route) moreSpecific(other *Route) bool {
+	for i := 0; i < len(route.segments) && i < len(other.segments); i++ {
+		if route.segments[i].kind != other.segments[i].kind {
+			return route.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(route.segments) != len(other.segments) {
+		return len(route.segments) > len(other.segments)
+	}
+	return route.method != "" && other.method == ""
+}
+
+// Match finds the route for a request. If the path matches but the method
+// does not, it returns the methods that would have matched instead.
+func (rt *Router) Match(method, path string) (*Route, []routeParam, []string) {
+	parts := splitPath(path)
+
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var best *Route
+	var bestParams []routeParam
+	allowed := make(map[string]bool)
+	for _, route := range rt.routes {
+		params, ok := route.match(parts)
+		if !ok {
+			continue
+		}
+		if route.method != "" && route.method != method &&
+			!(method == http.MethodHead && route.method == http.MethodGet) {
+			allowed[route.method] = true
+			continue
+		}
+		if best == nil || route.moreSpecific(best) ||
+			(!best.moreSpecific(route) && route.method == method && best.method != method) {
+			best, bestParams = route, params
+		}
+	}
+	if best != nil {
+		return best, bestParams, nil
+	}
+
+	methods := make([]string, 0, len(allowed))
+	for m := range allowed {
+		methods = append(methods, m)
+	}
+	if allowed[http.MethodGet] && !allowed[http.MethodHead] {
+		methods = append(methods, http.MethodHead)
+	}
+	sort.Strings(methods)
+	return nil, nil, methods
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, params, allowed := rt.Match(r.Method, r.URL.Path)
+	if route != nil {
+		route.handler(w, r, params)
+		return
+	}
+
+	rt.mu.RLock()
+	notFound, methodNotAllowed := rt.notFound, rt.methodNotAllowed
+	rt.mu.RUnlock()
+
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		if methodNotAllowed != nil {
+			methodNotAllowed(w, r, nil)
+			return
+		}
+		writeError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if notFound != nil {
+		notFound(w, r, nil)
+		return
+	}
+	writeError(w, r, "404 page not found", http.StatusNotFound)
+}
@@ -0,0 +1,185 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// namedHandler answers with its name and the matched parameters.
+func namedHandler(name string) routeHandler {
+	return func(w http.ResponseWriter, r *http.Request, params []routeParam) {
+		var parts []string
+		for _, p := range params {
+			parts = append(parts, p.name+"="+p.value)
+		}
+		fmt.Fprintf(w, "%s %s", name, strings.Join(parts, ","))
+	}
+}
+
+func serveRouter(rt *Router, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestRouterMatching(t *testing.T) {
+	rt := NewRouter()
+	rt.Handle("GET", "/users/:id", namedHandler("user"))
+	rt.Handle("GET", "/users/me", namedHandler("me"))
+	rt.Handle("GET", "/users/:id/posts/:post", namedHandler("post"))
+	rt.Handle("GET", "/files/*path", namedHandler("files"))
+	rt.Handle("GET", "/files/readme", namedHandler("readme"))
+	rt.Handle("", "/any", namedHandler("any"))
+	rt.Handle("POST", "/any", namedHandler("post-any"))
+	rt.Handle("GET", "/", namedHandler("root"))
+
+	tests := []struct {
+		method, path, want string
+	}{
+		{"GET", "/users/42", "user id=42"},
+		{"GET", "/users/me", "me "},
+		{"GET", "/users/42/posts/7", "post id=42,post=7"},
+		{"GET", "/files/a/b/c.txt", "files path=a/b/c.txt"},
+		{"GET", "/files/readme", "readme "},
+		{"GET", "/files/", "files path="},
+		{"DELETE", "/any", "any "},
+		{"POST", "/any", "post-any "},
+		{"GET", "/", "root "},
+		{"HEAD", "/users/42", "user id=42"},
+	}
+	for _, tt := range tests {
+		w := serveRouter(rt, tt.method, tt.path)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s %s: %d %q, want %q", tt.method, tt.path, w.Code, w.Body.String(), tt.want)
+		}
+	}
+
+	// Registering the same method and pattern again replaces the route.
+	rt.Handle("GET", "/users/:id", namedHandler("replaced"))
+	if body := serveRouter(rt, "GET", "/users/1").Body.String(); body != "replaced id=1" {
+		t.Errorf("re-registered route: %q", body)
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	rt := NewRouter()
+	rt.Handle("GET", "/items/:id", namedHandler("get"))
+	rt.Handle("PUT", "/items/:id", namedHandler("put"))
+
+	w := serveRouter(rt, "POST", "/items/1")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST: status %d, want 405", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD, PUT" {
+		t.Fatalf("Allow %q", allow)
+	}
+	if w := serveRouter(rt, "GET", "/missing"); w.Code != http.StatusNotFound || w.Header().Get("Allow") != "" {
+		t.Fatalf("unknown path: %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	rt.NotFound(namedHandler("custom-404"))
+	rt.MethodNotAllowed(namedHandler("custom-405"))
+	if body := serveRouter(rt, "GET", "/missing").Body.String(); body != "custom-404 " {
+		t.Errorf("custom not found: %q", body)
+	}
+	w = serveRouter(rt, "DELETE", "/items/1")
+	if w.Body.String() != "custom-405 " || w.Header().Get("Allow") != "GET, HEAD, PUT" {
+		t.Errorf("custom method not allowed: %q, Allow %q", w.Body.String(), w.Header().Get("Allow"))
+	}
+}
+
+func TestRouterGroups(t *testing.T) {
+	v := newTestVM(t, Config{})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server("groups", %d)
+		app:use(function(req)
+			if req.headers["X-Block"] then return { status = 403, body = "blocked" } end
+		end)
+		app:group("/api", function(api)
+			api:use(function(req) req.seen = "api" end)
+			api:get("/", function(req) return { body = "api root" } end)
+			api:group("/v1", function(v1)
+				v1:use(function(req) req.seen = req.seen .. ">v1" end)
+				v1:get("/users/:id", function(req)
+					return { body = req.seen .. " " .. req.params.id }
+				end)
+			end)
+		end)
+		app:get("/users/:id", function(req) return { body = "outside " .. tostring(req.seen) } end)
+		app:start()
+	`, port))
+	t.Cleanup(func() { runLua(t, v, `stop_server("groups")`) })
+	base := "http://" + waitForServer(t, port)
+
+	tests := []struct {
+		method, path string
+		block        bool
+		status       int
+		body         string
+	}{
+		{"GET", "/api/v1/users/7", false, 200, "api>v1 7"},
+		{"GET", "/api", false, 200, "api root"},
+		{"GET", "/users/7", false, 200, "outside nil"},
+		{"GET", "/api/v1/users/7", true, 403, "blocked"},
+		{"GET", "/users/7", true, 403, "blocked"},
+		{"POST", "/api/v1/users/7", false, 405, ""},
+		{"GET", "/api/v2/users/7", false, 404, ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, base+tt.path, nil)
+		if tt.block {
+			req.Header.Set("X-Block", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || (tt.body != "" && string(body) != tt.body) {
+			t.Errorf("%s %s (blocked %v): %d %q, want %d %q", tt.method, tt.path, tt.block, resp.StatusCode, body, tt.status, tt.body)
+		}
+	}
+}
+
+// Pipeline middleware is chosen with { pipeline = true }, never guessed from
+// the function's parameters: a variadic function still gets next, and an
+// old before-hook with three parameters is still continued past.
+func TestMiddlewarePipelineOption(t *testing.T) {
+	v := newTestVM(t, Config{})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server("pipeline", %d)
+		app:use(function(...)
+			local req, res, next = ...
+			req.context.trail = "pipeline"
+			next()
+			res:header("X-After", req.context.trail)
+		end, { pipeline = true })
+		app:use(function(req, res, extra)
+			assert(extra == nil, "a before-hook was passed next")
+			req.context.trail = req.context.trail .. ">hook"
+		end)
+		app:get("/", function(req) return { body = req.context.trail } end)
+		app:start()
+	`, port))
+	t.Cleanup(func() { runLua(t, v, `stop_server("pipeline")`) })
+
+	resp, err := http.Get("http://" + waitForServer(t, port) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "pipeline>hook" {
+		t.Fatalf("status %d, body %q", resp.StatusCode, body)
+	}
+	if after := resp.Header.Get("X-After"); after != "pipeline>hook" {
+		t.Fatalf("code after next() saw %q", after)
+	}
+}
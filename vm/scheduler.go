@@ -1,7 +1,11 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,30 +13,94 @@ import (
 	lua "github.com/yuin/gopher-lua"
 )
 
+const (
+	jobInterval = "interval"
+	jobTimeout  = "timeout"
+	jobCron     = "cron"
+
+	overlapAllow = "allow"
+	overlapSkip  = "skip"
+	overlapQueue = "queue"
+
+	catchUpOnce = "once"
+	catchUpAll  = "all"
+	catchUpSkip = "skip"
+
+	maxCatchUpRuns  = 1000
+	defaultJobStore = ".solvm/jobs.json"
+)
+
+var cronParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+type JobOptions struct {
+	Name          string
+	Persist       bool
+	CatchUp       string
+	Timezone      string
+	Overlap       string
+	Retries       int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	MaxRuntime    time.Duration
+	Jitter        time.Duration
+	OnRun         *lua.LFunction
+	Args          []lua.LValue
+	Mode          string
+}
+
+type jobRun struct {
+	label       string
+	scheduledAt time.Time
+	startedAt   time.Time
+	finishedAt  time.Time
+	attempts    int
+	skipped     bool
+	err         error
+}
+
+type Job struct {
+	ID       int
+	Name     string
+	Kind     string
+	Schedule string
+	Interval time.Duration
+	Options  JobOptions
+
+	mu        sync.Mutex
+	callback  *Callback
+	onRun     *Callback
+	paused    bool
+	cancelled bool
+	running   bool
+	queued    []*jobRun
+	nextRun   time.Time
+	lastRun   time.Time
+	runCount  int
+	lastError error
+	skipCount int
+	remaining time.Duration
+	fired     bool
+	timer     Timer
+	schedule  cron.Schedule
+}
+
 type SchedulerModule struct {
-	vm        *SolVM
-	intervals map[int]*time.Ticker
-	timeouts  map[int]*time.Timer
-	crons     map[int]cron.EntryID
-	cron      *cron.Cron
-	mu        sync.RWMutex
-	nextID    int
-	pool      *sync.Pool
+	vm       *SolVM
+	jobs     map[int]*Job
+	names    map[string]int
+	mu       sync.RWMutex
+	nextID   int
+	store    *JobStore
+	storeErr error
+	storeMu  sync.Mutex
 }
 
 func NewSchedulerModule(vm *SolVM) *SchedulerModule {
 	return &SchedulerModule{
-		vm:        vm,
-		intervals: make(map[int]*time.Ticker),
-		timeouts:  make(map[int]*time.Timer),
-		crons:     make(map[int]cron.EntryID),
-		cron:      cron.New(cron.WithSeconds()),
-		nextID:    1,
-		pool: &sync.Pool{
-			New: func() interface{} {
-				return lua.NewState()
-			},
-		},
+		vm:     vm,
+		jobs:   make(map[int]*Job),
+		names:  make(map[string]int),
+		nextID: 1,
 	}
 }
 
@@ -40,146 +108,773 @@ func (sm *SchedulerModule) Register() {
 	sm.vm.RegisterFunction("set_interval", sm.setInterval)
 	sm.vm.RegisterFunction("set_timeout", sm.setTimeout)
 	sm.vm.RegisterFunction("cron", sm.setCron)
-	sm.cron.Start()
+	sm.vm.RegisterTable("scheduler", map[string]lua.LGFunction{
+		"list": sm.list,
+	})
 }
 
-func (sm *SchedulerModule) setInterval(L *lua.LState) int {
-	fn := L.CheckFunction(1)
-	seconds := float64(L.CheckNumber(2))
+func (sm *SchedulerModule) newJob(L *lua.LState, kind string, fn *lua.LFunction, opts JobOptions) *Job {
+	if opts.Name != "" {
+		sm.mu.RLock()
+		id, exists := sm.names[opts.Name]
+		sm.mu.RUnlock()
+		if exists {
+			sm.cancelJob(id, false)
+		}
+	}
 
 	sm.mu.Lock()
-	id := sm.nextID
+	defer sm.mu.Unlock()
+
+	job := &Job{
+		ID:       sm.nextID,
+		Name:     opts.Name,
+		Kind:     kind,
+		Options:  opts,
+		callback: sm.vm.NewCallback(L, fn, opts.Args, opts.Mode),
+	}
+	if opts.OnRun != nil {
+		job.onRun = sm.vm.NewCallback(L, opts.OnRun, nil, opts.Mode)
+	}
 	sm.nextID++
-	sm.mu.Unlock()
+	sm.jobs[job.ID] = job
+	if job.Name != "" {
+		sm.names[job.Name] = job.ID
+	}
+	return job
+}
 
-	ticker := time.NewTicker(time.Duration(seconds * float64(time.Second)))
-	sm.intervals[id] = ticker
+func (sm *SchedulerModule) setInterval(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	seconds := float64(L.CheckNumber(2))
+	interval := time.Duration(seconds * float64(time.Second))
+	if interval <= 0 {
+		L.ArgError(2, "interval must be positive")
+		return 0
+	}
+	opts := sm.parseJobOptions(L, 3, jobInterval)
 
-	go func() {
-		for range ticker.C {
-			L2 := sm.pool.Get().(*lua.LState)
-			defer sm.pool.Put(L2)
+	job := sm.newJob(L, jobInterval, fn, opts)
+	job.Interval = interval
 
-			fn2 := L2.NewFunctionFromProto(fn.Proto)
-			L2.Push(fn2)
-			if err := L2.PCall(0, 0, nil); err != nil {
-				sm.vm.monitor.handleError(fmt.Errorf("Interval function error: %v", err))
-			}
-		}
-	}()
+	firstRun, catchUp := sm.restoreJob(L, job, sm.vm.clock.Now().Add(interval))
+	sm.scheduleNext(job, firstRun, "Interval")
+	sm.catchUp(job, catchUp, "Interval")
 
-	L.Push(lua.LNumber(id))
+	L.Push(sm.jobTable(L, job))
 	return 1
 }
 
 func (sm *SchedulerModule) setTimeout(L *lua.LState) int {
 	fn := L.CheckFunction(1)
 	seconds := float64(L.CheckNumber(2))
+	delay := time.Duration(seconds * float64(time.Second))
+	opts := sm.parseJobOptions(L, 3, jobTimeout)
+
+	job := sm.newJob(L, jobTimeout, fn, opts)
+	job.Interval = delay
+
+	now := sm.vm.clock.Now()
+	runAt, catchUp := sm.restoreJob(L, job, now.Add(delay))
+	if catchUp > 0 {
+		runAt = now
+	} else if job.Options.Persist && !runAt.After(now) {
+		sm.finishTimeout(job)
+		L.Push(sm.jobTable(L, job))
+		return 1
+	}
 
-	sm.mu.Lock()
-	id := sm.nextID
-	sm.nextID++
-	sm.mu.Unlock()
-
-	timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
-	sm.timeouts[id] = timer
+	job.mu.Lock()
+	sm.armTimeout(job, runAt.Sub(now))
+	job.mu.Unlock()
 
-	go func() {
-		<-timer.C
-		L2 := sm.pool.Get().(*lua.LState)
-		defer sm.pool.Put(L2)
+	L.Push(sm.jobTable(L, job))
+	return 1
+}
 
-		fn2 := L2.NewFunctionFromProto(fn.Proto)
-		L2.Push(fn2)
-		if err := L2.PCall(0, 0, nil); err != nil {
-			sm.vm.monitor.handleError(fmt.Errorf("Timeout function error: %v", err))
-		}
+func (sm *SchedulerModule) armTimeout(job *Job, delay time.Duration) {
+	job.nextRun = sm.vm.clock.Now().Add(delay)
+	job.timer = sm.vm.clock.AfterFunc(delay, func() {
+		job.mu.Lock()
+		job.fired = true
+		job.mu.Unlock()
+		sm.trigger(job, "Timeout")
+	})
+}
 
-		sm.mu.Lock()
-		delete(sm.timeouts, id)
-		sm.mu.Unlock()
-	}()
+func (sm *SchedulerModule) finishTimeout(job *Job) {
+	job.mu.Lock()
+	job.nextRun = time.Time{}
+	job.mu.Unlock()
 
-	L.Push(lua.LNumber(id))
-	return 1
+	sm.removeJob(job)
+	if job.Options.Persist {
+		sm.forgetJob(job)
+	}
 }
 
 func (sm *SchedulerModule) setCron(L *lua.LState) int {
 	schedule := L.CheckString(1)
 	fn := L.CheckFunction(2)
+	opts := sm.parseJobOptions(L, 3, jobCron)
 
-	sm.mu.Lock()
-	id := sm.nextID
-	sm.nextID++
-	sm.mu.Unlock()
+	spec := schedule
+	if opts.Timezone != "" {
+		if _, err := time.LoadLocation(opts.Timezone); err != nil {
+			L.RaiseError("Invalid timezone %q: %v", opts.Timezone, err)
+			return 0
+		}
+		spec = fmt.Sprintf("CRON_TZ=%s %s", opts.Timezone, schedule)
+	}
 
-	entryID, err := sm.cron.AddFunc(schedule, func() {
-		L2 := sm.pool.Get().(*lua.LState)
-		defer sm.pool.Put(L2)
+	parsed, err := cronParser.Parse(spec)
+	if err != nil {
+		L.RaiseError("Invalid cron schedule: %v", err)
+		return 0
+	}
+
+	job := sm.newJob(L, jobCron, fn, opts)
+	job.Schedule = schedule
+	job.schedule = parsed
+
+	firstRun, catchUp := sm.restoreJob(L, job, parsed.Next(sm.vm.clock.Now()))
+	sm.scheduleNext(job, firstRun, "Cron")
+	sm.catchUp(job, catchUp, "Cron")
+
+	L.Push(sm.jobTable(L, job))
+	return 1
+}
+
+func (sm *SchedulerModule) scheduleNext(job *Job, at time.Time, label string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
 
-		fn2 := L2.NewFunctionFromProto(fn.Proto)
-		L2.Push(fn2)
-		if err := L2.PCall(0, 0, nil); err != nil {
-			sm.vm.monitor.handleError(fmt.Errorf("Cron function error: %v", err))
+	if job.cancelled {
+		return
+	}
+
+	job.nextRun = at
+	job.timer = sm.vm.clock.AfterFunc(at.Sub(sm.vm.clock.Now()), func() {
+		job.mu.Lock()
+		next := job.advance(job.nextRun, sm.vm.clock.Now())
+		paused := job.paused
+		job.mu.Unlock()
+
+		sm.scheduleNext(job, next, label)
+		if !paused {
+			sm.trigger(job, label)
 		}
 	})
+}
+
+func (sm *SchedulerModule) jobStore() (*JobStore, error) {
+	sm.storeMu.Lock()
+	defer sm.storeMu.Unlock()
+
+	if sm.store != nil || sm.storeErr != nil {
+		return sm.store, sm.storeErr
+	}
 
+	path := sm.vm.jobStore
+	if path == "" {
+		path = defaultJobStore
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(sm.vm.workingDir, path)
+	}
+
+	sm.store, sm.storeErr = OpenJobStore(path)
+	return sm.store, sm.storeErr
+}
+
+func (sm *SchedulerModule) restoreJob(L *lua.LState, job *Job, defaultNext time.Time) (time.Time, int) {
+	if !job.Options.Persist {
+		return defaultNext, 0
+	}
+
+	store, err := sm.jobStore()
 	if err != nil {
-		L.RaiseError("Invalid cron schedule: %v", err)
+		sm.removeJob(job)
+		L.RaiseError("Failed to open job store: %v", err)
+		return defaultNext, 0
+	}
+
+	now := sm.vm.clock.Now()
+	nextRun := defaultNext
+	catchUp := 0
+
+	record, exists := store.Get(job.Name)
+	if exists && record.matches(job) {
+		job.mu.Lock()
+		job.lastRun = record.LastRun
+		job.runCount = record.RunCount
+		job.mu.Unlock()
+
+		nextRun = record.NextRun
+		if missed := job.missedRuns(nextRun, now); missed > 0 {
+			switch job.Options.CatchUp {
+			case catchUpAll:
+				catchUp = missed
+			case catchUpOnce:
+				catchUp = 1
+			}
+			nextRun = job.advance(nextRun, now)
+		}
+	}
+
+	job.mu.Lock()
+	job.nextRun = nextRun
+	job.mu.Unlock()
+	sm.persistJob(job)
+
+	return nextRun, catchUp
+}
+
+func (sm *SchedulerModule) catchUp(job *Job, runs int, label string) {
+	for i := 0; i < runs; i++ {
+		sm.afterJob(job, 0, func() {
+			sm.trigger(job, label)
+		})
+	}
+}
+
+func (sm *SchedulerModule) persistJob(job *Job) {
+	if !job.Options.Persist {
+		return
+	}
+
+	store, err := sm.jobStore()
+	if err != nil {
+		return
+	}
+
+	job.mu.Lock()
+	record := JobRecord{
+		Name:     job.Name,
+		Kind:     job.Kind,
+		Schedule: job.Schedule,
+		Timezone: job.Options.Timezone,
+		Interval: job.Interval.Seconds(),
+		NextRun:  job.nextRun,
+		LastRun:  job.lastRun,
+		RunCount: job.runCount,
+	}
+	job.mu.Unlock()
+
+	if err := store.Put(record); err != nil {
+		sm.vm.monitor.handleError(fmt.Errorf("Failed to persist job %s: %v", job.Name, err))
+	}
+}
+
+func (sm *SchedulerModule) forgetJob(job *Job) {
+	store, err := sm.jobStore()
+	if err != nil {
+		return
+	}
+	if err := store.Delete(job.Name); err != nil {
+		sm.vm.monitor.handleError(fmt.Errorf("Failed to remove job %s from store: %v", job.Name, err))
+	}
+}
+
+func (record JobRecord) matches(job *Job) bool {
+	return record.Kind == job.Kind &&
+		record.Schedule == job.Schedule &&
+		record.Timezone == job.Options.Timezone &&
+		(job.Kind != jobInterval || record.Interval == job.Interval.Seconds())
+}
+
+func (job *Job) missedRuns(nextRun, now time.Time) int {
+	if nextRun.IsZero() || nextRun.After(now) {
 		return 0
 	}
 
-	sm.crons[id] = entryID
-	L.Push(lua.LNumber(id))
-	return 1
+	switch job.Kind {
+	case jobInterval:
+		missed := int(now.Sub(nextRun)/job.Interval) + 1
+		if missed > maxCatchUpRuns {
+			missed = maxCatchUpRuns
+		}
+		return missed
+	case jobCron:
+		missed := 0
+		for t := nextRun; !t.After(now) && missed < maxCatchUpRuns; t = job.schedule.Next(t) {
+			missed++
+		}
+		return missed
+	default:
+		return 1
+	}
 }
 
-func (sm *SchedulerModule) ClearInterval(id int) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+func (job *Job) advance(nextRun, now time.Time) time.Time {
+	switch job.Kind {
+	case jobInterval:
+		for !nextRun.After(now) {
+			nextRun = nextRun.Add(job.Interval)
+		}
+		return nextRun
+	case jobCron:
+		return job.schedule.Next(now)
+	default:
+		return nextRun
+	}
+}
+
+func (sm *SchedulerModule) parseJobOptions(L *lua.LState, idx int, kind string) JobOptions {
+	opts := JobOptions{
+		CatchUp:       catchUpOnce,
+		Overlap:       overlapAllow,
+		RetryDelay:    time.Second,
+		MaxRetryDelay: time.Minute,
+	}
+	if kind == jobInterval {
+		opts.Overlap = overlapSkip
+	}
+
+	tbl := L.OptTable(idx, nil)
+	if tbl == nil {
+		return opts
+	}
+
+	if v, ok := tbl.RawGetString("name").(lua.LString); ok {
+		opts.Name = string(v)
+	}
+	if v, ok := tbl.RawGetString("persist").(lua.LBool); ok {
+		opts.Persist = bool(v)
+	}
+	if opts.Persist && opts.Name == "" {
+		L.ArgError(idx, "persisted jobs require a name")
+	}
+	if v, ok := tbl.RawGetString("catch_up").(lua.LString); ok {
+		switch string(v) {
+		case catchUpOnce, catchUpAll, catchUpSkip:
+			opts.CatchUp = string(v)
+		default:
+			L.ArgError(idx, fmt.Sprintf("invalid catch_up policy %q", string(v)))
+		}
+	}
+	if v, ok := tbl.RawGetString("timezone").(lua.LString); ok {
+		opts.Timezone = string(v)
+	}
+	if v, ok := tbl.RawGetString("overlap").(lua.LString); ok {
+		switch string(v) {
+		case overlapAllow, overlapSkip, overlapQueue:
+			opts.Overlap = string(v)
+		default:
+			L.ArgError(idx, fmt.Sprintf("invalid overlap policy %q", string(v)))
+		}
+	}
+	if v, ok := tbl.RawGetString("retries").(lua.LNumber); ok {
+		opts.Retries = int(v)
+	}
+	if v, ok := tbl.RawGetString("retry_delay").(lua.LNumber); ok {
+		opts.RetryDelay = secondsToDuration(v)
+	}
+	if v, ok := tbl.RawGetString("max_retry_delay").(lua.LNumber); ok {
+		opts.MaxRetryDelay = secondsToDuration(v)
+	}
+	if v, ok := tbl.RawGetString("max_runtime").(lua.LNumber); ok {
+		opts.MaxRuntime = secondsToDuration(v)
+	}
+	if v, ok := tbl.RawGetString("jitter").(lua.LNumber); ok {
+		opts.Jitter = secondsToDuration(v)
+	}
+	if v, ok := tbl.RawGetString("on_run").(*lua.LFunction); ok {
+		opts.OnRun = v
+	}
+	if v, ok := tbl.RawGetString("args").(*lua.LTable); ok {
+		for i := 1; i <= v.Len(); i++ {
+			opts.Args = append(opts.Args, v.RawGetInt(i))
+		}
+	}
+	if v, ok := tbl.RawGetString("mode").(lua.LString); ok {
+		switch string(v) {
+		case CallbackIsolated, CallbackMain:
+			opts.Mode = string(v)
+		default:
+			L.ArgError(idx, fmt.Sprintf("invalid callback mode %q", string(v)))
+		}
+	}
+
+	return opts
+}
+
+func (sm *SchedulerModule) trigger(job *Job, label string) {
+	run := &jobRun{
+		label:       label,
+		scheduledAt: sm.vm.clock.Now(),
+	}
 
-	if ticker, exists := sm.intervals[id]; exists {
-		ticker.Stop()
-		delete(sm.intervals, id)
+	job.mu.Lock()
+	if job.cancelled {
+		job.mu.Unlock()
+		return
+	}
+	switch job.Options.Overlap {
+	case overlapSkip:
+		if job.running {
+			job.skipCount++
+			job.mu.Unlock()
+			run.skipped = true
+			sm.notifyRun(job, run)
+			return
+		}
+	case overlapQueue:
+		if job.running {
+			job.queued = append(job.queued, run)
+			job.mu.Unlock()
+			return
+		}
 	}
+	job.running = true
+	job.mu.Unlock()
+
+	sm.startRun(job, run)
 }
 
-func (sm *SchedulerModule) ClearTimeout(id int) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+func (sm *SchedulerModule) startRun(job *Job, run *jobRun) {
+	if job.Options.Jitter > 0 {
+		jitter := time.Duration(rand.Int63n(int64(job.Options.Jitter)))
+		sm.afterJob(job, jitter, func() {
+			sm.attemptRun(job, run)
+		})
+		return
+	}
+	sm.attemptRun(job, run)
+}
+
+func (sm *SchedulerModule) attemptRun(job *Job, run *jobRun) {
+	if run.startedAt.IsZero() {
+		run.startedAt = sm.vm.clock.Now()
+	}
 
-	if timer, exists := sm.timeouts[id]; exists {
-		timer.Stop()
-		delete(sm.timeouts, id)
+	run.attempts++
+	run.err = sm.callJob(job)
+	if run.err != nil && run.attempts <= job.Options.Retries {
+		sm.afterJob(job, job.Options.retryBackoff(run.attempts), func() {
+			sm.attemptRun(job, run)
+		})
+		return
 	}
+
+	sm.finishRun(job, run)
 }
 
-func (sm *SchedulerModule) ClearCron(id int) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+func (sm *SchedulerModule) finishRun(job *Job, run *jobRun) {
+	run.finishedAt = sm.vm.clock.Now()
+
+	job.mu.Lock()
+	job.lastRun = run.startedAt
+	job.runCount++
+	job.lastError = run.err
+	job.mu.Unlock()
+
+	if job.Kind == jobTimeout {
+		sm.finishTimeout(job)
+	} else {
+		sm.persistJob(job)
+	}
 
-	if entryID, exists := sm.crons[id]; exists {
-		sm.cron.Remove(entryID)
-		delete(sm.crons, id)
+	if run.err != nil {
+		sm.vm.monitor.handleError(fmt.Errorf("%s function error: %v", run.label, run.err))
+	}
+	sm.notifyRun(job, run)
+
+	job.mu.Lock()
+	var next *jobRun
+	if len(job.queued) > 0 && !job.cancelled {
+		next = job.queued[0]
+		job.queued = job.queued[1:]
+	} else {
+		job.running = false
+	}
+	job.mu.Unlock()
+
+	if next != nil {
+		sm.startRun(job, next)
 	}
 }
 
-func (sm *SchedulerModule) Close() {
+func (sm *SchedulerModule) afterJob(job *Job, d time.Duration, f func()) {
+	sm.vm.clock.AfterFunc(d, func() {
+		job.mu.Lock()
+		cancelled := job.cancelled
+		job.mu.Unlock()
+
+		if !cancelled {
+			f()
+		}
+	})
+}
+
+func (sm *SchedulerModule) callJob(job *Job) error {
+	if job.Options.MaxRuntime <= 0 {
+		return job.callback.Call(nil, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), job.Options.MaxRuntime)
+	defer cancel()
+
+	err := job.callback.Call(ctx, nil)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("job exceeded max runtime of %s", job.Options.MaxRuntime)
+	}
+	return err
+}
+
+func (sm *SchedulerModule) notifyRun(job *Job, run *jobRun) {
+	if job.onRun == nil {
+		return
+	}
+
+	err := job.onRun.Call(nil, func(L *lua.LState) []lua.LValue {
+		meta := L.NewTable()
+		meta.RawSetString("job_id", lua.LNumber(job.ID))
+		meta.RawSetString("kind", lua.LString(job.Kind))
+		meta.RawSetString("scheduled_at", timeToLua(run.scheduledAt))
+		meta.RawSetString("skipped", lua.LBool(run.skipped))
+		if !run.skipped {
+			meta.RawSetString("started_at", timeToLua(run.startedAt))
+			meta.RawSetString("finished_at", timeToLua(run.finishedAt))
+			meta.RawSetString("duration", lua.LNumber(run.finishedAt.Sub(run.startedAt).Seconds()))
+			meta.RawSetString("attempts", lua.LNumber(run.attempts))
+			meta.RawSetString("success", lua.LBool(run.err == nil))
+			if run.err != nil {
+				meta.RawSetString("error", lua.LString(run.err.Error()))
+			}
+		}
+		return []lua.LValue{meta}
+	})
+	if err != nil {
+		sm.vm.monitor.handleError(fmt.Errorf("Job on_run callback error: %v", err))
+	}
+}
+
+func (opts JobOptions) retryBackoff(attempt int) time.Duration {
+	delay := opts.RetryDelay
+	for i := 1; i < attempt && (opts.MaxRetryDelay <= 0 || delay < opts.MaxRetryDelay); i++ {
+		delay *= 2
+	}
+	if opts.MaxRetryDelay > 0 && delay > opts.MaxRetryDelay {
+		delay = opts.MaxRetryDelay
+	}
+	return delay
+}
+
+func secondsToDuration(seconds lua.LNumber) time.Duration {
+	return time.Duration(float64(seconds) * float64(time.Second))
+}
+
+func (sm *SchedulerModule) removeJob(job *Job) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	for _, ticker := range sm.intervals {
-		ticker.Stop()
+	delete(sm.jobs, job.ID)
+	if job.Name != "" && sm.names[job.Name] == job.ID {
+		delete(sm.names, job.Name)
+	}
+}
+
+func (sm *SchedulerModule) cancelJob(id int, forget bool) bool {
+	sm.mu.RLock()
+	job, exists := sm.jobs[id]
+	sm.mu.RUnlock()
+
+	if !exists {
+		return false
+	}
+	sm.removeJob(job)
+
+	job.mu.Lock()
+	if job.cancelled {
+		job.mu.Unlock()
+		return false
+	}
+	job.cancelled = true
+	job.queued = nil
+	if job.timer != nil {
+		job.timer.Stop()
+	}
+	job.mu.Unlock()
+
+	if forget && job.Options.Persist {
+		sm.forgetJob(job)
+	}
+	return true
+}
+
+func (sm *SchedulerModule) pauseJob(job *Job) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if job.paused || job.cancelled {
+		return
+	}
+	job.paused = true
+
+	// A timeout whose timer has already fired is running or about to, and
+	// must not be armed again on resume.
+	if job.Kind == jobTimeout && job.timer != nil && !job.fired {
+		if !job.timer.Stop() {
+			job.fired = true
+			return
+		}
+		job.remaining = job.nextRun.Sub(sm.vm.clock.Now())
+		if job.remaining < 0 {
+			job.remaining = 0
+		}
+	}
+}
+
+func (sm *SchedulerModule) resumeJob(job *Job) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if !job.paused || job.cancelled {
+		return
+	}
+	job.paused = false
+
+	if job.Kind == jobTimeout && !job.fired {
+		sm.armTimeout(job, job.remaining)
+	}
+}
+
+func (sm *SchedulerModule) jobNextRun(job *Job) time.Time {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if job.cancelled {
+		return time.Time{}
+	}
+	if job.paused && job.Kind == jobTimeout {
+		return time.Time{}
+	}
+	return job.nextRun
+}
+
+func (sm *SchedulerModule) jobTable(L *lua.LState, job *Job) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("id", lua.LNumber(job.ID))
+	tbl.RawSetString("kind", lua.LString(job.Kind))
+	if job.Name != "" {
+		tbl.RawSetString("name", lua.LString(job.Name))
+	}
+	if job.Schedule != "" {
+		tbl.RawSetString("schedule", lua.LString(job.Schedule))
+	}
+	if job.Options.Timezone != "" {
+		tbl.RawSetString("timezone", lua.LString(job.Options.Timezone))
+	}
+
+	tbl.RawSetString("cancel", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(sm.cancelJob(job.ID, true)))
+		return 1
+	}))
+
+	tbl.RawSetString("pause", L.NewFunction(func(L *lua.LState) int {
+		sm.pauseJob(job)
+		return 0
+	}))
+
+	tbl.RawSetString("resume", L.NewFunction(func(L *lua.LState) int {
+		sm.resumeJob(job)
+		return 0
+	}))
+
+	tbl.RawSetString("next_run", L.NewFunction(func(L *lua.LState) int {
+		L.Push(timeToLua(sm.jobNextRun(job)))
+		return 1
+	}))
+
+	tbl.RawSetString("last_run", L.NewFunction(func(L *lua.LState) int {
+		job.mu.Lock()
+		lastRun := job.lastRun
+		job.mu.Unlock()
+		L.Push(timeToLua(lastRun))
+		return 1
+	}))
+
+	tbl.RawSetString("run_count", L.NewFunction(func(L *lua.LState) int {
+		job.mu.Lock()
+		count := job.runCount
+		job.mu.Unlock()
+		L.Push(lua.LNumber(count))
+		return 1
+	}))
+
+	tbl.RawSetString("skip_count", L.NewFunction(func(L *lua.LState) int {
+		job.mu.Lock()
+		count := job.skipCount
+		job.mu.Unlock()
+		L.Push(lua.LNumber(count))
+		return 1
+	}))
+
+	tbl.RawSetString("last_error", L.NewFunction(func(L *lua.LState) int {
+		job.mu.Lock()
+		err := job.lastError
+		job.mu.Unlock()
+		if err == nil {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LString(err.Error()))
+		}
+		return 1
+	}))
+
+	return tbl
+}
+
+func (sm *SchedulerModule) list(L *lua.LState) int {
+	sm.mu.RLock()
+	jobs := make([]*Job, 0, len(sm.jobs))
+	for _, job := range sm.jobs {
+		jobs = append(jobs, job)
 	}
-	for _, timer := range sm.timeouts {
-		timer.Stop()
+	sm.mu.RUnlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+
+	result := L.NewTable()
+	for _, job := range jobs {
+		result.Append(sm.jobTable(L, job))
 	}
-	for _, entryID := range sm.crons {
-		sm.cron.Remove(entryID)
+
+	L.Push(result)
+	return 1
+}
+
+func timeToLua(t time.Time) lua.LValue {
+	if t.IsZero() {
+		return lua.LNil
 	}
+	return lua.LNumber(float64(t.UnixNano()) / float64(time.Second))
+}
+
+func (sm *SchedulerModule) ClearInterval(id int) {
+	sm.cancelJob(id, true)
+}
+
+func (sm *SchedulerModule) ClearTimeout(id int) {
+	sm.cancelJob(id, true)
+}
 
-	sm.cron.Stop()
-	sm.intervals = nil
-	sm.timeouts = nil
-	sm.crons = nil
+func (sm *SchedulerModule) ClearCron(id int) {
+	sm.cancelJob(id, true)
+}
+
+func (sm *SchedulerModule) Close() {
+	sm.mu.RLock()
+	ids := make([]int, 0, len(sm.jobs))
+	for id := range sm.jobs {
+		ids = append(ids, id)
+	}
+	sm.mu.RUnlock()
+
+	for _, id := range ids {
+		sm.cancelJob(id, false)
+	}
 }
@@ -0,0 +1,247 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestSchedulerIntervalAndTimeout(t *testing.T) {
+	v := newTestVM(t, Config{FakeClock: true, CallbackMode: CallbackMain})
+	runLuaWithin(t, v, 5*time.Second, `
+		local ticks, fired = 0, 0
+		local interval = set_interval(function() ticks = ticks + 1 end, 1)
+		set_timeout(function() fired = fired + 1 end, 2.5)
+
+		clock.advance(0.5)
+		assert(ticks == 0 and fired == 0)
+		clock.advance(2.5)
+		assert(ticks == 3, "ticks " .. ticks)
+		assert(fired == 1)
+		assert(interval:run_count() == 3)
+
+		clock.advance(10)
+		assert(ticks == 13 and fired == 1)
+
+		assert(interval:cancel())
+		clock.advance(5)
+		assert(ticks == 13)
+	`)
+}
+
+func TestSchedulerPauseResume(t *testing.T) {
+	v := newTestVM(t, Config{FakeClock: true, CallbackMode: CallbackMain})
+	runLuaWithin(t, v, 5*time.Second, `
+		local ticks, fired = 0, 0
+		local interval = set_interval(function() ticks = ticks + 1 end, 1)
+		local timeout = set_timeout(function() fired = fired + 1 end, 3)
+
+		clock.advance(1)
+		interval:pause()
+		timeout:pause()
+		clock.advance(5)
+		assert(ticks == 1, "paused interval ran: " .. ticks)
+		assert(fired == 0, "paused timeout ran")
+
+		interval:resume()
+		timeout:resume()
+		clock.advance(1.5)
+		assert(ticks == 2, "ticks " .. ticks)
+		assert(fired == 0, "timeout ran before its remaining delay")
+		clock.advance(0.5)
+		assert(fired == 1)
+	`)
+}
+
+// A timeout paused while its callback runs has already fired; resuming it
+// must not run it again.
+func TestSchedulerTimeoutPausedWhileRunning(t *testing.T) {
+	v := newTestVM(t, Config{FakeClock: true, CallbackMode: CallbackMain})
+	runLuaWithin(t, v, 5*time.Second, `
+		local runs = 0
+		local job
+		job = set_timeout(function()
+			runs = runs + 1
+			job:pause()
+			job:resume()
+		end, 1)
+
+		clock.advance(1)
+		clock.advance(5)
+		assert(runs == 1, "timeout ran " .. runs .. " times")
+	`)
+}
+
+// jobLog is a file a job appends lines to. Job functions run on other
+// states, so the script names it with a literal rather than an upvalue.
+type jobLog string
+
+func newJobLog(t *testing.T) jobLog {
+	return jobLog(filepath.Join(t.TempDir(), "job.log"))
+}
+
+// appendLine returns a Lua statement appending expr to the log.
+func (l jobLog) appendLine(expr string) string {
+	return fmt.Sprintf(`local f = io.open(%q, "a"); f:write(tostring(%s), "\n"); f:close()`, string(l), expr)
+}
+
+// count returns a Lua expression for the number of lines in the log.
+func (l jobLog) count() string {
+	return fmt.Sprintf(`(function() local n, f = 0, io.open(%q); if f then for _ in f:lines() do n = n + 1 end f:close() end return n end)()`, string(l))
+}
+
+func (l jobLog) lines() []string {
+	data, _ := os.ReadFile(string(l))
+	return strings.Fields(string(data))
+}
+
+// waitForFile is a Lua statement that keeps a job running until the test
+// creates path.
+func waitForFile(path string) string {
+	return fmt.Sprintf(`local f; repeat f = io.open(%q) until f; f:close()`, path)
+}
+
+func TestSchedulerRetries(t *testing.T) {
+	v := newTestVM(t, Config{})
+	attempts, runs := newJobLog(t), newJobLog(t)
+	onRun := fmt.Sprintf(`function(meta) %s end`,
+		runs.appendLine(`meta.attempts .. ":" .. tostring(meta.success)`))
+	runLua(t, v, fmt.Sprintf(`
+		flaky = set_timeout(function()
+			%s
+			if %s < 3 then error("not yet") end
+		end, 0, { retries = 3, retry_delay = 0.01, on_run = %s })
+	`, attempts.appendLine(`"try"`), attempts.count(), onRun))
+
+	waitFor(t, "the flaky job", func() bool { return len(runs.lines()) == 1 })
+	if got := runs.lines()[0]; got != "3:true" {
+		t.Fatalf("flaky job: %s, want 3 attempts and success", got)
+	}
+	if n := evalLua(t, v, "flaky:run_count()"); n != lua.LNumber(1) {
+		t.Fatalf("run_count %v, want retries to count as one run", n)
+	}
+	if err := evalLua(t, v, "flaky:last_error()"); err != lua.LNil {
+		t.Fatalf("last_error %v after a successful retry", err)
+	}
+
+	failing := newJobLog(t)
+	runLua(t, v, fmt.Sprintf(`
+		failing = set_timeout(function() error("always") end, 0, {
+			retries = 2, retry_delay = 0.01,
+			on_run = function(meta) %s end,
+		})
+	`, failing.appendLine(`meta.attempts .. ":" .. tostring(meta.success)`)))
+	waitFor(t, "the failing job", func() bool { return len(failing.lines()) == 1 })
+	if got := failing.lines()[0]; got != "3:false" {
+		t.Fatalf("failing job: %s, want 3 attempts and failure", got)
+	}
+	if err := evalLua(t, v, "failing:last_error()").String(); !strings.Contains(err, "always") {
+		t.Fatalf("last_error %q", err)
+	}
+}
+
+func TestJobRetryBackoff(t *testing.T) {
+	tests := []struct {
+		delay, max time.Duration
+		attempt    int
+		want       time.Duration
+	}{
+		{time.Second, time.Minute, 1, time.Second},
+		{time.Second, time.Minute, 2, 2 * time.Second},
+		{time.Second, time.Minute, 4, 8 * time.Second},
+		{time.Second, 3 * time.Second, 4, 3 * time.Second},
+		{time.Second, time.Minute, 30, time.Minute},
+		// Without a cap the delay keeps doubling.
+		{time.Second, 0, 4, 8 * time.Second},
+		{2 * time.Second, 0, 11, 2048 * time.Second},
+	}
+	for _, tt := range tests {
+		opts := JobOptions{RetryDelay: tt.delay, MaxRetryDelay: tt.max}
+		if got := opts.retryBackoff(tt.attempt); got != tt.want {
+			t.Errorf("delay %v, max %v, attempt %d: %v, want %v", tt.delay, tt.max, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	v := newTestVM(t, Config{})
+	release := filepath.Join(t.TempDir(), "release")
+	skipped, queued := newJobLog(t), newJobLog(t)
+	runLua(t, v, fmt.Sprintf(`
+		skipping = cron("* * * * * *", function() %s; %s end, { overlap = "skip" })
+		queueing = cron("* * * * * *", function() %s; %s; %s end, { overlap = "queue" })
+	`, skipped.appendLine(`"run"`), waitForFile(release),
+		queued.appendLine(`"start"`), waitForFile(release), queued.appendLine(`"end"`)))
+	t.Cleanup(func() { runLua(t, v, `skipping:cancel(); queueing:cancel()`) })
+
+	waitFor(t, "skipped ticks", func() bool {
+		return evalLua(t, v, "skipping:skip_count()").(lua.LNumber) >= 1
+	})
+	if runs := skipped.lines(); len(runs) != 1 {
+		t.Fatalf("%d runs started while the first was running", len(runs))
+	}
+	if runs := queued.lines(); len(runs) != 1 {
+		t.Fatalf("queued runs did not wait for the running one: %v", runs)
+	}
+
+	if err := os.WriteFile(release, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "queued runs", func() bool { return len(queued.lines()) >= 4 })
+	lines := queued.lines()
+	for i, line := range lines[:4] {
+		if want := []string{"start", "end"}[i%2]; line != want {
+			t.Fatalf("queued runs overlapped: %v", lines)
+		}
+	}
+}
+
+func TestSchedulerMaxRuntime(t *testing.T) {
+	v := newTestVM(t, Config{})
+	runLua(t, v, `
+		stuck = set_timeout(function() while true do end end, 0, { max_runtime = 0.05 })
+	`)
+	waitFor(t, "the job to be stopped", func() bool {
+		return evalLua(t, v, "stuck:run_count()") == lua.LNumber(1)
+	})
+	if err := evalLua(t, v, "stuck:last_error()").String(); !strings.Contains(err, "exceeded max runtime") {
+		t.Fatalf("last_error %q", err)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	v := newTestVM(t, Config{})
+	delays := newJobLog(t)
+	runLua(t, v, fmt.Sprintf(`
+		for i = 1, 20 do
+			set_timeout(function() end, 0, {
+				jitter = 0.1,
+				on_run = function(meta) %s end,
+			})
+		end
+	`, delays.appendLine(`meta.started_at - meta.scheduled_at`)))
+
+	waitFor(t, "the jittered jobs", func() bool { return len(delays.lines()) == 20 })
+	var longest float64
+	for _, line := range delays.lines() {
+		d, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d < 0 || d > 0.2 {
+			t.Fatalf("run started %gs after it was due, want within the 0.1s jitter", d)
+		}
+		if d > longest {
+			longest = d
+		}
+	}
+	if longest < 0.01 {
+		t.Fatalf("20 runs were all delayed less than 10ms; jitter is not applied")
+	}
+}
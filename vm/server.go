@@ -3,41 +3,62 @@ package vm
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
-	"regexp"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/gorilla/websocket"
 	lua "github.com/yuin/gopher-lua"
 )
 
-type Route struct {
-	pattern    *regexp.Regexp
-	handler    *lua.LFunction
-	middleware []*lua.LFunction
+type ServerModule struct {
+	vm      *SolVM
+	servers map[string]*httpServer
+	mu      sync.RWMutex
 }
 
-type ServerModule struct {
-	vm       *SolVM
-	servers  map[string]*http.Server
-	mu       sync.RWMutex
-	upgrader websocket.Upgrader
-	routes   map[string]map[string]*Route
+// httpServer is a server created with create_server. Requests are dispatched
+// by its router; middleware registered with use_middleware is kept per route
+// pattern so it applies no matter which was registered first.
+type httpServer struct {
+	id          string
+	server      *http.Server
+	router      *Router
+	root        *routeGroup
+	maxBodySize int64
+	hub         *wsHub
+	legacyMu    sync.RWMutex
+	legacy      map[string][]Middleware
+	unixSocket  string
+	certs       *certCache
+	stopMu      sync.Mutex
+	stopHooks   []func() error
+}
+
+// onStop registers hook to run when the server stops.
+func (srv *httpServer) onStop(hook func() error) {
+	srv.stopMu.Lock()
+	srv.stopHooks = append(srv.stopHooks, hook)
+	srv.stopMu.Unlock()
+}
+
+// routeGroup shares a path prefix and middleware between routes. The server
+// itself is the root group.
+type routeGroup struct {
+	srv        *httpServer
+	parent     *routeGroup
+	prefix     string
+	mu         sync.RWMutex
+	middleware []Middleware
 }
 
 func NewServerModule(vm *SolVM) *ServerModule {
 	return &ServerModule{
 		vm:      vm,
-		servers: make(map[string]*http.Server),
-		routes:  make(map[string]map[string]*Route),
-		upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
+		servers: make(map[string]*httpServer),
 	}
 }
 
@@ -48,300 +69,495 @@ func (sm *ServerModule) Register() {
 	sm.vm.RegisterFunction("handle_http", sm.handleHTTP)
 	sm.vm.RegisterFunction("handle_ws", sm.handleWebSocket)
 	sm.vm.RegisterFunction("use_middleware", sm.useMiddleware)
+	sm.vm.RegisterFunction("serve_static", sm.serveStatic)
+	sm.vm.RegisterFunction("handle_sse", sm.handleSSE)
+	sm.vm.RegisterFunction("ws_broadcast", sm.wsBroadcast)
+	sm.vm.RegisterTable("middleware", sm.middlewareFunctions())
 }
 
-func (sm *ServerModule) useMiddleware(L *lua.LState) int {
-	serverID := L.CheckString(1)
-	path := L.CheckString(2)
-	middleware := L.CheckFunction(3)
-
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+func (sm *ServerModule) server(L *lua.LState, serverID string) *httpServer {
+	sm.mu.RLock()
+	srv, exists := sm.servers[serverID]
+	sm.mu.RUnlock()
 
-	if _, exists := sm.routes[serverID]; !exists {
-		sm.routes[serverID] = make(map[string]*Route)
+	if !exists {
+		L.RaiseError("Server %s does not exist", serverID)
 	}
+	return srv
+}
 
-	route, exists := sm.routes[serverID][path]
-	if !exists {
-		route = &Route{
-			pattern:    regexp.MustCompile("^" + strings.ReplaceAll(path, ":param", "([^/]+)") + "$"),
-			middleware: make([]*lua.LFunction, 0),
-		}
-		sm.routes[serverID][path] = route
+// legacyPattern converts a handle_http path to a router pattern. Paths ending
+// in a slash used to match their whole subtree, as with http.ServeMux.
+func legacyPattern(path string) string {
+	if strings.HasSuffix(path, "/") {
+		return path + "*path"
 	}
+	return path
+}
+
+func (sm *ServerModule) useMiddleware(L *lua.LState) int {
+	srv := sm.server(L, L.CheckString(1))
+	pattern := legacyPattern(L.CheckString(2))
+	middleware := sm.middlewareArg(L, 3, srv)
 
-	route.middleware = append(route.middleware, middleware)
+	srv.legacyMu.Lock()
+	srv.legacy[pattern] = append(srv.legacy[pattern], middleware)
+	srv.legacyMu.Unlock()
 	return 0
 }
 
+// createServer accepts either the positional (id, port, https, cert, key)
+// form or (id, port, options) with https, cert, key and max_body_size.
 func (sm *ServerModule) createServer(L *lua.LState) int {
 	serverID := L.CheckString(1)
 	port := L.CheckInt(2)
-	isHTTPS := L.OptBool(3, false)
 
-	mux := http.NewServeMux()
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+	srv := &httpServer{
+		id:          serverID,
+		router:      NewRouter(),
+		maxBodySize: defaultMaxBodySize,
+		hub:         newWSHub(),
+		legacy:      make(map[string][]Middleware),
 	}
 
-	if isHTTPS {
-		certFile := L.CheckString(4)
-		keyFile := L.CheckString(5)
+	srv.root = &routeGroup{srv: srv}
+	srv.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: srv,
+	}
 
-		config := &tls.Config{
-			MinVersion: tls.VersionTLS12,
+	var isHTTPS bool
+	var certFile, keyFile string
+	if opts, ok := L.Get(3).(*lua.LTable); ok {
+		certFile = lua.LVAsString(opts.RawGetString("cert"))
+		keyFile = lua.LVAsString(opts.RawGetString("key"))
+		isHTTPS = lua.LVAsBool(opts.RawGetString("https")) || certFile != ""
+		if isHTTPS && (certFile == "" || keyFile == "") {
+			L.ArgError(3, "https requires cert and key")
 		}
-		server.TLSConfig = config
-
-		server.TLSConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-			if err != nil {
-				return nil, fmt.Errorf("failed to load certificate: %v", err)
+		switch v := opts.RawGetString("max_body_size").(type) {
+		case lua.LNumber:
+			if v <= 0 {
+				L.ArgError(3, "max_body_size must be positive")
 			}
-			return &cert, nil
+			srv.maxBodySize = int64(v)
+		case *lua.LNilType:
+		default:
+			L.ArgError(3, "max_body_size must be a number")
+		}
+		if err := configureServer(srv, port, opts); err != nil {
+			L.ArgError(3, err.Error())
+		}
+	} else if isHTTPS = L.OptBool(3, false); isHTTPS {
+		certFile = L.CheckString(4)
+		keyFile = L.CheckString(5)
+	}
+
+	if isHTTPS {
+		certs, err := newCertCache(sm.vm.clock, certFile, keyFile, func(err error) {
+			sm.vm.monitor.handleError(fmt.Errorf("Server %s: %v", serverID, err))
+		})
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		srv.certs = certs
+		srv.server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
 		}
 	}
 
 	sm.mu.Lock()
-	sm.servers[serverID] = server
+	sm.servers[serverID] = srv
 	sm.mu.Unlock()
 
-	return 0
+	L.Push(sm.serverTable(L, srv))
+	return 1
 }
 
-func (sm *ServerModule) startServer(L *lua.LState) int {
-	serverID := L.CheckString(1)
+// configureServer applies the listening and connection options of
+// create_server. Timeouts are in seconds; 0 means none.
+func configureServer(srv *httpServer, port int, opts *lua.LTable) error {
+	if v, ok := opts.RawGetString("host").(lua.LString); ok {
+		srv.server.Addr = net.JoinHostPort(strings.Trim(string(v), "[]"), strconv.Itoa(port))
+	}
+	srv.unixSocket = lua.LVAsString(opts.RawGetString("unix_socket"))
+
+	for name, target := range map[string]*time.Duration{
+		"read_timeout":        &srv.server.ReadTimeout,
+		"read_header_timeout": &srv.server.ReadHeaderTimeout,
+		"write_timeout":       &srv.server.WriteTimeout,
+		"idle_timeout":        &srv.server.IdleTimeout,
+	} {
+		switch v := opts.RawGetString(name).(type) {
+		case lua.LNumber:
+			if v < 0 {
+				return fmt.Errorf("%s must not be negative", name)
+			}
+			*target = secondsToDuration(v)
+		case *lua.LNilType:
+		default:
+			return fmt.Errorf("%s must be a number", name)
+		}
+	}
 
-	sm.mu.RLock()
-	server, exists := sm.servers[serverID]
-	sm.mu.RUnlock()
+	switch v := opts.RawGetString("max_header_bytes").(type) {
+	case lua.LNumber:
+		if v <= 0 {
+			return fmt.Errorf("max_header_bytes must be positive")
+		}
+		srv.server.MaxHeaderBytes = int(v)
+	case *lua.LNilType:
+	default:
+		return fmt.Errorf("max_header_bytes must be a number")
+	}
 
-	if !exists {
-		L.RaiseError("Server %s does not exist", serverID)
-		return 0
+	if v, ok := opts.RawGetString("keep_alive").(lua.LBool); ok {
+		srv.server.SetKeepAlivesEnabled(bool(v))
 	}
+	if opts.RawGetString("http2") == lua.LFalse {
+		// A non-nil, empty map turns off the server's automatic HTTP/2.
+		srv.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return nil
+}
 
+func (sm *ServerModule) startServer(L *lua.LState) int {
+	sm.start(sm.server(L, L.CheckString(1)))
+	return 0
+}
+
+func (sm *ServerModule) start(srv *httpServer) {
 	go func() {
-		var err error
-		if server.TLSConfig != nil {
-			err = server.ListenAndServeTLS("", "")
-		} else {
-			err = server.ListenAndServe()
+		listener, err := srv.listen()
+		if err == nil {
+			if srv.server.TLSConfig != nil {
+				err = srv.server.ServeTLS(listener, "", "")
+			} else {
+				err = srv.server.Serve(listener)
+			}
 		}
 		if err != nil && err != http.ErrServerClosed {
-			sm.vm.monitor.handleError(fmt.Errorf("Server %s error: %v", serverID, err))
+			sm.vm.monitor.handleError(fmt.Errorf("Server %s error: %v", srv.id, err))
 		}
 	}()
+}
 
-	return 0
+// listen opens the server's TCP address, or its Unix socket. A socket file
+// left behind by a server that did not shut down cleanly is replaced.
+func (srv *httpServer) listen() (net.Listener, error) {
+	if srv.unixSocket == "" {
+		return net.Listen("tcp", srv.server.Addr)
+	}
+	if info, err := os.Lstat(srv.unixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", srv.unixSocket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", srv.unixSocket)
+		}
+		os.Remove(srv.unixSocket)
+	}
+	return net.Listen("unix", srv.unixSocket)
+}
+
+func (sm *ServerModule) hasServers() bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return len(sm.servers) > 0
 }
 
 func (sm *ServerModule) stopServer(L *lua.LState) int {
-	serverID := L.CheckString(1)
+	sm.stop(L.CheckString(1))
+	return 0
+}
 
+func (sm *ServerModule) stop(serverID string) {
 	sm.mu.Lock()
-	server, exists := sm.servers[serverID]
+	srv, exists := sm.servers[serverID]
 	if exists {
 		delete(sm.servers, serverID)
 	}
 	sm.mu.Unlock()
 
 	if exists {
-		if err := server.Close(); err != nil {
+		if err := srv.server.Close(); err != nil {
 			sm.vm.monitor.handleError(fmt.Errorf("Error stopping server %s: %v", serverID, err))
 		}
+		srv.stopMu.Lock()
+		hooks := srv.stopHooks
+		srv.stopHooks = nil
+		srv.stopMu.Unlock()
+		for _, hook := range hooks {
+			if err := hook(); err != nil {
+				sm.vm.monitor.handleError(fmt.Errorf("Error stopping server %s: %v", serverID, err))
+			}
+		}
 	}
-
-	return 0
 }
 
 func (sm *ServerModule) handleHTTP(L *lua.LState) int {
-	serverID := L.CheckString(1)
-	path := L.CheckString(2)
-	handler := L.CheckFunction(3)
-
-	sm.mu.Lock()
-	if _, exists := sm.routes[serverID]; !exists {
-		sm.routes[serverID] = make(map[string]*Route)
-	}
-
-	route := &Route{
-		pattern:    regexp.MustCompile("^" + strings.ReplaceAll(path, ":param", "([^/]+)") + "$"),
-		handler:    handler,
-		middleware: make([]*lua.LFunction, 0),
-	}
-	sm.routes[serverID][path] = route
-	sm.mu.Unlock()
+	srv := sm.server(L, L.CheckString(1))
+	pattern := legacyPattern(L.CheckString(2))
+	handler := sm.vm.NewCallback(L, L.CheckFunction(3), nil, "")
 
-	sm.mu.RLock()
-	server, exists := sm.servers[serverID]
-	sm.mu.RUnlock()
+	srv.router.Handle("", pattern, sm.luaRoute(srv.root, pattern, handler))
+	return 0
+}
 
-	if !exists {
-		L.RaiseError("Server %s does not exist", serverID)
-		return 0
+// chain returns the middleware of the groups between the server and g. The
+// server's own middleware is not included: it wraps the router, so it also
+// runs for requests that match no route.
+func (g *routeGroup) chain() []Middleware {
+	var chain []Middleware
+	for group := g; group != nil && group.parent != nil; group = group.parent {
+		group.mu.RLock()
+		chain = append(append([]Middleware{}, group.middleware...), chain...)
+		group.mu.RUnlock()
 	}
+	return chain
+}
 
-	mux := server.Handler.(*http.ServeMux)
-	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if err := recover(); err != nil {
-				sm.vm.monitor.handleError(fmt.Errorf("HTTP handler panic: %v", err))
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			}
-		}()
-
-		L2 := lua.NewState()
-		defer L2.Close()
-
-		req := L2.NewTable()
-		req.RawSetString("method", lua.LString(r.Method))
-		req.RawSetString("path", lua.LString(r.URL.Path))
-		req.RawSetString("query", lua.LString(r.URL.RawQuery))
+// route wraps the handler of a route registered on group with the group
+// middleware and the use_middleware functions of its pattern.
+func (sm *ServerModule) route(group *routeGroup, pattern string, final http.HandlerFunc) routeHandler {
+	return func(w http.ResponseWriter, r *http.Request, params []routeParam) {
+		srv := group.srv
+		r, state := ensureRequestState(r, srv)
+		state.setParams(params)
 
-		headers := L2.NewTable()
-		for key, values := range r.Header {
-			if len(values) > 0 {
-				headers.RawSetString(key, lua.LString(values[0]))
-			}
-		}
-		req.RawSetString("headers", headers)
+		srv.legacyMu.RLock()
+		chain := append(group.chain(), srv.legacy[pattern]...)
+		srv.legacyMu.RUnlock()
 
-		params := L2.NewTable()
-		matches := route.pattern.FindStringSubmatch(r.URL.Path)
-		if len(matches) > 1 {
-			for i, match := range matches[1:] {
-				params.RawSetInt(i+1, lua.LString(match))
-			}
-		}
-		req.RawSetString("params", params)
-
-		for _, middleware := range route.middleware {
-			fn := L2.NewFunctionFromProto(middleware.Proto)
-			L2.Push(fn)
-			L2.Push(req)
-			if err := L2.PCall(1, 1, nil); err != nil {
-				sm.vm.monitor.handleError(fmt.Errorf("Middleware error: %v", err))
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
-			}
+		chainHandler(chain, final).ServeHTTP(w, r)
+	}
+}
 
-			if L2.Get(-1).Type() == lua.LTBool && !L2.Get(-1).(lua.LBool) {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-			L2.Pop(1)
-		}
+func (sm *ServerModule) luaRoute(group *routeGroup, pattern string, handler *Callback) routeHandler {
+	return sm.route(group, pattern, func(w http.ResponseWriter, r *http.Request) {
+		sm.serveLua(w, r, handler)
+	})
+}
 
-		fn := L2.NewFunctionFromProto(handler.Proto)
-		L2.Push(fn)
-		L2.Push(req)
-		if err := L2.PCall(1, 1, nil); err != nil {
-			sm.vm.monitor.handleError(fmt.Errorf("HTTP handler error: %v", err))
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+// serveLua calls a handler with the request and response tables. Once a
+// response has been sent or set on res, whatever the handler returns is
+// ignored.
+func (sm *ServerModule) serveLua(w http.ResponseWriter, r *http.Request, handler *Callback) {
+	sm.withLua(w, r, handler.Mode(), false, func(lr *luaRequest) error {
+		results, err := handler.CallOn(lr.L, 1, lr.req, lr.res)
+		if err != nil {
+			return fmt.Errorf("HTTP handler error: %v", err)
 		}
-
-		resp := L2.Get(-1)
-		if resp.Type() != lua.LTTable {
-			sm.vm.monitor.handleError(fmt.Errorf("Invalid response type from handler: expected table, got %s", resp.Type().String()))
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+		if lr.rw.responded() {
+			return nil
 		}
+		return applyTableResponse(lr.rw, results[0])
+	})
+}
 
-		respTable := resp.(*lua.LTable)
+// ServeHTTP runs the server middleware around the router.
+func (srv *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, _ = ensureRequestState(r, srv)
+	srv.root.mu.RLock()
+	chain := append([]Middleware{}, srv.root.middleware...)
+	srv.root.mu.RUnlock()
+	chainHandler(chain, srv.router).ServeHTTP(w, r)
+}
 
-		status := respTable.RawGetString("status")
-		if status.Type() != lua.LTNumber {
-			sm.vm.monitor.handleError(fmt.Errorf("Invalid status type in response: expected number, got %s", status.Type().String()))
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-		statusCode := int(status.(lua.LNumber))
-		if statusCode < 100 || statusCode > 599 {
-			sm.vm.monitor.handleError(fmt.Errorf("Invalid status code: %d", statusCode))
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+// applyTableResponse sets the response from a {status, headers, body} table
+// returned by a handler. A missing status keeps the one set with res:status
+// (200 unless changed) and a missing body means an empty one; returning
+// nothing sends just the status and the headers set on res. The body is
+// held back until the request's middleware has finished.
+func applyTableResponse(rw *responseWriter, value lua.LValue) error {
+	if value == lua.LNil {
+		return nil
+	}
+	respTable, ok := value.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("Invalid response type from handler: expected table, got %s", value.Type().String())
+	}
 
-		if headers := respTable.RawGetString("headers"); headers.Type() == lua.LTTable {
-			headers.(*lua.LTable).ForEach(func(key, value lua.LValue) {
-				if key.Type() == lua.LTString && value.Type() == lua.LTString {
-					w.Header().Set(key.String(), value.String())
-				}
-			})
-		}
+	statusCode := rw.status
+	switch status := respTable.RawGetString("status").(type) {
+	case lua.LNumber:
+		statusCode = int(status)
+	case *lua.LNilType:
+	default:
+		return fmt.Errorf("Invalid status type in response: expected number, got %s", status.Type().String())
+	}
+	if statusCode < 100 || statusCode > 599 {
+		return fmt.Errorf("Invalid status code: %d", statusCode)
+	}
 
-		body := respTable.RawGetString("body")
-		if body.Type() != lua.LTString {
-			sm.vm.monitor.handleError(fmt.Errorf("Invalid body type in response: expected string, got %s", body.Type().String()))
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+	body := ""
+	switch b := respTable.RawGetString("body").(type) {
+	case lua.LString:
+		body = string(b)
+	case *lua.LNilType:
+	default:
+		return fmt.Errorf("Invalid body type in response: expected string, got %s", b.Type().String())
+	}
 
-		w.WriteHeader(statusCode)
-		if _, err := w.Write([]byte(body.String())); err != nil {
-			sm.vm.monitor.handleError(fmt.Errorf("Failed to write response body: %v", err))
-		}
-	})
+	if headers, ok := respTable.RawGetString("headers").(*lua.LTable); ok {
+		headers.ForEach(func(key, value lua.LValue) {
+			if key.Type() == lua.LTString && value.Type() == lua.LTString {
+				rw.Header().Set(key.String(), value.String())
+			}
+		})
+	}
 
-	return 0
+	if !rw.started() {
+		rw.status = statusCode
+	}
+	rw.setBody([]byte(body))
+	return nil
 }
 
-func (sm *ServerModule) handleWebSocket(L *lua.LState) int {
-	serverID := L.CheckString(1)
-	path := L.CheckString(2)
-	handler := L.CheckFunction(3)
+var routeMethods = map[string]string{
+	"get":     http.MethodGet,
+	"post":    http.MethodPost,
+	"put":     http.MethodPut,
+	"patch":   http.MethodPatch,
+	"delete":  http.MethodDelete,
+	"head":    http.MethodHead,
+	"options": http.MethodOptions,
+	"any":     "",
+}
 
-	sm.mu.RLock()
-	_, exists := sm.servers[serverID]
-	sm.mu.RUnlock()
+// groupTable builds the Lua object for a route group: one registration
+// method per HTTP verb plus route, group, static, sse, ws and use. Methods
+// are called with a colon, so arguments start at index 2.
+func (sm *ServerModule) groupTable(L *lua.LState, group *routeGroup) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("prefix", lua.LString(group.prefix))
+
+	register := func(L *lua.LState, method string, path string, fn *lua.LFunction) {
+		pattern := joinPaths(group.prefix, path)
+		handler := sm.vm.NewCallback(L, fn, nil, "")
+		group.srv.router.Handle(method, pattern, sm.luaRoute(group, pattern, handler))
+	}
 
-	if !exists {
-		L.RaiseError("Server %s does not exist", serverID)
-		return 0
+	for name, method := range routeMethods {
+		method := method
+		tbl.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			register(L, method, L.CheckString(2), L.CheckFunction(3))
+			L.Push(L.Get(1))
+			return 1
+		}))
 	}
 
-	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		conn, err := sm.upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			sm.vm.monitor.handleError(fmt.Errorf("WebSocket upgrade error: %v", err))
-			return
+	tbl.RawSetString("route", L.NewFunction(func(L *lua.LState) int {
+		path := L.CheckString(3)
+		fn := L.CheckFunction(4)
+		switch methods := L.Get(2).(type) {
+		case lua.LString:
+			register(L, string(methods), path, fn)
+		case *lua.LTable:
+			for i := 1; i <= methods.Len(); i++ {
+				register(L, lua.LVAsString(methods.RawGetInt(i)), path, fn)
+			}
+		default:
+			L.ArgError(2, "method must be a string or an array of strings")
+		}
+		L.Push(L.Get(1))
+		return 1
+	}))
+
+	tbl.RawSetString("group", L.NewFunction(func(L *lua.LState) int {
+		child := &routeGroup{
+			srv:    group.srv,
+			parent: group,
+			prefix: joinPaths(group.prefix, L.CheckString(2)),
 		}
-		defer conn.Close()
+		childTable := sm.groupTable(L, child)
+		if fn, ok := L.Get(3).(*lua.LFunction); ok {
+			L.Push(fn)
+			L.Push(childTable)
+			L.Call(1, 0)
+		}
+		L.Push(childTable)
+		return 1
+	}))
+
+	tbl.RawSetString("ws", L.NewFunction(func(L *lua.LState) int {
+		sm.ws(L, group, L.CheckString(2), 3)
+		L.Push(L.Get(1))
+		return 1
+	}))
+
+	tbl.RawSetString("sse", L.NewFunction(func(L *lua.LState) int {
+		sm.sse(L, group, L.CheckString(2), 3)
+		L.Push(L.Get(1))
+		return 1
+	}))
+
+	tbl.RawSetString("static", L.NewFunction(func(L *lua.LState) int {
+		sm.static(L, group, L.CheckString(2), 3)
+		L.Push(L.Get(1))
+		return 1
+	}))
+
+	tbl.RawSetString("use", L.NewFunction(func(L *lua.LState) int {
+		middleware := sm.middlewareArg(L, 2, group.srv)
+		group.mu.Lock()
+		group.middleware = append(group.middleware, middleware)
+		group.mu.Unlock()
+		L.Push(L.Get(1))
+		return 1
+	}))
+
+	return tbl
+}
 
-		L2 := lua.NewState()
-		defer L2.Close()
+func (sm *ServerModule) serverTable(L *lua.LState, srv *httpServer) *lua.LTable {
+	tbl := sm.groupTable(L, srv.root)
+	tbl.RawSetString("id", lua.LString(srv.id))
 
-		ws := L2.NewTable()
-		ws.RawSetString("send", L2.NewFunction(func(L *lua.LState) int {
-			message := L.CheckString(1)
-			if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
-				sm.vm.monitor.handleError(fmt.Errorf("WebSocket send error: %v", err))
-			}
+	fallback := func(set func(routeHandler)) lua.LGFunction {
+		return func(L *lua.LState) int {
+			handler := sm.vm.NewCallback(L, L.CheckFunction(2), nil, "")
+			set(func(w http.ResponseWriter, r *http.Request, params []routeParam) {
+				sm.serveLua(w, r, handler)
+			})
 			return 0
-		}))
-
-		ws.RawSetString("receive", L2.NewFunction(func(L *lua.LState) int {
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				sm.vm.monitor.handleError(fmt.Errorf("WebSocket receive error: %v", err))
-				L.Push(lua.LNil)
-				return 1
-			}
-			L.Push(lua.LString(string(message)))
-			return 1
-		}))
-
-		fn := L2.NewFunctionFromProto(handler.Proto)
-		L2.Push(fn)
-		L2.Push(ws)
-		if err := L2.PCall(1, 0, nil); err != nil {
-			sm.vm.monitor.handleError(fmt.Errorf("WebSocket handler error: %v", err))
 		}
-	})
-
-	return 0
+	}
+	tbl.RawSetString("not_found", L.NewFunction(fallback(srv.router.NotFound)))
+	tbl.RawSetString("method_not_allowed", L.NewFunction(fallback(srv.router.MethodNotAllowed)))
+
+	tbl.RawSetString("broadcast", L.NewFunction(func(L *lua.LState) int {
+		kind, _ := broadcastOptions(L, 4)
+		L.Push(lua.LNumber(srv.hub.broadcast(L.OptString(2, ""), kind, []byte(L.CheckString(3)), nil)))
+		return 1
+	}))
+	tbl.RawSetString("connections", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(len(srv.hub.members(L.OptString(2, "")))))
+		return 1
+	}))
+
+	tbl.RawSetString("start", L.NewFunction(func(L *lua.LState) int {
+		sm.start(srv)
+		return 0
+	}))
+	tbl.RawSetString("stop", L.NewFunction(func(L *lua.LState) int {
+		sm.stop(srv.id)
+		return 0
+	}))
+	// reload_cert loads the certificate files again straight away, instead
+	// of waiting for the next handshake to notice that they changed.
+	tbl.RawSetString("reload_cert", L.NewFunction(func(L *lua.LState) int {
+		if srv.certs == nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString("server does not use TLS"))
+			return 2
+		}
+		if err := srv.certs.reload(); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+	return tbl
 }
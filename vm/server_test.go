@@ -0,0 +1,329 @@
+package vm
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestConfigureServer(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	configure := func(opts string) (*httpServer, error) {
+		t.Helper()
+		if err := L.DoString("return " + opts); err != nil {
+			t.Fatal(err)
+		}
+		defer L.Pop(1)
+		srv := &httpServer{server: &http.Server{Addr: ":8080"}}
+		return srv, configureServer(srv, 8080, L.Get(-1).(*lua.LTable))
+	}
+
+	for host, want := range map[string]string{
+		"127.0.0.1": "127.0.0.1:8080",
+		"::1":       "[::1]:8080",
+		"[::1]":     "[::1]:8080",
+		"localhost": "localhost:8080",
+	} {
+		srv, err := configure(fmt.Sprintf("{ host = %q }", host))
+		if err != nil || srv.server.Addr != want {
+			t.Errorf("host %q: address %q (%v), want %q", host, srv.server.Addr, err, want)
+		}
+	}
+
+	srv, err := configure(`{
+		read_timeout = 1, read_header_timeout = 0.5, write_timeout = 2, idle_timeout = 60,
+		max_header_bytes = 4096, http2 = false, unix_socket = "/tmp/app.sock",
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := srv.server
+	if s.ReadTimeout != time.Second || s.ReadHeaderTimeout != 500*time.Millisecond ||
+		s.WriteTimeout != 2*time.Second || s.IdleTimeout != time.Minute {
+		t.Errorf("timeouts %v %v %v %v", s.ReadTimeout, s.ReadHeaderTimeout, s.WriteTimeout, s.IdleTimeout)
+	}
+	if s.MaxHeaderBytes != 4096 || s.TLSNextProto == nil || len(s.TLSNextProto) != 0 || srv.unixSocket != "/tmp/app.sock" {
+		t.Errorf("max_header_bytes %d, TLSNextProto %v, unix_socket %q", s.MaxHeaderBytes, s.TLSNextProto, srv.unixSocket)
+	}
+	if srv, _ := configure(`{}`); srv.server.TLSNextProto != nil || srv.server.Addr != ":8080" {
+		t.Errorf("defaults changed: %+v", srv.server)
+	}
+
+	for opts, want := range map[string]string{
+		`{ read_timeout = -1 }`:      "read_timeout must not be negative",
+		`{ idle_timeout = "long" }`:  "idle_timeout must be a number",
+		`{ max_header_bytes = 0 }`:   "max_header_bytes must be positive",
+		`{ max_header_bytes = "1" }`: "max_header_bytes must be a number",
+	} {
+		if _, err := configure(opts); err == nil || err.Error() != want {
+			t.Errorf("%s: %v, want %q", opts, err, want)
+		}
+	}
+}
+
+// startTestServer runs a server created with the given options that answers
+// every request with "ok", and stops it when the test ends.
+func startTestServer(t *testing.T, v *SolVM, name string, port int, opts string) {
+	t.Helper()
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server(%q, %d, %s)
+		app:get("/", function(req) return { body = "ok" } end)
+		app:start()
+	`, name, port, opts))
+	t.Cleanup(func() { runLua(t, v, fmt.Sprintf(`stop_server(%q)`, name)) })
+}
+
+func TestServerHostBinding(t *testing.T) {
+	v := newTestVM(t, Config{})
+	port := freePort(t)
+	startTestServer(t, v, "local", port, `{ host = "127.0.0.1" }`)
+	resp, err := http.Get("http://" + waitForServer(t, port) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Bound to the loopback address only, the port stays free elsewhere.
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ip, _, _ := net.ParseCIDR(addr.String())
+		if ip == nil || ip.IsLoopback() || ip.To4() == nil {
+			continue
+		}
+		if conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), fmt.Sprint(port)), time.Second); err == nil {
+			conn.Close()
+			t.Fatalf("server bound to 127.0.0.1 accepted a connection on %s", ip)
+		}
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "app.sock")
+
+	// A socket file left behind by a server that crashed is replaced.
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	v := newTestVM(t, Config{})
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server("sock", 0, { unix_socket = %q })
+		app:get("/", function(req) return { body = "over a socket" } end)
+		app:start()
+	`, socket))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var resp *http.Response
+	waitFor(t, "the socket server", func() bool {
+		resp, err = client.Get("http://unix/")
+		return err == nil
+	})
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "over a socket" {
+		t.Fatalf("body %q", body)
+	}
+
+	runLua(t, v, `stop_server("sock")`)
+	waitFor(t, "the socket file to be removed", func() bool {
+		_, err := os.Stat(socket)
+		return os.IsNotExist(err)
+	})
+}
+
+func TestServerLimits(t *testing.T) {
+	v := newTestVM(t, Config{})
+	port := freePort(t)
+	startTestServer(t, v, "limits", port, `{ read_header_timeout = 0.1, max_header_bytes = 1024 }`)
+	addr := waitForServer(t, port)
+
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	req.Header.Set("X-Large", strings.Repeat("x", 16<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("large headers: status %d, want 431", resp.StatusCode)
+	}
+
+	// A client that connects and never sends its headers is dropped.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection: read %v, want EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("idle connection dropped after %v", elapsed)
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	v := newTestVM(t, Config{})
+	h2Port, h1Port := freePort(t), freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		for name, opts in pairs{
+			h2 = { port = %d },
+			h1 = { port = %d, http2 = false },
+		} do
+			opts.cert, opts.key = %q, %q
+			local app = create_server(name, opts.port, opts)
+			app:get("/", function(req) return { body = req.proto } end)
+			app:start()
+			_G[name] = app
+		end
+	`, h2Port, h1Port, certFile, keyFile))
+	t.Cleanup(func() { runLua(t, v, `stop_server("h1"); stop_server("h2")`) })
+
+	get := func(port int) (string, string) {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://" + waitForServer(t, port) + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if proto, _ := get(h2Port); proto != "HTTP/2.0" {
+		t.Errorf("default server: %s", proto)
+	}
+	if proto, _ := get(h1Port); proto != "HTTP/1.1" {
+		t.Errorf("http2 = false: %s", proto)
+	}
+
+	writeTestCert(t, dir, "second")
+	runLua(t, v, `assert(h1:reload_cert())`)
+	if _, name := get(h1Port); name != "second" {
+		t.Errorf("after reload_cert the server presents %q", name)
+	}
+
+	os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	runLua(t, v, `
+		local ok, err = h1:reload_cert()
+		assert(ok == nil and err:find("failed to load certificate"), tostring(err))
+	`)
+	if _, name := get(h1Port); name != "second" {
+		t.Errorf("after a failed reload the server presents %q", name)
+	}
+}
+
+// In main mode handlers run on the main state, so once the script returns
+// something has to keep serving them: ServeMain does, until no server is
+// left.
+func TestServeMainAfterScriptReturns(t *testing.T) {
+	if err := ValidateCallbackMode("threads"); err == nil {
+		t.Fatal("unknown callback mode accepted")
+	}
+
+	v := newTestVM(t, Config{CallbackMode: CallbackMain})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		hits = 0
+		local app = create_server("main_mode", %d)
+		app:get("/", function(req)
+			hits = hits + 1
+			return { body = tostring(hits) }
+		end)
+		app:get("/stop", function(req)
+			stop_server("main_mode")
+			return { body = "stopping" }
+		end)
+		app:start()
+	`, port))
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		v.ServeMain()
+	}()
+	base := "http://" + waitForServer(t, port)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for want := 1; want <= 2; want++ {
+		resp, err := client.Get(base + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != fmt.Sprint(want) {
+			t.Fatalf("request %d: %q, want the shared counter", want, body)
+		}
+	}
+	if resp, err := client.Get(base + "/stop"); err == nil {
+		resp.Body.Close()
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeMain kept running after the last server stopped")
+	}
+}
+
+func TestResponseStatusIsValidated(t *testing.T) {
+	v := newTestVM(t, Config{})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server("status", %d)
+		app:get("/", function(req, res)
+			for _, call in ipairs({
+				function() res:json({}, 1000) end,
+				function() res:send("body", 99) end,
+				function() res:status(600) end,
+			}) do
+				local ok, err = pcall(call)
+				assert(not ok and tostring(err):find("invalid status code"), tostring(err))
+			end
+			res:send("created", 201)
+		end)
+		app:start()
+	`, port))
+	t.Cleanup(func() { runLua(t, v, `stop_server("status")`) })
+
+	resp, err := http.Get("http://" + waitForServer(t, port) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "created" {
+		t.Fatalf("status %d, body %q", resp.StatusCode, body)
+	}
+}
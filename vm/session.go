@@ -0,0 +1,400 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type storedCookie struct {
+	URL      string    `json:"url"`
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+}
+
+func (c *storedCookie) key() string {
+	return strings.Join([]string{c.URL, c.Domain, c.Path, c.Name}, "|")
+}
+
+func (c *storedCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && c.Expires.Before(now)
+}
+
+// CookieJar is a cookie jar that remembers every cookie it is given so the
+// jar can be listed and saved to a file; net/http/cookiejar can do neither.
+type CookieJar struct {
+	mu      sync.Mutex
+	jar     *cookiejar.Jar
+	path    string
+	entries map[string]*storedCookie
+}
+
+func NewCookieJar(path string) (*CookieJar, error) {
+	jar, _ := cookiejar.New(nil)
+	cj := &CookieJar{
+		jar:     jar,
+		path:    path,
+		entries: make(map[string]*storedCookie),
+	}
+	if path == "" {
+		return cj, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cj, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cookie file: %w", err)
+	}
+
+	var stored []*storedCookie
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("failed to parse cookie file: %w", err)
+		}
+	}
+
+	now := time.Now()
+	for _, c := range stored {
+		if c.expired(now) {
+			continue
+		}
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			continue
+		}
+		cj.entries[c.key()] = c
+		cj.jar.SetCookies(u, []*http.Cookie{c.cookie()})
+	}
+	return cj, nil
+}
+
+func (c *storedCookie) cookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		Expires:  c.Expires,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+	}
+}
+
+func (cj *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	cj.mu.Lock()
+	defer cj.mu.Unlock()
+
+	cj.jar.SetCookies(u, cookies)
+
+	origin := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}).String()
+	now := time.Now()
+	for _, cookie := range cookies {
+		stored := &storedCookie{
+			URL:      origin,
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Domain:   cookie.Domain,
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+		}
+		switch {
+		case cookie.MaxAge > 0:
+			stored.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		case cookie.MaxAge < 0:
+			stored.Expires = now.Add(-time.Second)
+		case !cookie.Expires.IsZero():
+			stored.Expires = cookie.Expires
+		}
+
+		if stored.expired(now) {
+			delete(cj.entries, stored.key())
+		} else {
+			cj.entries[stored.key()] = stored
+		}
+	}
+}
+
+func (cj *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	cj.mu.Lock()
+	defer cj.mu.Unlock()
+	return cj.jar.Cookies(u)
+}
+
+func (cj *CookieJar) Clear() {
+	cj.mu.Lock()
+	defer cj.mu.Unlock()
+
+	cj.jar, _ = cookiejar.New(nil)
+	cj.entries = make(map[string]*storedCookie)
+}
+
+func (cj *CookieJar) list() []*storedCookie {
+	cj.mu.Lock()
+	defer cj.mu.Unlock()
+
+	now := time.Now()
+	cookies := make([]*storedCookie, 0, len(cj.entries))
+	for _, c := range cj.entries {
+		if !c.expired(now) {
+			cookies = append(cookies, c)
+		}
+	}
+	sort.Slice(cookies, func(i, j int) bool {
+		return cookies[i].key() < cookies[j].key()
+	})
+	return cookies
+}
+
+func (cj *CookieJar) Save() error {
+	if cj.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(cj.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cookies: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(cj.path), 0755); err != nil {
+		return fmt.Errorf("failed to create cookie directory: %w", err)
+	}
+
+	tmp := cj.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cookie file: %w", err)
+	}
+	if err := os.Rename(tmp, cj.path); err != nil {
+		return fmt.Errorf("failed to write cookie file: %w", err)
+	}
+	return nil
+}
+
+type httpSession struct {
+	hm         *HTTPModule
+	baseURL    string
+	headers    http.Header
+	timeout    time.Duration
+	hasTimeout bool
+	jar        *CookieJar
+	retry      *RetryPolicy
+	breaker    *BreakerPolicy
+	overrides  []clientOverride
+	cache      string
+}
+
+func (hm *HTTPModule) session(L *lua.LState) int {
+	opts := L.OptTable(1, L.NewTable())
+
+	s := &httpSession{
+		hm:      hm,
+		headers: make(http.Header),
+	}
+	if v, ok := opts.RawGetString("base_url").(lua.LString); ok {
+		s.baseURL = string(v)
+	}
+	if v, ok := opts.RawGetString("headers").(*lua.LTable); ok {
+		eachValue(v, func(key, value string) {
+			s.headers.Add(key, value)
+		})
+	}
+	if v, ok := opts.RawGetString("timeout").(lua.LNumber); ok {
+		s.timeout = secondsToDuration(v)
+		s.hasTimeout = true
+	}
+
+	var err error
+	if s.overrides, err = parseClientOverrides(opts); err != nil {
+		L.ArgError(1, err.Error())
+	}
+	if s.cache, err = parseCacheOption(opts.RawGetString("cache")); err != nil {
+		L.ArgError(1, err.Error())
+	}
+	if s.retry, err = parseRetryPolicy(opts.RawGetString("retry")); err != nil {
+		L.ArgError(1, err.Error())
+	}
+	if s.breaker, err = parseBreakerPolicy(opts.RawGetString("circuit_breaker")); err != nil {
+		L.ArgError(1, err.Error())
+	}
+
+	if opts.RawGetString("cookies") != lua.LFalse {
+		path := ""
+		if v, ok := opts.RawGetString("cookie_file").(lua.LString); ok {
+			path = string(v)
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(hm.vm.workingDir, path)
+			}
+		}
+		jar, err := NewCookieJar(path)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		s.jar = jar
+	}
+
+	L.Push(s.table(L))
+	return 1
+}
+
+func (s *httpSession) resolve(target string) string {
+	if s.baseURL == "" || strings.Contains(target, "://") {
+		return target
+	}
+	if target == "" {
+		return s.baseURL
+	}
+	return strings.TrimRight(s.baseURL, "/") + "/" + strings.TrimLeft(target, "/")
+}
+
+func (s *httpSession) apply(opts *requestOptions) {
+	opts.url = s.resolve(opts.url)
+	for key, values := range s.headers {
+		if _, exists := opts.headers[key]; !exists {
+			opts.headers[key] = values
+		}
+	}
+	if !opts.hasTimeout && s.hasTimeout {
+		opts.timeout = s.timeout
+		opts.hasTimeout = true
+	}
+	if s.jar != nil {
+		opts.jar = s.jar
+	}
+	opts.overrides = append(append([]clientOverride{}, s.overrides...), opts.overrides...)
+	if opts.cache == "" {
+		opts.cache = s.cache
+	}
+	if !opts.hasRetry {
+		opts.retry = s.retry
+	}
+	if !opts.hasBreaker {
+		opts.breaker = s.breaker
+	}
+}
+
+func (s *httpSession) saveCookies() {
+	if s.jar == nil {
+		return
+	}
+	if err := s.jar.Save(); err != nil {
+		s.hm.vm.monitor.handleError(fmt.Errorf("Failed to save session cookies: %v", err))
+	}
+}
+
+func (s *httpSession) call(L *lua.LState, opts *requestOptions, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	s.apply(opts)
+	defer s.saveCookies()
+	return s.hm.perform(L, opts)
+}
+
+func (s *httpSession) method(method string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		target := L.CheckString(2)
+		opts, err := s.hm.parseRequestTable(L.OptTable(3, L.NewTable()))
+		if err == nil {
+			opts.method = method
+			opts.url = target
+		}
+		return s.call(L, opts, err)
+	}
+}
+
+func (s *httpSession) table(L *lua.LState) *lua.LTable {
+	tbl := L.NewTable()
+	if s.baseURL != "" {
+		tbl.RawSetString("base_url", lua.LString(s.baseURL))
+	}
+
+	tbl.RawSetString("request", L.NewFunction(func(L *lua.LState) int {
+		opts, err := s.hm.parseRequestOptions(L, 2)
+		return s.call(L, opts, err)
+	}))
+	tbl.RawSetString("get", L.NewFunction(s.method(http.MethodGet)))
+	tbl.RawSetString("head", L.NewFunction(s.method(http.MethodHead)))
+	tbl.RawSetString("post", L.NewFunction(s.method(http.MethodPost)))
+	tbl.RawSetString("put", L.NewFunction(s.method(http.MethodPut)))
+	tbl.RawSetString("patch", L.NewFunction(s.method(http.MethodPatch)))
+	tbl.RawSetString("delete", L.NewFunction(s.method(http.MethodDelete)))
+
+	tbl.RawSetString("download", L.NewFunction(func(L *lua.LState) int {
+		opts := L.CheckTable(2)
+		reqOpts, err := s.hm.parseRequestTable(opts)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		s.apply(reqOpts)
+		defer s.saveCookies()
+		return s.hm.performDownload(L, reqOpts, opts)
+	}))
+
+	tbl.RawSetString("set_header", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		if value, ok := L.Get(3).(lua.LString); ok {
+			s.headers.Set(name, string(value))
+		} else {
+			s.headers.Del(name)
+		}
+		return 0
+	}))
+
+	tbl.RawSetString("cookies", L.NewFunction(func(L *lua.LState) int {
+		result := L.NewTable()
+		if s.jar == nil {
+			L.Push(result)
+			return 1
+		}
+		for _, c := range s.jar.list() {
+			cookie := L.NewTable()
+			cookie.RawSetString("name", lua.LString(c.Name))
+			cookie.RawSetString("value", lua.LString(c.Value))
+			cookie.RawSetString("url", lua.LString(c.URL))
+			if c.Domain != "" {
+				cookie.RawSetString("domain", lua.LString(c.Domain))
+			}
+			if c.Path != "" {
+				cookie.RawSetString("path", lua.LString(c.Path))
+			}
+			cookie.RawSetString("expires", timeToLua(c.Expires))
+			cookie.RawSetString("secure", lua.LBool(c.Secure))
+			cookie.RawSetString("http_only", lua.LBool(c.HttpOnly))
+			result.Append(cookie)
+		}
+		L.Push(result)
+		return 1
+	}))
+
+	tbl.RawSetString("clear_cookies", L.NewFunction(func(L *lua.LState) int {
+		if s.jar != nil {
+			s.jar.Clear()
+			s.saveCookies()
+		}
+		return 0
+	}))
+
+	return tbl
+}
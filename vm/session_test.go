@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPSessionCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "abc", MaxAge: 3600})
+			http.SetCookie(w, &http.Cookie{Name: "pref", Value: "dark"})
+		case "/logout":
+			http.SetCookie(w, &http.Cookie{Name: "sid", MaxAge: -1})
+		}
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("Cookie"), r.Header.Get("X-App"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	v := newTestVM(t, Config{WorkingDir: dir})
+	runLua(t, v, fmt.Sprintf(`
+		base = %q
+		local api = http.session{
+			base_url = base,
+			headers = { ["X-App"] = "bot" },
+			cookie_file = "state/cookies.json",
+		}
+		assert(api:post("/login"))
+		local body = api:get("whoami").body
+		assert(body == "pref=dark; sid=abc|bot" or body == "sid=abc; pref=dark|bot", body)
+		assert(#api:cookies() == 2)
+
+		api:set_header("X-App", nil)
+		body = api:get("/whoami").body
+		assert(body:sub(-1) == "|", "removed header still sent: " .. body)
+
+		local anonymous = http.session{ base_url = base, cookies = false }
+		anonymous:get("/login")
+		assert(anonymous:get("/whoami").body == "|")
+		assert(#anonymous:cookies() == 0)
+	`, srv.URL))
+
+	path := filepath.Join(dir, "state", "cookies.json")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("cookie file mode %v, want 0600", perm)
+	}
+
+	// A new session with the same file picks the cookies up again.
+	runLua(t, v, `
+		local api = http.session{ base_url = base, cookie_file = "state/cookies.json" }
+		local body = api:get("/whoami").body
+		assert(body:find("sid=abc", 1, true), "cookie not restored: " .. body)
+
+		api:get("/logout")
+		local again = http.session{ base_url = base, cookie_file = "state/cookies.json" }
+		body = again:get("/whoami").body
+		assert(not body:find("sid", 1, true), "deleted cookie restored: " .. body)
+
+		again:clear_cookies()
+		assert(#http.session{ cookie_file = "state/cookies.json" }:cookies() == 0)
+	`)
+}
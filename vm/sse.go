@@ -0,0 +1,290 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const defaultSSERetry = 3 * time.Second
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// sseStream reads a text/event-stream response and, like a browser's
+// EventSource, reconnects with Last-Event-ID when the connection drops.
+type sseStream struct {
+	hm          *HTTPModule
+	opts        *requestOptions
+	reconnect   bool
+	maxAttempts int
+	retry       time.Duration
+	lastID      string
+
+	mu     sync.Mutex
+	body   io.ReadCloser
+	reader *bufio.Reader
+	closed bool
+	err    error
+}
+
+func (hm *HTTPModule) sseConnect(L *lua.LState) int {
+	target := L.CheckString(1)
+	tbl := L.OptTable(2, L.NewTable())
+
+	opts, err := hm.parseRequestTable(tbl)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	opts.url = target
+	opts.stream = true
+	opts.cache = cacheBypass
+	opts.headers.Set("Accept", "text/event-stream")
+	opts.headers.Set("Cache-Control", "no-cache")
+
+	s := &sseStream{
+		hm:        hm,
+		opts:      opts,
+		reconnect: true,
+		retry:     defaultSSERetry,
+	}
+	switch v := tbl.RawGetString("reconnect").(type) {
+	case lua.LBool:
+		s.reconnect = bool(v)
+	case lua.LNumber:
+		s.maxAttempts = int(v)
+	}
+	if v, ok := tbl.RawGetString("retry").(lua.LNumber); ok {
+		s.retry = secondsToDuration(v)
+	}
+	if v, ok := tbl.RawGetString("last_event_id").(lua.LString); ok {
+		s.lastID = string(v)
+	}
+
+	if err := s.connect(); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(s.table(L))
+	return 1
+}
+
+// sseFatal marks errors after which an EventSource must not reconnect. A
+// 204 response ends the stream without being an error.
+type sseFatal struct {
+	err   error
+	ended bool
+}
+
+func (e sseFatal) Error() string {
+	return e.err.Error()
+}
+
+func (s *sseStream) connect() error {
+	if s.lastID != "" {
+		s.opts.headers.Set("Last-Event-ID", s.lastID)
+	}
+	req, err := s.hm.newRequest(s.opts)
+	if err != nil {
+		return sseFatal{err: err}
+	}
+	client, err := s.hm.clientFor(s.opts)
+	if err != nil {
+		return sseFatal{err: err}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return sseFatal{err: fmt.Errorf("unexpected status %s", resp.Status), ended: resp.StatusCode == http.StatusNoContent}
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		resp.Body.Close()
+		return sseFatal{err: fmt.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		resp.Body.Close()
+		return sseFatal{err: fmt.Errorf("stream closed")}
+	}
+	s.body = resp.Body
+	s.reader = bufio.NewReader(resp.Body)
+	return nil
+}
+
+func (s *sseStream) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// next returns the next event, or nil once the stream has ended for good.
+func (s *sseStream) next() *sseEvent {
+	for !s.isClosed() {
+		if event, err := s.read(); err == nil {
+			return event
+		} else if !s.recover(err) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *sseStream) recover(cause error) bool {
+	if s.isClosed() {
+		return false
+	}
+	s.body.Close()
+	if !s.reconnect {
+		if cause != io.EOF {
+			s.err = cause
+		}
+		return false
+	}
+
+	for attempt := 1; s.maxAttempts <= 0 || attempt <= s.maxAttempts; attempt++ {
+		s.hm.vm.monitor.emit("sse.reconnect", map[string]interface{}{
+			"url":           s.opts.url,
+			"attempt":       attempt,
+			"reason":        cause.Error(),
+			"delay":         s.retry.Seconds(),
+			"last_event_id": s.lastID,
+		})
+		s.hm.vm.clock.Sleep(s.retry)
+		if s.isClosed() {
+			return false
+		}
+
+		err := s.connect()
+		if err == nil {
+			return true
+		}
+		if fatal, ok := err.(sseFatal); ok {
+			if !fatal.ended {
+				s.err = err
+			}
+			return false
+		}
+		cause = err
+	}
+	s.err = cause
+	return false
+}
+
+// read parses lines until a complete event has been dispatched, following
+// the event stream interpretation rules of the HTML specification.
+func (s *sseStream) read() (*sseEvent, error) {
+	var data strings.Builder
+	hasData := false
+	eventType := ""
+
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		if line == "" {
+			if !hasData {
+				eventType = ""
+				continue
+			}
+			if eventType == "" {
+				eventType = "message"
+			}
+			return &sseEvent{id: s.lastID, event: eventType, data: data.String()}, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				s.lastID = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				s.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+func (s *sseStream) table(L *lua.LState) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("url", lua.LString(s.opts.url))
+
+	next := func(L *lua.LState) int {
+		event := s.next()
+		if event == nil {
+			L.Push(lua.LNil)
+			return 1
+		}
+		result := L.NewTable()
+		result.RawSetString("id", lua.LString(event.id))
+		result.RawSetString("event", lua.LString(event.event))
+		result.RawSetString("data", lua.LString(event.data))
+		L.Push(result)
+		return 1
+	}
+	tbl.RawSetString("next", L.NewFunction(next))
+
+	tbl.RawSetString("last_event_id", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(s.lastID))
+		return 1
+	}))
+	tbl.RawSetString("error", L.NewFunction(func(L *lua.LState) int {
+		if s.err == nil {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LString(s.err.Error()))
+		}
+		return 1
+	}))
+	tbl.RawSetString("close", L.NewFunction(func(L *lua.LState) int {
+		s.mu.Lock()
+		s.closed = true
+		body := s.body
+		s.mu.Unlock()
+		body.Close()
+		return 0
+	}))
+
+	meta := L.NewTable()
+	meta.RawSetString("__call", L.NewFunction(next))
+	L.SetMetatable(tbl, meta)
+	return tbl
+}
@@ -0,0 +1,235 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const defaultSSEHeartbeat = 15 * time.Second
+
+// sseWriter serializes writes to an event stream, which come from the Lua
+// handler and from the heartbeat goroutine.
+type sseWriter struct {
+	mu     sync.Mutex
+	rw     *responseWriter
+	ctx    context.Context
+	closed bool
+}
+
+func (s *sseWriter) write(payload string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.ctx.Err() != nil {
+		return errors.New("closed")
+	}
+	if _, err := s.rw.Write([]byte(payload)); err != nil {
+		s.closed = true
+		return errors.New("closed")
+	}
+	s.rw.Flush()
+	return nil
+}
+
+func (s *sseWriter) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+func (s *sseWriter) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed || s.ctx.Err() != nil
+}
+
+func (sm *ServerModule) handleSSE(L *lua.LState) int {
+	srv := sm.server(L, L.CheckString(1))
+	sm.sse(L, srv.root, L.CheckString(2), 3)
+	return 0
+}
+
+// sse registers an event stream route on group, with the handler and
+// options read from the stack starting at arg.
+func (sm *ServerModule) sse(L *lua.LState, group *routeGroup, path string, arg int) {
+	handler := sm.vm.NewCallback(L, L.CheckFunction(arg), nil, "")
+	opts := L.OptTable(arg+1, L.NewTable())
+
+	heartbeat := defaultSSEHeartbeat
+	switch v := opts.RawGetString("heartbeat").(type) {
+	case lua.LNumber:
+		heartbeat = secondsToDuration(v)
+	case lua.LBool:
+		if !v {
+			heartbeat = 0
+		}
+	case *lua.LNilType:
+	default:
+		L.ArgError(arg+1, "heartbeat must be a number or false")
+	}
+
+	pattern := joinPaths(group.prefix, path)
+	group.srv.router.Handle(http.MethodGet, pattern, sm.route(group, pattern, func(w http.ResponseWriter, r *http.Request) {
+		// The handler must be able to run cleanup code after the client
+		// disconnects, so its state is not tied to the request context.
+		sm.withLua(w, r, handler.Mode(), true, func(lr *luaRequest) error {
+			return sm.serveSSE(r.Context(), lr.L, lr.rw, lr.r, lr.req, handler, heartbeat)
+		})
+	}))
+}
+
+// serveSSE opens the event stream and runs the handler until it returns.
+// Once ctx is done the client has gone away: sends fail and wait returns
+// false so the handler can stop.
+func (sm *ServerModule) serveSSE(ctx context.Context, L *lua.LState, rw *responseWriter, r *http.Request, req *lua.LTable, handler *Callback, heartbeat time.Duration) error {
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	rw.Flush()
+	// The stream outlives the server's read and write timeouts, which are
+	// meant for ordinary requests.
+	rc := http.NewResponseController(rw)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	stream := &sseWriter{rw: rw, ctx: ctx}
+	defer stream.close()
+
+	if heartbeat > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				case <-sm.vm.clock.After(heartbeat):
+					if stream.write(":\n\n") != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	if _, err := handler.CallOn(L, 0, sm.sseStreamTable(L, stream, r), req); err != nil {
+		return fmt.Errorf("SSE handler error: %v", err)
+	}
+	return nil
+}
+
+func (sm *ServerModule) sseStreamTable(L *lua.LState, stream *sseWriter, r *http.Request) *lua.LTable {
+	tbl := L.NewTable()
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		tbl.RawSetString("last_event_id", lua.LString(id))
+	}
+
+	tbl.RawSetString("send", L.NewFunction(func(L *lua.LState) int {
+		var event strings.Builder
+		switch v := L.Get(2).(type) {
+		case *lua.LTable:
+			if err := formatSSEEvent(&event, v); err != nil {
+				L.ArgError(2, err.Error())
+			}
+		default:
+			writeSSEData(&event, L.CheckString(2))
+		}
+		event.WriteString("\n")
+		return pushStreamResult(L, stream.write(event.String()))
+	}))
+
+	tbl.RawSetString("comment", L.NewFunction(func(L *lua.LState) int {
+		var comment strings.Builder
+		for _, line := range splitSSELines(L.OptString(2, "")) {
+			comment.WriteString(": " + line + "\n")
+		}
+		comment.WriteString("\n")
+		return pushStreamResult(L, stream.write(comment.String()))
+	}))
+
+	tbl.RawSetString("closed", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(stream.isClosed()))
+		return 1
+	}))
+
+	tbl.RawSetString("wait", L.NewFunction(func(L *lua.LState) int {
+		select {
+		case <-sm.vm.clock.After(secondsToDuration(L.CheckNumber(2))):
+		case <-stream.ctx.Done():
+		}
+		L.Push(lua.LBool(!stream.isClosed()))
+		return 1
+	}))
+
+	tbl.RawSetString("close", L.NewFunction(func(L *lua.LState) int {
+		stream.close()
+		return 0
+	}))
+
+	return tbl
+}
+
+func pushStreamResult(L *lua.LState, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// formatSSEEvent writes the fields of an event table. Table data is sent as
+// JSON and retry is given in seconds, like every other duration in SolVM.
+func formatSSEEvent(b *strings.Builder, tbl *lua.LTable) error {
+	switch id := tbl.RawGetString("id").(type) {
+	case lua.LString, lua.LNumber:
+		if strings.ContainsAny(id.String(), "\r\n\x00") {
+			return fmt.Errorf("event id must not contain newlines")
+		}
+		b.WriteString("id: " + id.String() + "\n")
+	}
+	if v, ok := tbl.RawGetString("event").(lua.LString); ok {
+		if strings.ContainsAny(string(v), "\r\n") {
+			return fmt.Errorf("event name must not contain newlines")
+		}
+		b.WriteString("event: " + string(v) + "\n")
+	}
+	if v, ok := tbl.RawGetString("retry").(lua.LNumber); ok {
+		fmt.Fprintf(b, "retry: %d\n", secondsToDuration(v).Milliseconds())
+	}
+
+	switch data := tbl.RawGetString("data").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		encoded, err := json.Marshal(convertToGoValue(data))
+		if err != nil {
+			return fmt.Errorf("failed to encode data: %v", err)
+		}
+		writeSSEData(b, string(encoded))
+	default:
+		writeSSEData(b, data.String())
+	}
+	return nil
+}
+
+func writeSSEData(b *strings.Builder, data string) {
+	for _, line := range splitSSELines(data) {
+		b.WriteString("data: " + line + "\n")
+	}
+}
+
+func splitSSELines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.Split(strings.ReplaceAll(text, "\r", "\n"), "\n")
+}
@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestSSEEventFormat(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	tests := []struct {
+		event, want, err string
+	}{
+		{`{ data = "hi" }`, "data: hi\n", ""},
+		{`{ id = 7, event = "update", retry = 1.5, data = "a" }`, "id: 7\nevent: update\nretry: 1500\ndata: a\n", ""},
+		{`{ data = "one\r\ntwo\rthree\nfour" }`, "data: one\ndata: two\ndata: three\ndata: four\n", ""},
+		{`{ data = "" }`, "data: \n", ""},
+		{`{ data = { n = 1 } }`, "data: {\"n\":1}\n", ""},
+		{`{ event = "ping" }`, "event: ping\n", ""},
+		{`{ id = "a\nb", data = "x" }`, "", "event id must not contain newlines"},
+		{`{ event = "a\rb" }`, "", "event name must not contain newlines"},
+	}
+	for _, tt := range tests {
+		if err := L.DoString("return " + tt.event); err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		err := formatSSEEvent(&b, L.Get(-1).(*lua.LTable))
+		L.Pop(1)
+		switch {
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%s: error %v, want %q", tt.event, err, tt.err)
+		case tt.err == "" && (err != nil || b.String() != tt.want):
+			t.Errorf("%s: %q (%v), want %q", tt.event, b.String(), err, tt.want)
+		}
+	}
+}
+
+func TestSSEStream(t *testing.T) {
+	v := newTestVM(t, Config{})
+	port := freePort(t)
+	done := filepath.Join(t.TempDir(), "done")
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server("sse", %d)
+		app:sse("/events", function(stream, req)
+			stream:send{ id = 7, event = "greeting", data = "hello\nworld" }
+			stream:send("resuming after " .. tostring(stream.last_event_id))
+			stream:comment("note")
+			while stream:wait(0.02) do end
+
+			local ok, err = stream:send("too late")
+			local f = io.open(%q, "w")
+			f:write(tostring(stream:closed()), " ", tostring(ok), " ", tostring(err))
+			f:close()
+		end, { heartbeat = 0.05 })
+		app:start()
+	`, port, done))
+	t.Cleanup(func() { runLua(t, v, `stop_server("sse")`) })
+
+	req, _ := http.NewRequest("GET", "http://"+waitForServer(t, port)+"/events", nil)
+	req.Header.Set("Last-Event-ID", "6")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+
+	events := "id: 7\nevent: greeting\ndata: hello\ndata: world\n\n" +
+		"data: resuming after 6\n\n" +
+		": note\n\n"
+	reader := bufio.NewReader(resp.Body)
+	var got strings.Builder
+	for !strings.HasSuffix(got.String(), ":\n\n") || got.Len() <= len(events) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended after %q: %v", got.String(), err)
+		}
+		got.WriteString(line)
+	}
+	// Heartbeats may arrive between the events but must not break them up.
+	if stream := strings.ReplaceAll(got.String(), ":\n\n", ""); stream != strings.ReplaceAll(events, ":\n\n", "") {
+		t.Fatalf("stream %q, want %q followed by a heartbeat", got.String(), events)
+	}
+
+	resp.Body.Close()
+	var result []byte
+	waitFor(t, "the handler to notice the disconnect", func() bool {
+		result, _ = os.ReadFile(done)
+		return len(result) > 0
+	})
+	if string(result) != "true nil closed" {
+		t.Fatalf("after disconnecting: closed, send result = %q", result)
+	}
+}
@@ -0,0 +1,277 @@
+package vm
+
+import (
+	"fmt"
+	"html"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type staticOptions struct {
+	index    []string
+	listing  bool
+	gzip     bool
+	spa      string
+	dotfiles bool
+	maxAge   int
+}
+
+// staticHandler serves files below root. Every path is resolved through
+// symlinks and must stay inside root, so neither ".." segments nor links
+// can reach files outside the served directory.
+type staticHandler struct {
+	root string
+	opts staticOptions
+}
+
+func (sm *ServerModule) serveStatic(L *lua.LState) int {
+	srv := sm.server(L, L.CheckString(1))
+	sm.static(L, srv.root, L.CheckString(2), 3)
+	return 0
+}
+
+// static registers a static file route on group for the prefix, with the
+// directory and options read from the stack starting at arg.
+func (sm *ServerModule) static(L *lua.LState, group *routeGroup, prefix string, arg int) {
+	dir := L.CheckString(arg)
+	opts, err := parseStaticOptions(L.OptTable(arg+1, L.NewTable()))
+	if err != nil {
+		L.ArgError(arg+1, err.Error())
+	}
+
+	root := dir
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(sm.vm.workingDir, root)
+	}
+	root, err = filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		L.ArgError(arg, fmt.Sprintf("invalid static directory: %v", err))
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		L.ArgError(arg, fmt.Sprintf("%s is not a directory", dir))
+	}
+
+	handler := &staticHandler{root: root, opts: opts}
+	pattern := joinPaths(joinPaths(group.prefix, prefix), "*filepath")
+	group.srv.router.Handle(http.MethodGet, pattern, sm.route(group, pattern, func(w http.ResponseWriter, r *http.Request) {
+		handler.serve(w, r, requestStateOf(r).routeParams())
+	}))
+}
+
+func parseStaticOptions(tbl *lua.LTable) (staticOptions, error) {
+	opts := staticOptions{index: []string{"index.html"}, gzip: true}
+
+	switch v := tbl.RawGetString("index").(type) {
+	case lua.LString:
+		opts.index = []string{string(v)}
+	case lua.LBool:
+		if !v {
+			opts.index = nil
+		}
+	case *lua.LTable:
+		opts.index = nil
+		for i := 1; i <= v.Len(); i++ {
+			opts.index = append(opts.index, lua.LVAsString(v.RawGetInt(i)))
+		}
+	case *lua.LNilType:
+	default:
+		return opts, fmt.Errorf("index must be a string, an array of strings or false")
+	}
+
+	switch v := tbl.RawGetString("spa").(type) {
+	case lua.LString:
+		opts.spa = string(v)
+	case lua.LBool:
+		if v {
+			opts.spa = "index.html"
+		}
+	case *lua.LNilType:
+	default:
+		return opts, fmt.Errorf("spa must be a boolean or a file name")
+	}
+
+	if v, ok := tbl.RawGetString("gzip").(lua.LBool); ok {
+		opts.gzip = bool(v)
+	}
+	opts.listing = lua.LVAsBool(tbl.RawGetString("listing"))
+	opts.dotfiles = lua.LVAsBool(tbl.RawGetString("dotfiles"))
+	if v, ok := tbl.RawGetString("max_age").(lua.LNumber); ok {
+		opts.maxAge = int(v)
+	}
+	return opts, nil
+}
+
+// resolve maps a URL path below the prefix to a file inside the root. It
+// reports false for anything that is hidden or would escape the root; the
+// returned path may not exist.
+func (h *staticHandler) resolve(name string) (string, bool) {
+	if strings.ContainsRune(name, 0) || strings.Contains(name, "\\") {
+		return "", false
+	}
+	clean := path.Clean("/" + name)
+	if !h.opts.dotfiles {
+		for _, part := range strings.Split(clean, "/") {
+			if strings.HasPrefix(part, ".") {
+				return "", false
+			}
+		}
+	}
+
+	full := filepath.Join(h.root, filepath.FromSlash(clean))
+	resolved, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return full, true
+		}
+		return "", false
+	}
+	if !h.contains(resolved) {
+		return "", false
+	}
+	return resolved, true
+}
+
+func (h *staticHandler) contains(resolved string) bool {
+	return resolved == h.root || strings.HasPrefix(resolved, h.root+string(filepath.Separator))
+}
+
+func (h *staticHandler) serve(w http.ResponseWriter, r *http.Request, params []routeParam) {
+	name := ""
+	if len(params) > 0 {
+		name = params[len(params)-1].value
+	}
+
+	full, ok := h.resolve(name)
+	if !ok {
+		writeError(w, r, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	info, err := os.Stat(full)
+	if err == nil && info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := r.URL.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		for _, index := range h.opts.index {
+			if indexInfo, err := os.Stat(filepath.Join(full, index)); err == nil && !indexInfo.IsDir() {
+				h.serveFile(w, r, filepath.Join(full, index), indexInfo)
+				return
+			}
+		}
+		if h.opts.listing {
+			h.serveListing(w, r, full)
+			return
+		}
+		err = fs.ErrNotExist
+	}
+
+	if err != nil {
+		if h.opts.spa != "" && path.Ext(name) == "" {
+			if fallback, ok := h.resolve(h.opts.spa); ok {
+				if info, err := os.Stat(fallback); err == nil && !info.IsDir() {
+					h.serveFile(w, r, fallback, info)
+					return
+				}
+			}
+		}
+		writeError(w, r, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	h.serveFile(w, r, full, info)
+}
+
+// serveFile sends a file with an ETag derived from its size and modification
+// time, preferring a precompressed name.gz next to it when the client
+// accepts gzip. http.ServeContent handles Range and conditional requests.
+func (h *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, full string, info os.FileInfo) {
+	contentType := mime.TypeByExtension(filepath.Ext(full))
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+
+	if h.opts.gzip {
+		gzPath, err := filepath.EvalSymlinks(full + ".gz")
+		if gzInfo, statErr := os.Stat(gzPath); err == nil && statErr == nil && !gzInfo.IsDir() && h.contains(gzPath) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if acceptsGzip(r) {
+				if contentType == "" {
+					contentType = "application/octet-stream"
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				full, info = gzPath, gzInfo
+				etag = fmt.Sprintf(`"%x-%x-gz"`, info.ModTime().UnixNano(), info.Size())
+			}
+		}
+	}
+
+	file, err := os.Open(full)
+	if err != nil {
+		writeError(w, r, "404 page not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", etag)
+	if h.opts.maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", h.opts.maxAge))
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+func (h *staticHandler) serveListing(w http.ResponseWriter, r *http.Request, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		writeError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	var b strings.Builder
+	b.WriteString("<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n<pre>\n")
+	for _, entry := range entries {
+		name := entry.Name()
+		if !h.opts.dotfiles && strings.HasPrefix(name, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			name += "/"
+		}
+		link := url.URL{Path: name}
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", link.String(), html.EscapeString(name))
+	}
+	b.WriteString("</pre>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
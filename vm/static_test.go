@@ -0,0 +1,39 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticDirRelativeToWorkingDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "public"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "public", "hello.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := newTestVM(t, Config{WorkingDir: dir})
+	port := freePort(t)
+	runLua(t, v, fmt.Sprintf(`
+		local app = create_server("static", %d)
+		app:static("/files", "public")
+		app:start()
+	`, port))
+	t.Cleanup(func() { runLua(t, v, `stop_server("static")`) })
+
+	resp, err := http.Get("http://" + waitForServer(t, port) + "/files/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("got %d %q, want 200 \"hello\"", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,95 @@
+package vm
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often a handshake may look at the certificate
+// files for changes.
+const certCheckInterval = 5 * time.Second
+
+// certCache holds a server's TLS key pair. Handshakes share the loaded
+// certificate, which is loaded again once the files on disk change, so
+// renewed certificates are picked up without restarting the server.
+type certCache struct {
+	clock    Clock
+	certFile string
+	keyFile  string
+	onError  func(error)
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	stamp   string
+	checked time.Time
+}
+
+func newCertCache(clock Clock, certFile, keyFile string, onError func(error)) (*certCache, error) {
+	c := &certCache{clock: clock, certFile: certFile, keyFile: keyFile, onError: onError}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// fileStamp identifies the current version of the certificate files.
+func (c *certCache) fileStamp() (string, error) {
+	stamp := ""
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d/%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp, nil
+}
+
+// reload loads the key pair from disk. The previous certificate stays in
+// use if that fails.
+func (c *certCache) reload() error {
+	stamp, err := c.fileStamp()
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.stamp = stamp
+	c.checked = c.clock.Now()
+	return nil
+}
+
+func (c *certCache) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	now := c.clock.Now()
+	if now.Sub(c.checked) < certCheckInterval {
+		cert := c.cert
+		c.mu.Unlock()
+		return cert, nil
+	}
+	c.checked = now
+	stamp := c.stamp
+	c.mu.Unlock()
+
+	// A file that is briefly missing or half written while it is being
+	// replaced fails to load; the old certificate is used until the next
+	// check.
+	if current, err := c.fileStamp(); err == nil && current != stamp {
+		if err := c.reload(); err != nil && c.onError != nil {
+			c.onError(err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
@@ -0,0 +1,124 @@
+package vm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var certGeneration atomic.Int64
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with the
+// given common name to dir and returns the certificate and key paths. The
+// files' modification time is moved forward on every call so a rewrite is
+// always noticed.
+func writeTestCert(t *testing.T, dir, commonName string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	mtime := time.Now().Add(time.Duration(certGeneration.Add(1)) * time.Second)
+	for path, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertCacheReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	clock := NewFakeClock(time.Now())
+	var errs []error
+	certs, err := newCertCache(clock, certFile, keyFile, func(err error) { errs = append(errs, err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := func() string {
+		cert, err := certs.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return commonName(t, cert)
+	}
+
+	if name := current(); name != "first" {
+		t.Fatalf("loaded %q", name)
+	}
+
+	writeTestCert(t, dir, "second")
+	if name := current(); name != "first" {
+		t.Fatalf("files checked again within %v: %q", certCheckInterval, name)
+	}
+	clock.Advance(certCheckInterval)
+	if name := current(); name != "second" {
+		t.Fatalf("renewed certificate not picked up: %q", name)
+	}
+
+	// A half-written file keeps the previous certificate in use.
+	os.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600)
+	clock.Advance(certCheckInterval)
+	if name := current(); name != "second" || len(errs) != 1 {
+		t.Fatalf("after a failed reload: %q, %d errors", name, len(errs))
+	}
+	if err := certs.reload(); err == nil {
+		t.Fatal("reload of an invalid certificate succeeded")
+	}
+
+	writeTestCert(t, dir, "third")
+	if err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := current(); name != "third" {
+		t.Fatalf("after reload: %q", name)
+	}
+
+	if _, err := newCertCache(clock, filepath.Join(dir, "missing.pem"), keyFile, nil); err == nil {
+		t.Fatal("missing certificate file was accepted")
+	}
+}
@@ -0,0 +1,160 @@
+package vm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// HTTPClientConfig controls how outbound connections are made. Proxy may be
+// an http, https or socks5 URL, or "none" to ignore the proxy environment
+// variables. CAFile adds a PEM bundle to the system roots, and CertFile and
+// KeyFile present a client certificate for mutual TLS.
+type HTTPClientConfig struct {
+	Proxy              string
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// Validate reports a proxy, CA bundle or client certificate that cannot be
+// used. Requests made with a bad per-request configuration fail with the
+// same error, but the global configuration should be checked up front.
+func (cfg HTTPClientConfig) Validate() error {
+	_, err := newHTTPTransport(cfg)
+	return err
+}
+
+type clientOverride func(cfg *HTTPClientConfig)
+
+type errorTransport struct {
+	err error
+}
+
+func (t errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, t.err
+}
+
+func newHTTPTransport(cfg HTTPClientConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = httpTimeout
+
+	switch cfg.Proxy {
+	case "":
+	case "none":
+		transport.Proxy = nil
+	default:
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", cfg.Proxy)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" && cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// transportFor returns a shared transport for cfg, so requests with the same
+// TLS and proxy settings reuse connections. Failures are not cached: a CA
+// file or certificate that is missing now may be there for the next request.
+func (hm *HTTPModule) transportFor(cfg HTTPClientConfig) (http.RoundTripper, error) {
+	key := fmt.Sprintf("%+v", cfg)
+
+	hm.transportMu.Lock()
+	defer hm.transportMu.Unlock()
+
+	if transport, exists := hm.transports[key]; exists {
+		return transport, nil
+	}
+
+	base, err := newHTTPTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport := hm.vm.httpMock.Wrap(base)
+	hm.transports[key] = transport
+	return transport, nil
+}
+
+func parseClientOverrides(tbl *lua.LTable) ([]clientOverride, error) {
+	var overrides []clientOverride
+
+	switch v := tbl.RawGetString("proxy").(type) {
+	case lua.LString:
+		proxy := string(v)
+		overrides = append(overrides, func(cfg *HTTPClientConfig) { cfg.Proxy = proxy })
+	case lua.LBool:
+		if !v {
+			overrides = append(overrides, func(cfg *HTTPClientConfig) { cfg.Proxy = "none" })
+		}
+	case *lua.LNilType:
+	default:
+		return nil, fmt.Errorf("proxy must be a URL string or false")
+	}
+
+	tlsOpts, ok := tbl.RawGetString("tls").(*lua.LTable)
+	if !ok {
+		return overrides, nil
+	}
+	if v, ok := tlsOpts.RawGetString("ca_file").(lua.LString); ok {
+		overrides = append(overrides, func(cfg *HTTPClientConfig) { cfg.CAFile = string(v) })
+	}
+	if v, ok := tlsOpts.RawGetString("cert_file").(lua.LString); ok {
+		overrides = append(overrides, func(cfg *HTTPClientConfig) { cfg.CertFile = string(v) })
+	}
+	if v, ok := tlsOpts.RawGetString("key_file").(lua.LString); ok {
+		overrides = append(overrides, func(cfg *HTTPClientConfig) { cfg.KeyFile = string(v) })
+	}
+	if v, ok := tlsOpts.RawGetString("server_name").(lua.LString); ok {
+		overrides = append(overrides, func(cfg *HTTPClientConfig) { cfg.ServerName = string(v) })
+	}
+	if v, ok := tlsOpts.RawGetString("insecure_skip_verify").(lua.LBool); ok {
+		overrides = append(overrides, func(cfg *HTTPClientConfig) { cfg.InsecureSkipVerify = bool(v) })
+	}
+	return overrides, nil
+}
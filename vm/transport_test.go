@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPClientConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  HTTPClientConfig
+		err  string
+	}{
+		{"empty", HTTPClientConfig{}, ""},
+		{"no proxy", HTTPClientConfig{Proxy: "none"}, ""},
+		{"missing CA file", HTTPClientConfig{CAFile: filepath.Join(dir, "missing.pem")}, "failed to read CA file"},
+		{"CA file without certificates", HTTPClientConfig{CAFile: notPEM}, "no certificates found"},
+		{"missing client certificate", HTTPClientConfig{CertFile: filepath.Join(dir, "cert.pem")}, "failed to load client certificate"},
+		{"key without certificate", HTTPClientConfig{KeyFile: notPEM}, "failed to load client certificate"},
+		{"bad proxy scheme", HTTPClientConfig{Proxy: "ftp://proxy:21"}, "unsupported proxy scheme"},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// A CA file that is missing for one request must not keep failing the
+// requests made once it exists.
+func TestTransportErrorsAreNotCached(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+
+	v := newTestVM(t, Config{})
+	request := fmt.Sprintf(`http.request{ url = %q, tls = { ca_file = %q } }`, srv.URL, caFile)
+	runLua(t, v, fmt.Sprintf(`
+		local resp, err = %s
+		assert(resp == nil and err:find("failed to read CA file"), tostring(err))
+	`, request))
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runLua(t, v, fmt.Sprintf(`
+		local resp, err = %s
+		assert(resp and resp.body == "ok", tostring(err))
+	`, request))
+}
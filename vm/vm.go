@@ -23,6 +23,10 @@ type Config struct {
 	MemoryLimit   int64
 	MaxGoroutines int
 	WorkingDir    string
+	JobStore      string
+	FakeClock     bool
+	CallbackMode  string
+	HTTP          HTTPClientConfig
 }
 
 type ScopeNode struct {
@@ -60,6 +64,14 @@ type SolVM struct {
 	memoryLimit   int64
 	maxGoroutines int
 	workingDir    string
+	jobStore      string
+	clock         Clock
+	httpMock      *HTTPMock
+	httpConfig    HTTPClientConfig
+	callbackMode  string
+	callbackPool  *sync.Pool
+	builtins      map[string]lua.LValue
+	tasks         chan mainTask
 	modules       map[string]Module
 	moduleMu      sync.RWMutex
 	startMem      runtime.MemStats
@@ -91,6 +103,11 @@ func NewSolVM(config Config) *SolVM {
 		memoryLimit:   config.MemoryLimit,
 		maxGoroutines: config.MaxGoroutines,
 		workingDir:    config.WorkingDir,
+		jobStore:      config.JobStore,
+		clock:         realClock{},
+		callbackMode:  config.CallbackMode,
+		httpConfig:    config.HTTP,
+		tasks:         make(chan mainTask),
 		modules:       make(map[string]Module),
 		scopeTree: &ScopeNode{
 			Variables: make(map[string]bool),
@@ -100,6 +117,18 @@ func NewSolVM(config Config) *SolVM {
 		functionCache: NewFunctionCache(),
 	}
 
+	if config.FakeClock {
+		vm.clock = NewFakeClock(time.Now())
+	}
+	if vm.callbackMode == "" {
+		vm.callbackMode = CallbackIsolated
+	}
+	vm.callbackPool = &sync.Pool{
+		New: func() interface{} {
+			return vm.newCallbackState()
+		},
+	}
+
 	runtime.ReadMemStats(&vm.startMem)
 	vm.initializeModules()
 	vm.registerBuiltinModules()
@@ -108,6 +137,7 @@ func NewSolVM(config Config) *SolVM {
 }
 
 func (vm *SolVM) initializeModules() {
+	vm.httpMock = NewHTTPMock()
 	vm.importMod = NewImportModule(vm)
 	vm.concMod = NewConcurrencyModule(vm)
 	vm.monitor = NewMonitorModule(vm)
@@ -128,9 +158,9 @@ func (vm *SolVM) registerBuiltinModules() {
 	modules.RegisterTextModule(vm.state)
 	modules.RegisterCryptoModule(vm.state)
 	modules.RegisterDotenvModule(vm.state)
-	modules.RegisterDatetimeModule(vm.state)
+	modules.RegisterDatetimeModule(vm.state, vm.clock, vm.sleepFor)
 	modules.RegisterCSVModule(vm.state)
-	modules.RegisterFTModule(vm.state)
+	modules.RegisterFTModule(vm.state, vm.httpMod.streamClient)
 	modules.RegisterINIModule(vm.state)
 	modules.RegisterTARModule(vm.state)
 	modules.RegisterTemplateModule(vm.state)
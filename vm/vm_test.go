@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// stuckVMs holds VMs whose script never returned. Closing one would wait
+// forever for the lock the script holds.
+var stuckVMs sync.Map
+
+// newTestVM returns a VM with every builtin registered, closed when the
+// test ends.
+func newTestVM(t *testing.T, config Config) *SolVM {
+	t.Helper()
+	if config.WorkingDir == "" {
+		config.WorkingDir = t.TempDir()
+	}
+	v := NewSolVM(config)
+	v.RegisterCustomFunctions()
+	t.Cleanup(func() {
+		if _, stuck := stuckVMs.Load(v); !stuck {
+			v.Close()
+		}
+	})
+	return v
+}
+
+// runLua runs code on the VM's main state and fails the test if it raises
+// an error.
+func runLua(t *testing.T, v *SolVM, code string) {
+	t.Helper()
+	if err := v.LoadString(code); err != nil {
+		t.Fatalf("lua error: %v", err)
+	}
+}
+
+// runLuaWithin is runLua for code that could block, failing the test
+// instead of hanging.
+func runLuaWithin(t *testing.T, v *SolVM, d time.Duration, code string) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- v.LoadString(code)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("lua error: %v", err)
+		}
+	case <-time.After(d):
+		stuckVMs.Store(v, true)
+		t.Fatalf("script did not finish within %s", d)
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitForServer waits until a server started by a script accepts
+// connections on port and returns its address.
+func waitForServer(t *testing.T, port int) string {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if i == 100 {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// evalLua returns the value of a Lua expression on the VM's main state.
+func evalLua(t *testing.T, v *SolVM, expr string) lua.LValue {
+	t.Helper()
+	runLua(t, v, "__result = "+expr)
+	return v.state.GetGlobal("__result")
+}
+
+// waitFor polls cond until it holds, failing the test after five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
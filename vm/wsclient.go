@@ -0,0 +1,367 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const wsCloseWait = time.Second
+
+type wsMessage struct {
+	kind int
+	data []byte
+}
+
+// wsClient is an outbound WebSocket connection. A single goroutine reads
+// frames into a channel, so receive can time out without breaking the
+// connection, and reconnects in the background when the connection drops.
+type wsClient struct {
+	hm             *HTTPModule
+	url            string
+	header         http.Header
+	dialer         *websocket.Dialer
+	reconnect      *RetryPolicy
+	maxMessageSize int64
+	pingInterval   time.Duration
+	pongTimeout    time.Duration
+
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	closing  bool
+	finalErr error
+	writeMu  sync.Mutex
+	messages chan wsMessage
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (hm *HTTPModule) wsConnect(L *lua.LState) int {
+	target := L.CheckString(1)
+	tbl := L.OptTable(2, L.NewTable())
+
+	opts, err := hm.parseRequestTable(tbl)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	opts.url = target
+	req, err := hm.newRequest(opts)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	cfg := hm.vm.httpConfig
+	for _, override := range opts.overrides {
+		override(&cfg)
+	}
+	transport, err := newHTTPTransport(cfg)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            transport.Proxy,
+		TLSClientConfig:  transport.TLSClientConfig,
+		HandshakeTimeout: httpTimeout,
+	}
+	if opts.hasTimeout {
+		dialer.HandshakeTimeout = opts.timeout
+	}
+	if protocols, ok := tbl.RawGetString("subprotocols").(*lua.LTable); ok {
+		for i := 1; i <= protocols.Len(); i++ {
+			dialer.Subprotocols = append(dialer.Subprotocols, lua.LVAsString(protocols.RawGetInt(i)))
+		}
+	}
+
+	c := &wsClient{
+		hm:       hm,
+		url:      req.URL.String(),
+		header:   req.Header,
+		dialer:   dialer,
+		messages: make(chan wsMessage, 64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if v := tbl.RawGetString("reconnect"); v != lua.LNil {
+		if c.reconnect, err = parseRetryPolicy(v); err != nil {
+			L.ArgError(2, "reconnect must be a boolean, number or table")
+		}
+	}
+	if v, ok := tbl.RawGetString("max_message_size").(lua.LNumber); ok {
+		c.maxMessageSize = int64(v)
+	}
+	if v, ok := tbl.RawGetString("ping_interval").(lua.LNumber); ok {
+		c.pingInterval = secondsToDuration(v)
+		c.pongTimeout = c.pingInterval
+	}
+	if v, ok := tbl.RawGetString("pong_timeout").(lua.LNumber); ok {
+		c.pongTimeout = secondsToDuration(v)
+	}
+
+	if err := c.dial(); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	go c.readLoop()
+	if c.pingInterval > 0 {
+		go c.pingLoop()
+	}
+
+	L.Push(c.table(L))
+	return 1
+}
+
+func (c *wsClient) dial() error {
+	conn, resp, err := c.dialer.Dial(c.url, c.header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%v (status %d)", err, resp.StatusCode)
+		}
+		return err
+	}
+	if c.maxMessageSize > 0 {
+		conn.SetReadLimit(c.maxMessageSize)
+	}
+	if c.pingInterval > 0 {
+		deadline := c.pingInterval + c.pongTimeout
+		conn.SetReadDeadline(time.Now().Add(deadline))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(deadline))
+		})
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *wsClient) current() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *wsClient) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+func (c *wsClient) readLoop() {
+	defer close(c.done)
+	defer close(c.messages)
+
+	for {
+		conn := c.current()
+		kind, data, err := conn.ReadMessage()
+		if err == nil {
+			select {
+			case c.messages <- wsMessage{kind: kind, data: data}:
+			case <-c.stop:
+			}
+			continue
+		}
+
+		conn.Close()
+		if c.isClosing() || c.reconnect == nil || !wsShouldReconnect(err) {
+			c.finish(err)
+			return
+		}
+		if err := c.redial(err); err != nil {
+			c.finish(err)
+			return
+		}
+	}
+}
+
+// wsShouldReconnect reports whether err means the connection was lost rather
+// than closed on purpose: network errors and the close codes servers send
+// when going away or restarting. A message over max_message_size would only
+// arrive again, and a connection closed on this side was closed on purpose.
+func wsShouldReconnect(err error) bool {
+	if errors.Is(err, websocket.ErrReadLimit) || errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return true
+	}
+	switch closeErr.Code {
+	case websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseInternalServerErr,
+		websocket.CloseServiceRestart, websocket.CloseTryAgainLater:
+		return true
+	}
+	return false
+}
+
+func (c *wsClient) redial(cause error) error {
+	for attempt := 1; attempt <= c.reconnect.Attempts; attempt++ {
+		delay := c.reconnect.delay(attempt, nil, c.hm.vm.clock.Now())
+		c.hm.vm.monitor.emit("ws.reconnect", map[string]interface{}{
+			"url":     c.url,
+			"attempt": attempt,
+			"reason":  cause.Error(),
+			"delay":   delay.Seconds(),
+		})
+		select {
+		case <-c.hm.vm.clock.After(delay):
+		case <-c.stop:
+			return cause
+		}
+
+		err := c.dial()
+		if err == nil {
+			return nil
+		}
+		cause = err
+	}
+	return cause
+}
+
+func (c *wsClient) finish(err error) {
+	c.mu.Lock()
+	c.finalErr = err
+	c.mu.Unlock()
+}
+
+func (c *wsClient) pingLoop() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.current().WriteControl(websocket.PingMessage, nil, time.Now().Add(c.pongTimeout))
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsClient) write(kind int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.current().WriteMessage(kind, data)
+}
+
+// closeResult converts the error that ended the connection into receive's
+// return values: nil, message and, for close frames, the code and reason.
+func (c *wsClient) closeResult(L *lua.LState) int {
+	c.mu.Lock()
+	err := c.finalErr
+	c.mu.Unlock()
+
+	L.Push(lua.LNil)
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		L.Push(lua.LString("closed"))
+		L.Push(lua.LNumber(closeErr.Code))
+		L.Push(lua.LString(closeErr.Text))
+		return 4
+	}
+	if err == nil {
+		L.Push(lua.LString("closed"))
+		return 2
+	}
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+func (c *wsClient) table(L *lua.LState) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("url", lua.LString(c.url))
+
+	send := func(kind int) lua.LGFunction {
+		return func(L *lua.LState) int {
+			if err := c.write(kind, []byte(L.CheckString(2))); err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LTrue)
+			return 1
+		}
+	}
+	tbl.RawSetString("send", L.NewFunction(send(websocket.TextMessage)))
+	tbl.RawSetString("send_binary", L.NewFunction(send(websocket.BinaryMessage)))
+
+	tbl.RawSetString("receive", L.NewFunction(func(L *lua.LState) int {
+		var timeout <-chan time.Time
+		if v, ok := L.Get(2).(lua.LNumber); ok {
+			timeout = c.hm.vm.clock.After(secondsToDuration(v))
+		}
+
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				return c.closeResult(L)
+			}
+			L.Push(lua.LString(msg.data))
+			if msg.kind == websocket.BinaryMessage {
+				L.Push(lua.LString("binary"))
+			} else {
+				L.Push(lua.LString("text"))
+			}
+			return 2
+		case <-timeout:
+			L.Push(lua.LNil)
+			L.Push(lua.LString("timeout"))
+			return 2
+		}
+	}))
+
+	tbl.RawSetString("ping", L.NewFunction(func(L *lua.LState) int {
+		data := []byte(L.OptString(2, ""))
+		if err := c.current().WriteControl(websocket.PingMessage, data, time.Now().Add(httpTimeout)); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	tbl.RawSetString("subprotocol", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(c.current().Subprotocol()))
+		return 1
+	}))
+
+	tbl.RawSetString("close", L.NewFunction(func(L *lua.LState) int {
+		code := L.OptInt(2, websocket.CloseNormalClosure)
+		reason := L.OptString(3, "")
+
+		c.mu.Lock()
+		alreadyClosing := c.closing
+		c.closing = true
+		c.mu.Unlock()
+		if alreadyClosing {
+			return 0
+		}
+		close(c.stop)
+
+		conn := c.current()
+		message := websocket.FormatCloseMessage(code, reason)
+		if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsCloseWait)); err == nil {
+			select {
+			case <-c.done:
+			case <-time.After(wsCloseWait):
+			}
+		}
+		conn.Close()
+		return 0
+	}))
+
+	return tbl
+}
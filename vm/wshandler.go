@@ -0,0 +1,515 @@
+package vm
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultWSMaxMessageSize = 1 << 20
+	wsWriteTimeout          = 10 * time.Second
+	// wsSendQueue is how many broadcast messages may wait for a slow
+	// client before it is disconnected.
+	wsSendQueue = 256
+)
+
+// wsHub tracks the WebSocket connections of one server and the rooms they
+// have joined, so a message can be published to every member of a room.
+type wsHub struct {
+	mu    sync.RWMutex
+	conns map[*wsConn]struct{}
+	rooms map[string]map[*wsConn]struct{}
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{
+		conns: make(map[*wsConn]struct{}),
+		rooms: make(map[string]map[*wsConn]struct{}),
+	}
+}
+
+func (h *wsHub) add(c *wsConn) {
+	h.mu.Lock()
+	h.conns[c] = struct{}{}
+	h.mu.Unlock()
+}
+
+func (h *wsHub) remove(c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, c)
+	for room, members := range h.rooms {
+		delete(members, c)
+		if len(members) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+}
+
+func (h *wsHub) join(c *wsConn, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[*wsConn]struct{})
+	}
+	h.rooms[room][c] = struct{}{}
+}
+
+func (h *wsHub) leave(c *wsConn, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.rooms[room], c)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+func (h *wsHub) roomsOf(c *wsConn) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var rooms []string
+	for room, members := range h.rooms {
+		if _, ok := members[c]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// members returns the connections in room, or every connection when room
+// is empty.
+func (h *wsHub) members(room string) []*wsConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	set := h.conns
+	if room != "" {
+		set = h.rooms[room]
+	}
+	conns := make([]*wsConn, 0, len(set))
+	for c := range set {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// broadcast queues a message for the members of room except skip and
+// returns how many connections accepted it. It never waits for a client.
+func (h *wsHub) broadcast(room string, kind int, data []byte, skip *wsConn) int {
+	sent := 0
+	for _, c := range h.members(room) {
+		if c != skip && c.enqueue(kind, data) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// wsConn is an accepted WebSocket connection. Like wsClient, one goroutine
+// reads frames into a channel so receive can time out. Broadcasts go
+// through a per-connection queue drained by writeLoop, so a stalled client
+// only holds up its own messages; writes are serialized with ws:send.
+type wsConn struct {
+	id       string
+	conn     *websocket.Conn
+	hub      *wsHub
+	clock    Clock
+	writeMu  sync.Mutex
+	messages chan wsMessage
+	outbox   chan wsMessage
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu       sync.Mutex
+	closing  bool
+	finalErr error
+}
+
+type wsOptions struct {
+	upgrader       websocket.Upgrader
+	maxMessageSize int64
+	pingInterval   time.Duration
+	pongTimeout    time.Duration
+}
+
+func parseWSOptions(tbl *lua.LTable) (*wsOptions, error) {
+	opts := &wsOptions{
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+		maxMessageSize: defaultWSMaxMessageSize,
+	}
+
+	switch v := tbl.RawGetString("origins").(type) {
+	case *lua.LTable:
+		var origins []string
+		for i := 1; i <= v.Len(); i++ {
+			origins = append(origins, lua.LVAsString(v.RawGetInt(i)))
+		}
+		opts.upgrader.CheckOrigin = allowOrigins(origins)
+	case lua.LString:
+		opts.upgrader.CheckOrigin = allowOrigins([]string{string(v)})
+	case *lua.LNilType:
+	default:
+		return nil, fmt.Errorf("origins must be a string or an array of strings")
+	}
+
+	if protocols, ok := tbl.RawGetString("subprotocols").(*lua.LTable); ok {
+		for i := 1; i <= protocols.Len(); i++ {
+			opts.upgrader.Subprotocols = append(opts.upgrader.Subprotocols, lua.LVAsString(protocols.RawGetInt(i)))
+		}
+	}
+	if v, ok := tbl.RawGetString("max_message_size").(lua.LNumber); ok {
+		opts.maxMessageSize = int64(v)
+	}
+	if v, ok := tbl.RawGetString("ping_interval").(lua.LNumber); ok {
+		opts.pingInterval = secondsToDuration(v)
+		opts.pongTimeout = opts.pingInterval
+	}
+	if v, ok := tbl.RawGetString("pong_timeout").(lua.LNumber); ok {
+		opts.pongTimeout = secondsToDuration(v)
+	}
+	return opts, nil
+}
+
+// allowOrigins accepts requests whose Origin is in the list ("*" allows any).
+// Requests without an Origin header do not come from browsers and are always
+// accepted.
+func allowOrigins(origins []string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowed := range origins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (sm *ServerModule) handleWebSocket(L *lua.LState) int {
+	srv := sm.server(L, L.CheckString(1))
+	sm.ws(L, srv.root, L.CheckString(2), 3)
+	return 0
+}
+
+// ws registers a WebSocket route on group, with the handler and options
+// read from the stack starting at arg.
+func (sm *ServerModule) ws(L *lua.LState, group *routeGroup, path string, arg int) {
+	handler := sm.vm.NewCallback(L, L.CheckFunction(arg), nil, "")
+	opts, err := parseWSOptions(L.OptTable(arg+1, L.NewTable()))
+	if err != nil {
+		L.ArgError(arg+1, err.Error())
+	}
+
+	pattern := joinPaths(group.prefix, path)
+	group.srv.router.Handle(http.MethodGet, pattern, sm.route(group, pattern, func(w http.ResponseWriter, r *http.Request) {
+		// As with event streams, the handler runs until the connection
+		// closes and must not be aborted by the hijacked request's context.
+		sm.withLua(w, r, handler.Mode(), true, func(lr *luaRequest) error {
+			return sm.serveWebSocket(lr.L, lr.rw, lr.r, group.srv, lr.req, handler, opts)
+		})
+	}))
+}
+
+func (sm *ServerModule) serveWebSocket(L *lua.LState, rw *responseWriter, r *http.Request, srv *httpServer, req *lua.LTable, handler *Callback, opts *wsOptions) error {
+	conn, err := opts.upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		// The upgrader has already answered the request.
+		return nil
+	}
+	if opts.maxMessageSize > 0 {
+		conn.SetReadLimit(opts.maxMessageSize)
+	}
+
+	c := newWSConn(conn, srv.hub, sm.vm.clock)
+	defer srv.hub.remove(c)
+
+	if opts.pingInterval > 0 {
+		deadline := opts.pingInterval + opts.pongTimeout
+		conn.SetReadDeadline(time.Now().Add(deadline))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(deadline))
+		})
+		go c.pingLoop(opts.pingInterval, opts.pongTimeout)
+	}
+	go c.readLoop()
+	go c.writeLoop()
+
+	_, err = handler.CallOn(L, 0, c.table(L), req)
+	c.close(websocket.CloseNormalClosure, "")
+	if err != nil {
+		return fmt.Errorf("WebSocket handler error: %v", err)
+	}
+	return nil
+}
+
+// newWSConn registers conn with hub. The caller starts readLoop and
+// writeLoop once any pong handler is in place.
+func newWSConn(conn *websocket.Conn, hub *wsHub, clock Clock) *wsConn {
+	c := &wsConn{
+		id:       uuid.NewString(),
+		conn:     conn,
+		hub:      hub,
+		clock:    clock,
+		messages: make(chan wsMessage, 64),
+		outbox:   make(chan wsMessage, wsSendQueue),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	hub.add(c)
+	return c
+}
+
+func (c *wsConn) readLoop() {
+	defer close(c.done)
+	defer close(c.messages)
+	for {
+		kind, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.mu.Lock()
+			c.finalErr = err
+			c.mu.Unlock()
+			c.conn.Close()
+			return
+		}
+		select {
+		case c.messages <- wsMessage{kind: kind, data: data}:
+		case <-c.stop:
+		}
+	}
+}
+
+func (c *wsConn) pingLoop(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// writeLoop sends queued broadcasts until the connection ends. A failed
+// write drops the connection, which in turn ends the read loop.
+func (c *wsConn) writeLoop() {
+	for {
+		select {
+		case msg := <-c.outbox:
+			if err := c.write(msg.kind, msg.data); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// enqueue queues a broadcast message. A client whose queue is full is
+// too slow to keep up and is disconnected rather than buffered forever.
+func (c *wsConn) enqueue(kind int, data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.outbox <- wsMessage{kind: kind, data: data}:
+		return true
+	default:
+		go c.close(websocket.CloseTryAgainLater, "too slow")
+		return false
+	}
+}
+
+func (c *wsConn) write(kind int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteMessage(kind, data)
+}
+
+// close sends a close frame, waits briefly for the client to answer it and
+// then drops the connection. Only the first call has any effect.
+func (c *wsConn) close(code int, reason string) {
+	c.mu.Lock()
+	alreadyClosing := c.closing
+	c.closing = true
+	c.mu.Unlock()
+	if alreadyClosing {
+		return
+	}
+
+	close(c.stop)
+
+	message := websocket.FormatCloseMessage(code, reason)
+	if err := c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsCloseWait)); err == nil {
+		select {
+		case <-c.done:
+		case <-time.After(wsCloseWait):
+		}
+	}
+	c.conn.Close()
+}
+
+func (c *wsConn) closeResult(L *lua.LState) int {
+	c.mu.Lock()
+	err := c.finalErr
+	c.mu.Unlock()
+
+	L.Push(lua.LNil)
+	L.Push(lua.LString("closed"))
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		L.Push(lua.LNumber(closeErr.Code))
+		L.Push(lua.LString(closeErr.Text))
+		return 4
+	}
+	return 2
+}
+
+// broadcastOptions reads the optional table of ws:broadcast and
+// server:broadcast.
+func broadcastOptions(L *lua.LState, n int) (kind int, includeSelf bool) {
+	kind = websocket.TextMessage
+	if opts, ok := L.Get(n).(*lua.LTable); ok {
+		if lua.LVAsBool(opts.RawGetString("binary")) {
+			kind = websocket.BinaryMessage
+		}
+		includeSelf = lua.LVAsBool(opts.RawGetString("include_self"))
+	}
+	return kind, includeSelf
+}
+
+// table builds the Lua connection object. Handlers written for the first
+// version call ws.send(msg) and ws.receive() with a dot, so every method
+// accepts being called either way.
+func (c *wsConn) table(L *lua.LState) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("id", lua.LString(c.id))
+	tbl.RawSetString("remote_addr", lua.LString(c.conn.RemoteAddr().String()))
+
+	base := func(L *lua.LState) int {
+		if L.Get(1) == tbl {
+			return 2
+		}
+		return 1
+	}
+
+	send := func(kind int) lua.LGFunction {
+		return func(L *lua.LState) int {
+			if err := c.write(kind, []byte(L.CheckString(base(L)))); err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LTrue)
+			return 1
+		}
+	}
+	tbl.RawSetString("send", L.NewFunction(send(websocket.TextMessage)))
+	tbl.RawSetString("send_binary", L.NewFunction(send(websocket.BinaryMessage)))
+
+	tbl.RawSetString("receive", L.NewFunction(func(L *lua.LState) int {
+		var timeout <-chan time.Time
+		if v, ok := L.Get(base(L)).(lua.LNumber); ok {
+			timeout = c.clock.After(secondsToDuration(v))
+		}
+
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				return c.closeResult(L)
+			}
+			L.Push(lua.LString(msg.data))
+			if msg.kind == websocket.BinaryMessage {
+				L.Push(lua.LString("binary"))
+			} else {
+				L.Push(lua.LString("text"))
+			}
+			return 2
+		case <-timeout:
+			L.Push(lua.LNil)
+			L.Push(lua.LString("timeout"))
+			return 2
+		}
+	}))
+
+	tbl.RawSetString("ping", L.NewFunction(func(L *lua.LState) int {
+		data := []byte(L.OptString(base(L), ""))
+		if err := c.conn.WriteControl(websocket.PingMessage, data, time.Now().Add(wsWriteTimeout)); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	tbl.RawSetString("subprotocol", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(c.conn.Subprotocol()))
+		return 1
+	}))
+
+	tbl.RawSetString("close", L.NewFunction(func(L *lua.LState) int {
+		n := base(L)
+		c.close(L.OptInt(n, websocket.CloseNormalClosure), L.OptString(n+1, ""))
+		return 0
+	}))
+
+	tbl.RawSetString("join", L.NewFunction(func(L *lua.LState) int {
+		c.hub.join(c, L.CheckString(base(L)))
+		return 0
+	}))
+
+	tbl.RawSetString("leave", L.NewFunction(func(L *lua.LState) int {
+		c.hub.leave(c, L.CheckString(base(L)))
+		return 0
+	}))
+
+	tbl.RawSetString("rooms", L.NewFunction(func(L *lua.LState) int {
+		rooms := L.NewTable()
+		for _, room := range c.hub.roomsOf(c) {
+			rooms.Append(lua.LString(room))
+		}
+		L.Push(rooms)
+		return 1
+	}))
+
+	tbl.RawSetString("broadcast", L.NewFunction(func(L *lua.LState) int {
+		n := base(L)
+		room := L.OptString(n, "")
+		message := L.CheckString(n + 1)
+		kind, includeSelf := broadcastOptions(L, n+2)
+		skip := c
+		if includeSelf {
+			skip = nil
+		}
+		L.Push(lua.LNumber(c.hub.broadcast(room, kind, []byte(message), skip)))
+		return 1
+	}))
+
+	return tbl
+}
+
+func (sm *ServerModule) wsBroadcast(L *lua.LState) int {
+	srv := sm.server(L, L.CheckString(1))
+	kind, _ := broadcastOptions(L, 4)
+	L.Push(lua.LNumber(srv.hub.broadcast(L.OptString(2, ""), kind, []byte(L.CheckString(3)), nil)))
+	return 1
+}
@@ -0,0 +1,171 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// wsPair accepts WebSocket connections into hub and returns a function
+// that dials a new client, along with the server side of each connection.
+func wsPair(t *testing.T, hub *wsHub, clock Clock) func() (*websocket.Conn, *wsConn) {
+	t.Helper()
+	accepted := make(chan *wsConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := newWSConn(conn, hub, clock)
+		go c.readLoop()
+		go c.writeLoop()
+		accepted <- c
+	}))
+	t.Cleanup(srv.Close)
+
+	return func() (*websocket.Conn, *wsConn) {
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		c := <-accepted
+		t.Cleanup(func() { c.conn.Close() })
+		return client, c
+	}
+}
+
+func TestWSBroadcastDoesNotWaitForSlowClient(t *testing.T) {
+	hub := newWSHub()
+	dial := wsPair(t, hub, realClock{})
+	_, slow := dial()
+	fast, _ := dial()
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for {
+			if _, _, err := fast.ReadMessage(); err != nil {
+				return
+			}
+			n++
+			received <- n
+		}
+	}()
+
+	// The slow client never reads, so its socket buffers fill up and the
+	// writer stalls; broadcasting must keep going regardless.
+	payload := []byte(strings.Repeat("x", 64<<10))
+	const messages = wsSendQueue * 4
+	start := time.Now()
+	for i := 0; i < messages; i++ {
+		hub.broadcast("", websocket.BinaryMessage, payload, nil)
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fast client stopped receiving after %d messages", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > wsWriteTimeout/2 {
+		t.Fatalf("broadcasting took %v", elapsed)
+	}
+
+	select {
+	case <-slow.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client was not disconnected")
+	}
+}
+
+func TestWSReceiveTimeoutUsesVMClock(t *testing.T) {
+	fc := NewFakeClock(time.Now())
+	_, c := wsPair(t, newWSHub(), fc)()
+
+	L := lua.NewState()
+	defer L.Close()
+	tbl := c.table(L)
+
+	done := make(chan string)
+	go func() {
+		L.Push(tbl.RawGetString("receive"))
+		L.Push(tbl)
+		L.Push(lua.LNumber(60))
+		L.Call(2, 2)
+		done <- L.Get(-1).String()
+	}()
+
+	select {
+	case status := <-done:
+		t.Fatalf("receive returned %q before the clock moved", status)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for {
+		fc.Advance(time.Minute)
+		select {
+		case status := <-done:
+			if status != "timeout" {
+				t.Fatalf("receive returned %q, want timeout", status)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestWSShouldReconnect(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network error", &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{"going away", &websocket.CloseError{Code: websocket.CloseGoingAway}, true},
+		{"abnormal closure", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, true},
+		{"normal closure", &websocket.CloseError{Code: websocket.CloseNormalClosure}, false},
+		{"policy violation", &websocket.CloseError{Code: websocket.ClosePolicyViolation}, false},
+		{"message too big", websocket.ErrReadLimit, false},
+		{"closed locally", &net.OpError{Op: "read", Err: net.ErrClosed}, false},
+		{"close sent", websocket.ErrCloseSent, false},
+	}
+	for _, tt := range tests {
+		if got := wsShouldReconnect(tt.err); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A message over max_message_size ends the connection for good: it would
+// only be sent again after reconnecting.
+func TestWSClientDoesNotReconnectAfterReadLimit(t *testing.T) {
+	var dials atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dials.Add(1)
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 100)))
+		conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	v := newTestVM(t, Config{})
+	runLuaWithin(t, v, 5*time.Second, fmt.Sprintf(`
+		local conn = assert(ws_connect(%q, { max_message_size = 10, reconnect = { attempts = 3, backoff = 0.01 } }))
+		local message, err = conn:receive(5)
+		assert(message == nil and err ~= "timeout", "receive: " .. tostring(message) .. " " .. tostring(err))
+	`, "ws"+strings.TrimPrefix(srv.URL, "http")))
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("%d connections, want no reconnect", n)
+	}
+}